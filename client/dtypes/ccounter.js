@@ -0,0 +1,79 @@
+// CCounter class.
+// Mostly mirrors server/dtypes/ccounter/ccounter.go.
+
+var _ = require('lodash');
+var inherits = require('inherits');
+
+var cvalue = require('./cvalue');
+
+////////////////////////////////////////////////////////////
+// Events
+
+inherits(Add, cvalue.Event);
+function Add(isLocal, delta, total) {
+  cvalue.Event.call(this, isLocal);
+  this.delta = delta;
+  this.total = total;
+}
+
+////////////////////////////////////////////////////////////
+// CCounter
+
+inherits(CCounter, cvalue.CValue);
+function CCounter(p, n) {
+  cvalue.CValue.call(this);
+  this.p_ = p;  // map of agent id to positive tally
+  this.n_ = n;  // map of agent id to negative tally
+}
+
+// Implements CValue.dtype.
+CCounter.prototype.dtype = function() {
+  return cvalue.dtypeCCounter;
+};
+
+// Decodes the given string into a CCounter.
+function decode(s) {
+  var x = JSON.parse(s);
+  return new CCounter(x.P || {}, x.N || {});
+}
+
+// Implements CValue.applyPatch.
+CCounter.prototype.applyPatch = function(isLocal, patch) {
+  if (isLocal) {
+    this.paused_ = false;
+  }
+  var x = JSON.parse(patch);
+  var prev = this.get();
+  this.p_[x.AgentId] = Math.max(this.p_[x.AgentId] || 0, x.P);
+  this.n_[x.AgentId] = Math.max(this.n_[x.AgentId] || 0, x.N);
+  var total = this.get();
+  if (total !== prev) {
+    this.emit('add', new Add(isLocal, total - prev, total));
+  }
+};
+
+// Returns the counter's value.
+CCounter.prototype.get = function() {
+  return _.sum(_.values(this.p_)) - _.sum(_.values(this.n_));
+};
+
+// Adds the given integer, which may be negative, to this counter.
+CCounter.prototype.add = function(delta) {
+  if (this.paused_) {
+    throw new Error('paused');
+  }
+  if (!_.isInteger(delta)) {
+    throw new Error('not an integer: ' + delta);
+  }
+  this.paused_ = true;
+  this.emit('patch', JSON.stringify({Add: delta}));
+};
+
+////////////////////////////////////////////////////////////
+// Exports
+
+module.exports = {
+  Add: Add,
+  CCounter: CCounter,
+  decode: decode
+};
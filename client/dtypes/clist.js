@@ -0,0 +1,354 @@
+// CList class.
+// Mostly mirrors server/dtypes/clist/clist.go.
+
+var _ = require('lodash');
+var inherits = require('inherits');
+
+var cvalue = require('./cvalue');
+var lib = require('../lib');
+var logoot = require('./logoot');
+
+////////////////////////////////////////////////////////////
+// Events
+
+inherits(InsertEvent, cvalue.Event);
+function InsertEvent(isLocal, pos, value) {
+  cvalue.Event.call(this, isLocal);
+  this.pos = pos;
+  this.value = value;
+}
+
+inherits(RemoveEvent, cvalue.Event);
+function RemoveEvent(isLocal, pos, value) {
+  cvalue.Event.call(this, isLocal);
+  this.pos = pos;
+  this.value = value;
+}
+
+inherits(MoveEvent, cvalue.Event);
+function MoveEvent(isLocal, from, to) {
+  cvalue.Event.call(this, isLocal);
+  this.from = from;
+  this.to = to;
+}
+
+////////////////////////////////////////////////////////////
+// CList
+
+// Note: Time is a string of decimal digits, since nanosecond timestamps are not
+// representable as JS numbers.
+function Stamp(time, agentId) {
+  this.time = time;
+  this.agentId = agentId;
+}
+
+Stamp.prototype.less = function(other) {
+  if (this.time.length !== other.time.length) {
+    return this.time.length < other.time.length;
+  } else if (this.time !== other.time) {
+    return this.time < other.time;
+  }
+  return this.agentId < other.agentId;
+};
+
+Stamp.prototype.encode = function() {
+  return [this.time, this.agentId].join('.');
+};
+
+function decodeStamp(s) {
+  var parts = s.split('.');
+  if (parts.length !== 2 || !/^\d+$/.test(parts[0])) {
+    throw new Error('invalid stamp: ' + s);
+  }
+  return new Stamp(parts[0], lib.atoi(parts[1]));
+}
+
+function encodeOptionalPid(pid) {
+  return pid ? pid.encode() : '';
+}
+
+function decodeOptionalPid(s) {
+  return s ? logoot.decodePid(s) : null;
+}
+
+function Op() {}
+
+Op.prototype.encode = function() {
+  throw new Error('not implemented');
+};
+
+inherits(ClientInsert, Op);
+function ClientInsert(prevPid, nextPid, values) {
+  Op.call(this);
+  this.prevPid = prevPid;
+  this.nextPid = nextPid;
+  this.values = values;
+}
+
+ClientInsert.prototype.encode = function() {
+  return ['ci', encodeOptionalPid(this.prevPid),
+          encodeOptionalPid(this.nextPid),
+          JSON.stringify(this.values)].join(',');
+};
+
+inherits(ClientMove, Op);
+function ClientMove(id, prevPid, nextPid) {
+  Op.call(this);
+  this.id = id;
+  this.prevPid = prevPid;
+  this.nextPid = nextPid;
+}
+
+ClientMove.prototype.encode = function() {
+  return ['cm', this.id.encode(), encodeOptionalPid(this.prevPid),
+          encodeOptionalPid(this.nextPid)].join(',');
+};
+
+inherits(Insert, Op);
+function Insert(pid, value) {
+  Op.call(this);
+  this.pid = pid;
+  this.value = value;
+}
+
+Insert.prototype.encode = function() {
+  return ['i', this.pid.encode(), JSON.stringify(this.value)].join(',');
+};
+
+inherits(Remove, Op);
+function Remove(id) {
+  Op.call(this);
+  this.id = id;
+}
+
+Remove.prototype.encode = function() {
+  return ['d', this.id.encode()].join(',');
+};
+
+inherits(Move, Op);
+function Move(id, pid, stamp) {
+  Op.call(this);
+  this.id = id;
+  this.pid = pid;
+  this.stamp = stamp;
+}
+
+Move.prototype.encode = function() {
+  return ['m', this.id.encode(), this.pid.encode(), this.stamp.encode()]
+    .join(',');
+};
+
+function newParseError(s) {
+  return new Error('failed to parse op: ' + s);
+}
+
+function decodeOp(s) {
+  var parts;
+  var t = s.split(',', 1)[0];
+  switch (t) {
+  case 'ci':
+    parts = lib.splitN(s, ',', 4);
+    if (parts.length < 4) {
+      throw newParseError(s);
+    }
+    return new ClientInsert(decodeOptionalPid(parts[1]),
+                            decodeOptionalPid(parts[2]),
+                            JSON.parse(parts[3]));
+  case 'cm':
+    parts = lib.splitN(s, ',', 4);
+    if (parts.length < 4) {
+      throw newParseError(s);
+    }
+    return new ClientMove(logoot.decodePid(parts[1]),
+                          decodeOptionalPid(parts[2]),
+                          decodeOptionalPid(parts[3]));
+  case 'i':
+    parts = lib.splitN(s, ',', 3);
+    if (parts.length < 3) {
+      throw newParseError(s);
+    }
+    return new Insert(logoot.decodePid(parts[1]), JSON.parse(parts[2]));
+  case 'd':
+    parts = lib.splitN(s, ',', 2);
+    if (parts.length < 2) {
+      throw newParseError(s);
+    }
+    return new Remove(logoot.decodePid(parts[1]));
+  case 'm':
+    parts = lib.splitN(s, ',', 4);
+    if (parts.length < 4) {
+      throw newParseError(s);
+    }
+    return new Move(logoot.decodePid(parts[1]), logoot.decodePid(parts[2]),
+                    decodeStamp(parts[3]));
+  default:
+    throw new Error('unknown op type: ' + t);
+  }
+}
+
+function encodePatch(ops) {
+  return JSON.stringify(_.map(ops, function(op) {
+    return op.encode();
+  }));
+}
+
+function decodePatch(s) {
+  return _.map(JSON.parse(s), decodeOp);
+}
+
+function Elem(id, pid, stamp, value) {
+  this.id = id;
+  this.pid = pid;
+  this.stamp = stamp;
+  this.value = value;
+}
+
+inherits(CList, cvalue.CValue);
+function CList(elems) {
+  cvalue.CValue.call(this);
+  this.elems_ = elems;  // sorted by pid
+  this.ids_ = {};  // map of encoded id to Elem
+  for (var i = 0; i < elems.length; i++) {
+    this.ids_[elems[i].id.encode()] = elems[i];
+  }
+}
+
+// Implements CValue.dtype.
+CList.prototype.dtype = function() {
+  return cvalue.dtypeCList;
+};
+
+// Decodes the given string into a CList.
+function decode(s) {
+  var elems = JSON.parse(s) || [];
+  return new CList(_.map(elems, function(elem) {
+    return new Elem(logoot.decodePid(elem.Id), logoot.decodePid(elem.Pid),
+                    decodeStamp(elem.Stamp), elem.Value);
+  }));
+}
+
+// Implements CValue.applyPatch.
+CList.prototype.applyPatch = function(isLocal, patch) {
+  if (isLocal) {
+    this.paused_ = false;
+  }
+  var ops = decodePatch(patch);
+  for (var i = 0; i < ops.length; i++) {
+    var op = ops[i], elem, pos;
+    if (op instanceof Insert) {
+      var idStr = op.pid.encode();
+      if (_.has(this.ids_, idStr)) {
+        continue;
+      }
+      elem = new Elem(op.pid, op.pid, new Stamp('0', 0), op.value);
+      this.ids_[idStr] = elem;
+      pos = this.search_(elem.pid);
+      this.elems_.splice(pos, 0, elem);
+      this.emit('insert', new InsertEvent(isLocal, pos, elem.value));
+    } else if (op instanceof Remove) {
+      elem = this.ids_[op.id.encode()];
+      if (!elem) {
+        continue;
+      }
+      delete this.ids_[op.id.encode()];
+      pos = this.search_(elem.pid);
+      this.elems_.splice(pos, 1);
+      this.emit('remove', new RemoveEvent(isLocal, pos, elem.value));
+    } else if (op instanceof Move) {
+      elem = this.ids_[op.id.encode()];
+      if (!elem || op.stamp.less(elem.stamp)) {
+        continue;
+      }
+      var from = this.search_(elem.pid);
+      this.elems_.splice(from, 1);
+      elem.pid = op.pid;
+      elem.stamp = op.stamp;
+      var to = this.search_(elem.pid);
+      this.elems_.splice(to, 0, elem);
+      this.emit('move', new MoveEvent(isLocal, from, to));
+    } else {
+      throw new Error('unexpected op: ' + op.encode());
+    }
+  }
+};
+
+// Returns the number of values in this list.
+CList.prototype.length = function() {
+  return this.elems_.length;
+};
+
+// Returns the value at the given position.
+CList.prototype.get = function(pos) {
+  return this.elems_[pos].value;
+};
+
+// Returns an array of the values in this list.
+CList.prototype.toArray = function() {
+  return _.map(this.elems_, 'value');
+};
+
+// Inserts the given array of values, which must be of native JS types, at the
+// given position.
+CList.prototype.insert = function(pos, values) {
+  if (this.paused_) {
+    throw new Error('paused');
+  }
+  if (values.length === 0) {
+    return;
+  }
+  this.paused_ = true;
+  var prevPid = pos === 0 ? null : this.elems_[pos - 1].pid;
+  var nextPid = pos < this.elems_.length ? this.elems_[pos].pid : null;
+  this.emit('patch', encodePatch([new ClientInsert(prevPid, nextPid, values)]));
+};
+
+// Removes len values starting at the given position.
+CList.prototype.remove = function(pos, len) {
+  if (this.paused_) {
+    throw new Error('paused');
+  }
+  if (len === 0) {
+    return;
+  }
+  this.paused_ = true;
+  var ops = new Array(len);
+  for (var i = 0; i < len; i++) {
+    ops[i] = new Remove(this.elems_[pos + i].id);
+  }
+  this.emit('patch', encodePatch(ops));
+};
+
+// Moves the value at position 'from' such that it ends up at position 'to'.
+CList.prototype.move = function(from, to) {
+  if (this.paused_) {
+    throw new Error('paused');
+  }
+  if (from === to) {
+    return;
+  }
+  this.paused_ = true;
+  var others = this.elems_.slice(0, from).concat(this.elems_.slice(from + 1));
+  var prevPid = to === 0 ? null : others[to - 1].pid;
+  var nextPid = to < others.length ? others[to].pid : null;
+  this.emit('patch', encodePatch([
+    new ClientMove(this.elems_[from].id, prevPid, nextPid)
+  ]));
+};
+
+CList.prototype.search_ = function(pid) {
+  var that = this;
+  return lib.search(this.elems_.length, function(i) {
+    return !that.elems_[i].pid.less(pid);
+  });
+};
+
+////////////////////////////////////////////////////////////
+// Exports
+
+module.exports = {
+  CList: CList,
+  decode: decode,
+  InsertEvent: InsertEvent,
+  MoveEvent: MoveEvent,
+  RemoveEvent: RemoveEvent
+};
@@ -0,0 +1,267 @@
+// CMap class.
+// Mostly mirrors server/dtypes/cmap/cmap.go.
+
+var _ = require('lodash');
+var inherits = require('inherits');
+
+var cvalue = require('./cvalue');
+// Note: util requires this module, so its functions must not be called until
+// both modules have loaded.
+var util = require('./util');
+
+////////////////////////////////////////////////////////////
+// Events
+
+inherits(Create, cvalue.Event);
+function Create(isLocal, key) {
+  cvalue.Event.call(this, isLocal);
+  this.key = key;
+}
+
+inherits(Delete, cvalue.Event);
+function Delete(isLocal, key) {
+  cvalue.Event.call(this, isLocal);
+  this.key = key;
+}
+
+////////////////////////////////////////////////////////////
+// CMap
+
+function Entry(tags, tombstone, values) {
+  this.tags = tags;  // map of encoded dot to dtype
+  this.tombstone = tombstone;  // map of agent id to sequence number
+  this.values = values;  // map of dtype to CValue
+}
+
+Entry.prototype.present = function() {
+  return !_.isEmpty(this.tags);
+};
+
+// Returns the dtype of the entry's lowest tag, or undefined if the entry is not
+// present.
+Entry.prototype.dtype = function() {
+  var min = _.minBy(_.keys(this.tags), function(tag) {
+    var parts = tag.split('.');
+    // Agent ids and sequence numbers are uint32s, so this is exact.
+    return Number(parts[0]) * Math.pow(2, 32) + Number(parts[1]);
+  });
+  return min === undefined ? undefined : this.tags[min];
+};
+
+// Returns true iff a[x] <= b[x] for all x in a.
+function leq(a, b) {
+  return _.every(_.keys(a), function(k) {
+    return a[k] <= (b[k] || 0);
+  });
+}
+
+inherits(CMap, cvalue.CValue);
+function CMap(entries) {
+  cvalue.CValue.call(this);
+  this.m_ = {};  // map of key to Entry
+  var that = this;
+  _.forOwn(entries, function(entry, key) {
+    that.m_[key] = entry;
+    _.forOwn(entry.values, function(value, dtype) {
+      that.watch_(key, dtype, value);
+    });
+  });
+}
+
+// Implements CValue.dtype.
+CMap.prototype.dtype = function() {
+  return cvalue.dtypeCMap;
+};
+
+// Decodes the given string into a CMap.
+function decode(s) {
+  return new CMap(_.mapValues(JSON.parse(s), function(x) {
+    return new Entry(x.Tags || {}, x.Tombstone || {}, _.mapValues(x.Values, function(value, dtype) {
+      return util.decodeValue(dtype, value);
+    }));
+  }));
+}
+
+// Forwards the patches of the given value, of the given dtype, at the given key.
+CMap.prototype.watch_ = function(key, dtype, value) {
+  var that = this;
+  value.on('patch', function(patch) {
+    var ops;
+    if (dtype === cvalue.dtypeCMap) {
+      // Nested map ops are addressed relative to the nested map.
+      ops = _.map(JSON.parse(patch), function(op) {
+        return _.assign({}, op, {Path: [key].concat(op.Path)});
+      });
+    } else {
+      ops = [{Op: 'update', Path: [key], DType: dtype, Patch: patch}];
+    }
+    that.emit('patch', JSON.stringify(ops));
+  });
+};
+
+// Returns the entry for the given key, creating it (with no tags) if needed.
+CMap.prototype.entry_ = function(key) {
+  var entry = this.m_[key];
+  if (entry === undefined) {
+    entry = new Entry({}, {}, {});
+    this.m_[key] = entry;
+  }
+  return entry;
+};
+
+// Returns the given entry's value of the given dtype, creating a zero value if
+// needed.
+CMap.prototype.value_ = function(key, entry, dtype) {
+  var value = entry.values[dtype];
+  if (value === undefined) {
+    value = util.newZeroValue(dtype);
+    entry.values[dtype] = value;
+    this.watch_(key, dtype, value);
+  }
+  return value;
+};
+
+// Applies the given update op, whose path relative to this map is path, tagging
+// every entry along the path. The update is not applied to the value if it is
+// concurrent with a deletion of an entry along the path.
+CMap.prototype.applyUpdate_ = function(isLocal, op, path) {
+  var key = path[0];
+  var entryDType = path.length > 1 ? cvalue.dtypeCMap : op.DType;
+  var entry = this.entry_(key);
+  var wasPresent = entry.present();
+  entry.tags[op.Dot] = entryDType;
+  if (leq(entry.tombstone, op.Vec)) {
+    var value = this.value_(key, entry, entryDType);
+    if (path.length === 1) {
+      value.applyPatch(isLocal, op.Patch);
+    } else {
+      value.applyUpdate_(isLocal, op, path.slice(1));
+    }
+  }
+  if (!wasPresent) {
+    this.emit('create', new Create(isLocal, key));
+  }
+};
+
+// Applies the given delete op, whose path relative to this map is path. The
+// deletion is ignored if it is concurrent with a deletion of an entry along the
+// path, excluding the last.
+CMap.prototype.applyDelete_ = function(isLocal, op, path) {
+  var key = path[0];
+  var entry = this.m_[key];
+  if (entry === undefined) {
+    return;
+  }
+  if (path.length > 1) {
+    var value = entry.values[cvalue.dtypeCMap];
+    if (leq(entry.tombstone, op.Vec) && value !== undefined) {
+      value.applyDelete_(isLocal, op, path.slice(1));
+    }
+    return;
+  }
+  var wasPresent = entry.present();
+  _.forEach(_.keys(entry.tags), function(tag) {
+    var parts = tag.split('.');
+    if ((op.Vec[parts[0]] || 0) >= Number(parts[1])) {
+      delete entry.tags[tag];
+    }
+  });
+  if (!leq(op.Vec, entry.tombstone)) {
+    _.forOwn(op.Vec, function(seq, agentId) {
+      entry.tombstone[agentId] = Math.max(entry.tombstone[agentId] || 0, seq);
+    });
+    entry.values = {};
+  }
+  if (wasPresent && !entry.present()) {
+    this.emit('delete', new Delete(isLocal, key));
+  }
+};
+
+// Implements CValue.applyPatch.
+CMap.prototype.applyPatch = function(isLocal, patch) {
+  var ops = JSON.parse(patch);
+  for (var i = 0; i < ops.length; i++) {
+    var op = ops[i];
+    switch (op.Op) {
+    case 'update':
+      this.applyUpdate_(isLocal, op, op.Path);
+      break;
+    case 'delete':
+      this.applyDelete_(isLocal, op, op.Path);
+      break;
+    default:
+      throw new Error('unknown op type: ' + op.Op);
+    }
+  }
+};
+
+function checkDType(got, want) {
+  if (got !== want) {
+    throw new Error('wrong dtype: got ' + got + ', want ' + want);
+  }
+}
+
+// Returns the keys of all present entries.
+CMap.prototype.keys = function() {
+  var that = this;
+  return _.filter(_.keys(this.m_), function(key) {
+    return that.m_[key].present();
+  });
+};
+
+// Gets the CValue for the given key. If opts.dtype is specified, checks that
+// the value has the given dtype.
+CMap.prototype.get = function(key, opts) {
+  opts = opts || {};
+  var entry = this.m_[key];
+  if (entry === undefined || !entry.present()) {
+    throw new Error('not found: ' + key);
+  }
+  if (opts.dtype) {
+    checkDType(entry.dtype(), opts.dtype);
+  }
+  return this.value_(key, entry, entry.dtype());
+};
+
+// Gets the CValue for the given key. If the entry is present, checks that it
+// has the given dtype; otherwise, creates a value with the given dtype. The
+// entry becomes present once the value is first updated.
+CMap.prototype.getOrCreate = function(key, dtype, opts) {
+  opts = opts || {};
+  var entry = this.entry_(key);
+  if (entry.present()) {
+    checkDType(entry.dtype(), dtype);
+  }
+  return this.value_(key, entry, dtype);
+};
+
+// Puts the given value for the given key. Value must be a native JS type, and
+// will be converted to a CRegister.
+CMap.prototype.put = function(key, value, opts) {
+  opts = opts || {};
+  this.getOrCreate(key, cvalue.dtypeCRegister, {}).set(value);
+};
+
+// Deletes the entry for the given key. If opts.failIfMissing is set, fails if
+// there is no such entry.
+CMap.prototype.delete = function(key, opts) {
+  opts = opts || {};
+  var entry = this.m_[key];
+  if (entry === undefined || !entry.present()) {
+    if (opts.failIfMissing) {
+      throw new Error('not found: ' + key);
+    }
+    return;
+  }
+  this.emit('patch', JSON.stringify([{Op: 'delete', Path: [key]}]));
+};
+
+////////////////////////////////////////////////////////////
+// Exports
+
+module.exports = {
+  CMap: CMap,
+  Create: Create,
+  decode: decode,
+  Delete: Delete
+};
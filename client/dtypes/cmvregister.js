@@ -0,0 +1,104 @@
+// CMVRegister class.
+// Mostly mirrors server/dtypes/cmvregister/cmvregister.go.
+
+var _ = require('lodash');
+var inherits = require('inherits');
+
+var cvalue = require('./cvalue');
+
+////////////////////////////////////////////////////////////
+// Events
+
+inherits(Set, cvalue.Event);
+function Set(isLocal, values) {
+  cvalue.Event.call(this, isLocal);
+  this.values = values;
+}
+
+////////////////////////////////////////////////////////////
+// CMVRegister
+
+function Version(agentId, vec, val) {
+  this.agentId = agentId;
+  this.vec = vec;  // map of agent id to sequence number
+  this.val = val;
+}
+
+function decodeVersion(x) {
+  return new Version(x.AgentId, x.Vec || {}, x.Val);
+}
+
+// Returns true iff a[x] <= b[x] for all x in a.
+function leq(a, b) {
+  return _.every(_.keys(a), function(k) {
+    return a[k] <= (b[k] || 0);
+  });
+}
+
+inherits(CMVRegister, cvalue.CValue);
+function CMVRegister(versions) {
+  cvalue.CValue.call(this);
+  this.versions_ = versions;  // sorted by agent id, then by seq
+}
+
+// Implements CValue.dtype.
+CMVRegister.prototype.dtype = function() {
+  return cvalue.dtypeCMVRegister;
+};
+
+// Decodes the given string into a CMVRegister.
+function decode(s) {
+  var x = JSON.parse(s);
+  return new CMVRegister(_.map(x.Versions, decodeVersion));
+}
+
+// Implements CValue.applyPatch.
+CMVRegister.prototype.applyPatch = function(isLocal, patch) {
+  if (isLocal) {
+    this.paused_ = false;
+  }
+  var other = decodeVersion(JSON.parse(patch));
+  if (_.some(this.versions_, function(v) {
+    return leq(other.vec, v.vec);
+  })) {
+    return;
+  }
+  var versions = _.filter(this.versions_, function(v) {
+    return !leq(v.vec, other.vec);
+  });
+  versions.push(other);
+  this.versions_ = _.sortBy(versions, ['agentId', function(v) {
+    return v.vec[v.agentId];
+  }]);
+  this.emit('set', new Set(isLocal, this.get()));
+};
+
+// Returns an array of the current values. There is more than one value iff
+// there are conflicting concurrent writes.
+CMVRegister.prototype.get = function() {
+  return _.map(this.versions_, 'val');
+};
+
+// Returns true iff there are conflicting concurrent writes.
+CMVRegister.prototype.conflicted = function() {
+  return this.versions_.length > 1;
+};
+
+// Updates this value to the given one, which must be of native JS type. The
+// new value replaces all current values, resolving any conflict.
+CMVRegister.prototype.set = function(value) {
+  if (this.paused_) {
+    throw new Error('paused');
+  }
+  this.paused_ = true;
+  this.emit('patch', JSON.stringify(value));
+};
+
+////////////////////////////////////////////////////////////
+// Exports
+
+module.exports = {
+  CMVRegister: CMVRegister,
+  decode: decode,
+  Set: Set
+};
@@ -0,0 +1,152 @@
+// CSet class.
+// Mostly mirrors server/dtypes/cset/cset.go.
+
+var _ = require('lodash');
+var inherits = require('inherits');
+
+var cvalue = require('./cvalue');
+
+////////////////////////////////////////////////////////////
+// Events
+
+inherits(Add, cvalue.Event);
+function Add(isLocal, value) {
+  cvalue.Event.call(this, isLocal);
+  this.value = value;
+}
+
+inherits(Remove, cvalue.Event);
+function Remove(isLocal, value) {
+  cvalue.Event.call(this, isLocal);
+  this.value = value;
+}
+
+////////////////////////////////////////////////////////////
+// CSet
+
+function Elem(value, tags) {
+  this.value = value;
+  this.tags = tags;  // set of encoded dots
+}
+
+// Returns the key for the given element, i.e. its JSON encoding.
+function key(value) {
+  return JSON.stringify(value);
+}
+
+function checkScalar(value) {
+  if (!(value === null || _.isBoolean(value) || _.isNumber(value) ||
+        _.isString(value))) {
+    throw new Error('not a scalar: ' + value);
+  }
+}
+
+inherits(CSet, cvalue.CValue);
+function CSet(elems) {
+  cvalue.CValue.call(this);
+  this.m_ = {};  // map of key to Elem
+  for (var i = 0; i < elems.length; i++) {
+    this.m_[key(elems[i].value)] = elems[i];
+  }
+}
+
+// Implements CValue.dtype.
+CSet.prototype.dtype = function() {
+  return cvalue.dtypeCSet;
+};
+
+// Decodes the given string into a CSet.
+function decode(s) {
+  var elems = JSON.parse(s) || [];
+  return new CSet(_.map(elems, function(elem) {
+    var tags = {};
+    _.forEach(elem.Tags, function(tag) {
+      tags[tag] = true;
+    });
+    return new Elem(elem.Value, tags);
+  }));
+}
+
+// Implements CValue.applyPatch.
+CSet.prototype.applyPatch = function(isLocal, patch) {
+  if (isLocal) {
+    this.paused_ = false;
+  }
+  var ops = JSON.parse(patch);
+  for (var i = 0; i < ops.length; i++) {
+    var op = ops[i], k = key(op.Value), elem = this.m_[k];
+    switch (op.Op) {
+    case 'add':
+      if (elem === undefined) {
+        elem = new Elem(op.Value, {});
+        this.m_[k] = elem;
+        this.emit('add', new Add(isLocal, op.Value));
+      }
+      elem.tags[op.Dot] = true;
+      break;
+    case 'remove':
+      if (elem === undefined) {
+        break;
+      }
+      _.forEach(op.Tags, function(tag) {
+        delete elem.tags[tag];
+      });
+      if (_.isEmpty(elem.tags)) {
+        delete this.m_[k];
+        this.emit('remove', new Remove(isLocal, op.Value));
+      }
+      break;
+    default:
+      throw new Error('unknown op type: ' + op.Op);
+    }
+  }
+};
+
+// Returns true iff the given value is in this set.
+CSet.prototype.has = function(value) {
+  return _.has(this.m_, key(value));
+};
+
+// Returns the number of values in this set.
+CSet.prototype.size = function() {
+  return _.size(this.m_);
+};
+
+// Returns an array of the values in this set, in no particular order.
+CSet.prototype.values = function() {
+  return _.map(_.values(this.m_), 'value');
+};
+
+// Adds the given values, which must be JSON scalars, to this set.
+CSet.prototype.add = function(values) {
+  this.update_('add', values);
+};
+
+// Removes the given values from this set.
+CSet.prototype.remove = function(values) {
+  this.update_('remove', values);
+};
+
+CSet.prototype.update_ = function(opType, values) {
+  if (this.paused_) {
+    throw new Error('paused');
+  }
+  _.forEach(values, checkScalar);
+  if (values.length === 0) {
+    return;
+  }
+  this.paused_ = true;
+  this.emit('patch', JSON.stringify(_.map(values, function(value) {
+    return {Op: opType, Value: value};
+  })));
+};
+
+////////////////////////////////////////////////////////////
+// Exports
+
+module.exports = {
+  Add: Add,
+  CSet: CSet,
+  decode: decode,
+  Remove: Remove
+};
@@ -7,6 +7,7 @@ var inherits = require('inherits');
 
 var cvalue = require('./cvalue');
 var lib = require('../lib');
+var logoot = require('./logoot');
 
 ////////////////////////////////////////////////////////////
 // Events
@@ -29,56 +30,6 @@ function SetSelectionRange(isLocal, start, end) {
 ////////////////////////////////////////////////////////////
 // CString
 
-function Id(pos, agentId) {
-  this.pos = pos;
-  this.agentId = agentId;
-}
-
-function Pid(ids, seq) {
-  this.ids = ids;
-  this.seq = seq;
-}
-
-Pid.prototype.less = function(other) {
-  for (var i = 0; i < this.ids.length; i++) {
-    if (i === other.ids.length) {
-      return false;
-    }
-    var v = this.ids[i], vo = other.ids[i];
-    if (v.pos !== vo.pos) {
-      return v.pos < vo.pos;
-    } else if (v.agentId !== vo.agentId) {
-      return v.agentId < vo.agentId;
-    }
-  }
-  if (this.ids.length === other.ids.length) {
-    return this.seq < other.seq;
-  }
-  return true;
-};
-
-Pid.prototype.encode = function() {
-  return _.map(this.ids, function(id) {
-    return [id.pos, id.agentId].join('.');
-  }).join(':') + '~' + this.seq;
-};
-
-function decodePid(s) {
-  var idsAndSeq = s.split('~');
-  if (idsAndSeq.length !== 2 ) {
-    throw new Error('invalid pid: ' + s);
-  }
-  var seq = lib.atoi(idsAndSeq[1]);
-  var ids = _.map(idsAndSeq[0].split(':'), function(idStr) {
-    var parts = idStr.split('.');
-    if (parts.length !== 2) {
-      throw new Error('invalid id: ' + idStr);
-    }
-    return new Id(lib.atoi(parts[0]), lib.atoi(parts[1]));
-  });
-  return new Pid(ids, seq);
-}
-
 function Op() {}
 
 Op.prototype.encode = function() {
@@ -133,19 +84,19 @@ function decodeOp(s) {
     if (parts.length < 4) {
       throw newParseError(s);
     }
-    return new ClientInsert(decodePid(parts[1]), decodePid(parts[2]), parts[3]);
+    return new ClientInsert(logoot.decodePid(parts[1]), logoot.decodePid(parts[2]), parts[3]);
   case 'i':
     parts = lib.splitN(s, ',', 3);
     if (parts.length < 3) {
       throw newParseError(s);
     }
-    return new Insert(decodePid(parts[1]), parts[2]);
+    return new Insert(logoot.decodePid(parts[1]), parts[2]);
   case 'd':
     parts = lib.splitN(s, ',', 2);
     if (parts.length < 2) {
       throw newParseError(s);
     }
-    return new Delete(decodePid(parts[1]));
+    return new Delete(logoot.decodePid(parts[1]));
   default:
     throw new Error('unknown op type: ' + t);
   }
@@ -191,7 +142,7 @@ CString.prototype.dtype = function() {
 function decode(s) {
   var atoms = JSON.parse(s);
   return new CString(_.map(atoms, function(atom) {
-    return new Atom(decodePid(atom.Pid), atom.Value);
+    return new Atom(logoot.decodePid(atom.Pid), atom.Value);
   }));
 }
 
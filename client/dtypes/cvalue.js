@@ -50,7 +50,12 @@ CValue.prototype.redo = function() {
 
 module.exports = {
   CValue: CValue,
+  dtypeCCounter: 'ccounter',
+  dtypeCList: 'clist',
+  dtypeCMap: 'cmap',
+  dtypeCMVRegister: 'cmvregister',
   dtypeCRegister: 'cregister',
+  dtypeCSet: 'cset',
   dtypeCString: 'cstring',
   dtypeDelete: 'delete',
   Event: Event
@@ -0,0 +1,65 @@
+// Logoot position identifiers, shared by the sequence CRDTs.
+// Mirrors server/dtypes/logoot/logoot.go.
+
+var _ = require('lodash');
+
+var lib = require('../lib');
+
+function Id(pos, agentId) {
+  this.pos = pos;
+  this.agentId = agentId;
+}
+
+function Pid(ids, seq) {
+  this.ids = ids;
+  this.seq = seq;
+}
+
+Pid.prototype.less = function(other) {
+  for (var i = 0; i < this.ids.length; i++) {
+    if (i === other.ids.length) {
+      return false;
+    }
+    var v = this.ids[i], vo = other.ids[i];
+    if (v.pos !== vo.pos) {
+      return v.pos < vo.pos;
+    } else if (v.agentId !== vo.agentId) {
+      return v.agentId < vo.agentId;
+    }
+  }
+  if (this.ids.length === other.ids.length) {
+    return this.seq < other.seq;
+  }
+  return true;
+};
+
+Pid.prototype.encode = function() {
+  return _.map(this.ids, function(id) {
+    return [id.pos, id.agentId].join('.');
+  }).join(':') + '~' + this.seq;
+};
+
+function decodePid(s) {
+  var idsAndSeq = s.split('~');
+  if (idsAndSeq.length !== 2 ) {
+    throw new Error('invalid pid: ' + s);
+  }
+  var seq = lib.atoi(idsAndSeq[1]);
+  var ids = _.map(idsAndSeq[0].split(':'), function(idStr) {
+    var parts = idStr.split('.');
+    if (parts.length !== 2) {
+      throw new Error('invalid id: ' + idStr);
+    }
+    return new Id(lib.atoi(parts[0]), lib.atoi(parts[1]));
+  });
+  return new Pid(ids, seq);
+}
+
+////////////////////////////////////////////////////////////
+// Exports
+
+module.exports = {
+  decodePid: decodePid,
+  Id: Id,
+  Pid: Pid
+};
@@ -1,14 +1,29 @@
 // Helper functions.
 
+var ccounter = require('./ccounter');
+var clist = require('./clist');
+var cmap = require('./cmap');
+var cmvregister = require('./cmvregister');
 var cregister = require('./cregister');
+var cset = require('./cset');
 var cstring = require('./cstring');
 var cvalue = require('./cvalue');
 
 // Decodes the given value.
 exports.decodeValue = function(dtype, value) {
   switch (dtype) {
+  case cvalue.dtypeCCounter:
+    return ccounter.decode(value);
+  case cvalue.dtypeCList:
+    return clist.decode(value);
+  case cvalue.dtypeCMap:
+    return cmap.decode(value);
+  case cvalue.dtypeCMVRegister:
+    return cmvregister.decode(value);
   case cvalue.dtypeCRegister:
     return cregister.decode(value);
+  case cvalue.dtypeCSet:
+    return cset.decode(value);
   case cvalue.dtypeCString:
     return cstring.decode(value);
   default:
@@ -19,8 +34,18 @@ exports.decodeValue = function(dtype, value) {
 // Returns a new zero value of the given dtype.
 exports.newZeroValue = function(dtype) {
   switch (dtype) {
+  case cvalue.dtypeCCounter:
+    return new ccounter.CCounter({}, {});
+  case cvalue.dtypeCList:
+    return new clist.CList([]);
+  case cvalue.dtypeCMap:
+    return new cmap.CMap({});
+  case cvalue.dtypeCMVRegister:
+    return new cmvregister.CMVRegister([]);
   case cvalue.dtypeCRegister:
     return new cregister.CRegister(undefined);
+  case cvalue.dtypeCSet:
+    return new cset.CSet([]);
   case cvalue.dtypeCString:
     return new cstring.CString([]);
   default:
@@ -16,8 +16,8 @@ exports.setImmediate = function(cb) {
 exports.splitN = function(s, sep, n) {
   var parts = s.split(sep);
   if (parts.length >= n) {
-    parts[n - 1] = parts.slice(n - 1).join(',');
-    parts = parts.slice(0, 3);
+    parts[n - 1] = parts.slice(n - 1).join(sep);
+    parts = parts.slice(0, n);
   }
   return parts;
 };
@@ -8,66 +8,389 @@ var util = require('./dtypes/util');
 
 module.exports = Store;
 
+// Delay before reconnecting after the connection to the server is lost.
+var RECONNECT_DELAY_MS = 1000;
+
+// DTypes of patches that create or destroy the watched collection.
+var dtypeCreateCollection = 'createCollection';
+var dtypeDestroyCollection = 'destroyCollection';
+
 function Store(addr) {
   this.addr_ = addr;
   // Map of key to CValue, populated from watch stream.
   this.m_ = {};
+  // Map of key to 'patch' event listener for the corresponding CValue.
+  this.onPatch_ = {};
+  // Subscribed collection, and keys and key prefixes within it.
+  this.collection_ = '';
+  this.keys_ = [];
+  this.prefixes_ = [];
+  // Callbacks awaiting ValuesDoneS2C messages, in order.
+  this.valuesDoneCbs_ = [];
+  this.opened_ = false;
+  // Version vector representing the patches reflected in m_, as last reported
+  // by the server. Used to resume the watch stream after reconnecting. Null if
+  // the stream cannot be resumed.
+  this.vec_ = null;
+  // Number of patches sent on the current connection whose echoes have not yet
+  // been received.
+  this.numPending_ = 0;
+  // While resuming the watch stream, the set of keys whose values the server
+  // has sent. Null otherwise.
+  this.received_ = null;
+  // Callbacks awaiting ScanS2C messages, in order.
+  this.scanCbs_ = [];
+  // While running a Store.batch function, the patches it has made, keyed by
+  // key. Null otherwise.
+  this.batch_ = null;
+}
+
+function subscriptionOpts(opts) {
+  var res = {collection: opts.collection || ''};
+  if (!opts.keys && !opts.prefixes) {
+    return _.assign(res, {keys: [], prefixes: ['']});
+  }
+  return _.assign(res, {keys: opts.keys || [], prefixes: opts.prefixes || []});
 }
 
-// Opens this store, initiating the watch stream.
-// TODO: Eliminate this method once we've implemented fine-grained watch.
-Store.prototype.open = function(cb) {
+// Opens this store, initiating the watch stream. The store watches the keys in
+// opts.keys, plus all keys with any of the prefixes in opts.prefixes, within
+// collection opts.collection (by default, the default collection, named ''); if
+// neither keys nor prefixes are specified, the store watches all keys in the
+// collection. The collection need not exist yet. Calls cb once the initial
+// values have been received, or with an error if the server reports an error
+// before then. Once opened, the store reconnects whenever the connection is
+// lost, resuming the watch stream where it left off if possible.
+Store.prototype.open = function(opts, cb) {
+  if (typeof opts === 'function') {
+    cb = opts;
+    opts = {};
+  }
   var that = this;
+  opts = subscriptionOpts(opts);
+  this.collection_ = opts.collection;
+  this.keys_ = opts.keys;
+  this.prefixes_ = opts.prefixes;
+  this.valuesDoneCbs_.push(function(err) {
+    that.opened_ = !err;
+    cb(err);
+  });
+  this.connect_();
+};
 
-  // Initialize connection.
+// Initializes the connection and sends SubscribeC2S.
+Store.prototype.connect_ = function() {
+  var that = this;
   this.conn_ = new Conn(this.addr_);
 
   this.conn_.on('open', function() {
+    that.numPending_ = 0;
+    // If resuming, track received values so that, if the server falls back to
+    // sending all values, we can drop values the server did not send.
+    that.received_ = that.vec_ ? {} : null;
     that.conn_.send({
-      Type: 'SubscribeC2S'
+      Type: 'SubscribeC2S',
+      Collection: that.collection_,
+      Keys: that.keys_,
+      Prefixes: that.prefixes_,
+      VersionVector: that.vec_
     });
   });
 
+  this.conn_.on('close', function() {
+    // Pending scans are lost with the connection.
+    var scanCbs = that.scanCbs_;
+    that.scanCbs_ = [];
+    _.forEach(scanCbs, function(cb) {
+      cb(new Error('connection lost'));
+    });
+    if (!that.opened_) {
+      return;
+    }
+    // If the server may have applied patches that we sent but whose echoes we
+    // did not receive, resuming would apply those patches twice, since the new
+    // stream cannot identify them as local. In that case, start from scratch.
+    // TODO: Patches written while disconnected are lost. Queue them and send
+    // them once reconnected.
+    if (that.numPending_ > 0) {
+      that.vec_ = null;
+    }
+    // The new stream's initial values reflect the current subscription, so
+    // callbacks awaiting subscription updates can be called once they arrive.
+    var cbs = that.valuesDoneCbs_;
+    that.valuesDoneCbs_ = [function() {
+      _.forEach(cbs, function(cb) {
+        cb();
+      });
+    }];
+    setTimeout(function() {
+      that.connect_();
+    }, RECONNECT_DELAY_MS);
+  });
+
   this.conn_.on('recv', function(msg) {
     switch (msg.Type) {
     case 'ValueS2C':
       return that.processValueS2C_(msg);
     case 'ValuesDoneS2C':
-      return cb();
+      return that.processValuesDoneS2C_(msg);
     case 'PatchS2C':
       return that.processPatchS2C_(msg);
+    case 'BatchS2C':
+      return that.processBatchS2C_(msg);
+    case 'ProgressS2C':
+      // Ignore progress reported before the server processed a subscription
+      // update.
+      if (_.isEmpty(that.valuesDoneCbs_)) {
+        that.vec_ = msg.VersionVector;
+      }
+      return;
+    case 'ScanS2C':
+      return that.scanCbs_.shift()(null, msg);
+    case 'ErrorS2C':
+      // The server closes the stream after sending this message.
+      var err = new Error(msg.Code + ': ' + msg.Message);
+      if (!that.opened_) {
+        return that.valuesDoneCbs_.shift()(err);
+      }
+      throw err;
     default:
       throw new Error('unknown message type: ' + msg.Type);
     }
   });
 };
 
-Store.prototype.putAndWatch_ = function(key, dtype, value) {
-  var that = this;
-  this.m_[key] = value;
-  value.on('patch', function(patch) {
-    that.conn_.send({
-      Type: 'PatchC2S',
+// Sends the given patch to the server, or adds it to the current batch.
+Store.prototype.sendPatch_ = function(key, dtype, patch) {
+  if (this.batch_) {
+    if (_.has(this.batch_, key)) {
+      throw new Error('key modified twice in batch: ' + key);
+    }
+    this.batch_[key] = {
+      Collection: this.collection_,
       Key: key,
       DType: dtype,
       Patch: patch
+    };
+    return;
+  }
+  this.numPending_++;
+  this.conn_.send({
+    Type: 'PatchC2S',
+    Collection: this.collection_,
+    Key: key,
+    DType: dtype,
+    Patch: patch
+  });
+};
+
+// Calls fn, then sends all patches made by fn to the server as a single batch,
+// which the server applies atomically: either all patches are applied, or none
+// are. Each key may be modified (or deleted) at most once in a batch. If fn
+// throws, no patches are sent.
+// TODO: If fn throws, roll back the local values it modified.
+Store.prototype.batch = function(fn) {
+  if (this.batch_) {
+    throw new Error('batches cannot be nested');
+  }
+  this.batch_ = {};
+  var patches;
+  try {
+    fn();
+    patches = _.values(this.batch_);
+  } finally {
+    this.batch_ = null;
+  }
+  if (_.isEmpty(patches)) {
+    return;
+  }
+  this.numPending_++;
+  this.conn_.send({Type: 'BatchC2S', Patches: patches});
+};
+
+// Changes the set of watched keys, as described in Store.open. Stops watching
+// (and forgets the values of) keys that are no longer watched. Calls cb once the
+// values of newly watched keys have been received.
+Store.prototype.subscribe = function(opts, cb) {
+  var that = this;
+  opts = subscriptionOpts(opts);
+  var collectionChanged = opts.collection !== this.collection_;
+  this.collection_ = opts.collection;
+  this.keys_ = opts.keys;
+  this.prefixes_ = opts.prefixes;
+  // Values of newly watched keys may reflect patches beyond our version vector,
+  // so we cannot resume from it until the server reports a new one.
+  this.vec_ = null;
+  _.forEach(_.keys(this.m_), function(key) {
+    if (collectionChanged || !that.watching(key)) {
+      that.removeAndUnwatch_(key);
+    }
+  });
+  this.valuesDoneCbs_.push(cb || _.noop);
+  this.conn_.send({
+    Type: 'UpdateSubscriptionC2S',
+    Collection: this.collection_,
+    Keys: this.keys_,
+    Prefixes: this.prefixes_
+  });
+};
+
+// Fetches the values of keys in [opts.start, opts.limit) with prefix
+// opts.prefix (all optional) in collection opts.collection (by default, the
+// watched collection) from the server, in reverse key order if opts.reverse is
+// set. Keys need not be watched. Calls cb with an error, or with
+// an array of up to opts.pageSize {key, value} objects, where value is a CValue
+// that does not reflect later patches, plus a function that fetches the next
+// page (with the same signature as cb), or null if there are no more values.
+Store.prototype.scan = function(opts, cb) {
+  var that = this;
+  this.scanCbs_.push(function(err, msg) {
+    if (err) {
+      return cb(err);
+    }
+    var values = _.map(msg.Values, function(v) {
+      return {key: v.Key, value: util.decodeValue(v.DType, v.Value)};
     });
+    var next = null;
+    if (msg.More) {
+      var last = _.last(msg.Values).Key;
+      var nextOpts = opts.reverse ? {limit: last} : {start: last + '\u0000'};
+      next = function(cb) {
+        that.scan(_.assign({}, opts, nextOpts), cb);
+      };
+    }
+    cb(null, values, next);
   });
+  this.conn_.send({
+    Type: 'ScanC2S',
+    Collection: _.has(opts, 'collection') ? opts.collection : this.collection_,
+    Start: opts.start || '',
+    Limit: opts.limit || '',
+    Prefix: opts.prefix || '',
+    Reverse: !!opts.reverse,
+    PageSize: opts.pageSize || 0
+  });
+};
+
+// Creates the named collection, if it does not already exist.
+Store.prototype.createCollection = function(name) {
+  this.conn_.send({Type: 'CreateCollectionC2S', Collection: name});
+};
+
+// Destroys the named collection, deleting all its records. The default
+// collection cannot be destroyed. If the store is watching the collection, the
+// store drops its values once the server has destroyed it.
+Store.prototype.destroyCollection = function(name) {
+  this.conn_.send({Type: 'DestroyCollectionC2S', Collection: name});
+};
+
+// Returns true iff this store is watching the given key.
+Store.prototype.watching = function(key) {
+  return _.includes(this.keys_, key) || _.some(this.prefixes_, function(prefix) {
+    return _.startsWith(key, prefix);
+  });
+};
+
+function checkWatching(store, key) {
+  if (!store.watching(key)) {
+    throw new Error('not watching: ' + key);
+  }
+}
+
+Store.prototype.putAndWatch_ = function(key, dtype, value) {
+  var that = this;
+  this.m_[key] = value;
+  value.on('patch', this.onPatch_[key] = function(patch) {
+    that.sendPatch_(key, dtype, patch);
+  });
+};
+
+Store.prototype.removeAndUnwatch_ = function(key) {
+  this.m_[key].removeListener('patch', this.onPatch_[key]);
+  delete this.m_[key];
+  delete this.onPatch_[key];
 };
 
 Store.prototype.processValueS2C_ = function(msg) {
+  if (this.received_) {
+    this.received_[msg.Key] = true;
+  }
+  // After reconnecting, the server may resend values we already have.
+  if (_.has(this.m_, msg.Key)) {
+    this.removeAndUnwatch_(msg.Key);
+  }
   this.putAndWatch_(msg.Key, msg.DType, util.decodeValue(msg.DType, msg.Value));
 };
 
+Store.prototype.processValuesDoneS2C_ = function(msg) {
+  var that = this;
+  // Only the reply to SubscribeC2S carries a version vector.
+  if (msg.VersionVector) {
+    if (this.received_ && !msg.Resumed) {
+      // The server sent all values, so drop the ones it did not send.
+      _.forEach(_.keys(this.m_), function(key) {
+        if (!_.has(that.received_, key)) {
+          that.removeAndUnwatch_(key);
+        }
+      });
+    }
+    this.received_ = null;
+    this.vec_ = msg.VersionVector;
+  }
+  this.valuesDoneCbs_.shift()();
+};
+
+function isCollectionPatch(msg) {
+  return msg.DType === dtypeCreateCollection ||
+    msg.DType === dtypeDestroyCollection;
+}
+
 Store.prototype.processPatchS2C_ = function(msg) {
-  if (msg.DType === cvalue.dtypeDelete) {
-    throw new Error('not implemented');
+  // Collection patches are only echoed if they affect the watched collection,
+  // so they are not counted as pending.
+  if (msg.IsLocal && !isCollectionPatch(msg)) {
+    this.numPending_--;
+  }
+  this.applyPatch_(msg.IsLocal, msg);
+};
+
+Store.prototype.processBatchS2C_ = function(msg) {
+  var that = this;
+  if (msg.IsLocal) {
+    this.numPending_--;
+  }
+  _.forEach(msg.Patches, function(patch) {
+    that.applyPatch_(msg.IsLocal, patch);
+  });
+};
+
+// Applies the given patch (from a PatchS2C or BatchS2C message).
+Store.prototype.applyPatch_ = function(isLocal, msg) {
+  // Ignore patches sent before the server processed a subscription update.
+  if (msg.Collection !== this.collection_) {
+    return;
+  }
+  if (msg.DType === dtypeDestroyCollection) {
+    var that = this;
+    _.forEach(_.keys(this.m_), function(key) {
+      that.removeAndUnwatch_(key);
+    });
+    return;
+  } else if (msg.DType === dtypeCreateCollection || !this.watching(msg.Key)) {
+    return;
   }
   var hasKey = _.has(this.m_, msg.Key);
+  if (msg.DType === cvalue.dtypeDelete) {
+    // Local deletions are applied eagerly by Store.del.
+    if (!isLocal && hasKey) {
+      this.removeAndUnwatch_(msg.Key);
+    }
+    return;
+  }
   var value = hasKey ? this.m_[msg.Key] : util.newZeroValue(msg.DType);
-  value.applyPatch(msg.IsLocal, msg.Patch);
+  value.applyPatch(isLocal, msg.Patch);
   if (!hasKey) {
-    this.putAndWatch_(value);
+    this.putAndWatch_(msg.Key, msg.DType, value);
   }
 };
 
@@ -95,6 +418,7 @@ Store.prototype.get = function(key, opts) {
 // it has the given dtype; otherwise, creates it with the given dtype.
 Store.prototype.getOrCreate = function(key, dtype, opts) {
   opts = opts || {};
+  checkWatching(this, key);
   var hasKey = _.has(this.m_, key), value;
   if (hasKey) {
     value = this.m_[key];
@@ -116,5 +440,14 @@ Store.prototype.put = function(key, value, opts) {
 // Deletes the specified record. If opts.failIfMissing is set, fails if there is
 // no record with the given key.
 Store.prototype.del = function(key, opts) {
-  throw new Error('not implemented');
+  opts = opts || {};
+  checkWatching(this, key);
+  if (!_.has(this.m_, key)) {
+    if (opts.failIfMissing) {
+      throw new Error('not found: ' + key);
+    }
+  } else {
+    this.removeAndUnwatch_(key);
+  }
+  this.sendPatch_(key, cvalue.dtypeDelete, '');
 };
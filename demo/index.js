@@ -22,7 +22,7 @@ var Editor = React.createFactory(React.createClass({
   componentDidMount: function() {
     var that = this, el = ReactDOM.findDOMNode(this);
     var st = new Store(this.props.addr);
-    st.open(function() {
+    st.open({keys: ['0']}, function() {
       var model = st.getOrCreate('0', 'cstring');
       var ed = newEditor(el, that.props.type, model);
       if (that.props.focus) ed.focus();
@@ -19,6 +19,8 @@ var (
 	loopback  = flag.Bool("loopback", true, "")
 	port      = flag.Int("port", 4000, "")
 	peerAddrs = flag.String("peer-addrs", "", "comma-separated peer addrs")
+	dataDir   = flag.String("data-dir", "", "data directory; if empty, data is not persisted")
+	maxPeers  = flag.Int("max-peers", 8, "max number of peers; when reached, peers learned via gossip are not added")
 )
 
 var serve = gosh.RegisterFunc("serve", hub.Serve)
@@ -56,7 +58,7 @@ func main() {
 	}
 	addr := fmt.Sprintf("%s:%d", hostname, *port)
 	httpAddr := fmt.Sprintf("%s:%d", hostname, *port+100)
-	c := sh.FuncCmd(serve, addr, strings.Split(*peerAddrs, ","))
+	c := sh.FuncCmd(serve, addr, strings.Split(*peerAddrs, ","), *dataDir, *maxPeers)
 	c.AddStderrWriter(os.Stderr)
 	c.Start()
 	c.AwaitVars("ready")
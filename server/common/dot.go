@@ -0,0 +1,60 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Dot identifies a patch: its creator's agent id and sequence number.
+type Dot struct {
+	AgentId  uint32
+	AgentSeq uint32
+}
+
+// Encode encodes this dot.
+func (d Dot) Encode() string {
+	return fmt.Sprintf("%d.%d", d.AgentId, d.AgentSeq)
+}
+
+// DecodeDot decodes the given string into a Dot.
+func DecodeDot(s string) (Dot, error) {
+	var res Dot
+	if _, err := fmt.Sscanf(s, "%d.%d", &res.AgentId, &res.AgentSeq); err != nil {
+		return Dot{}, fmt.Errorf("invalid dot: %s", s)
+	}
+	return res, nil
+}
+
+// EncodeDots returns the given dots, encoded and sorted.
+func EncodeDots(dots map[Dot]bool) []string {
+	res := make([]string, 0, len(dots))
+	for d := range dots {
+		res = append(res, d.Encode())
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Contains returns true iff the patch identified by d is in vec.
+func (vec *VersionVector) Contains(d Dot) bool {
+	return vec.Get(d.AgentId) >= d.AgentSeq
+}
+
+// MergeDots returns the merge of the given dot sets, where vec and otherVec
+// represent the patches seen by the states holding dots and otherDots,
+// respectively. A dot held by only one state survives iff the other state has
+// not seen it; otherwise, the other state must have removed it.
+func MergeDots(dots map[Dot]bool, vec *VersionVector, otherDots map[Dot]bool, otherVec *VersionVector) map[Dot]bool {
+	res := map[Dot]bool{}
+	for d := range dots {
+		if otherDots[d] || !otherVec.Contains(d) {
+			res[d] = true
+		}
+	}
+	for d := range otherDots {
+		if !vec.Contains(d) {
+			res[d] = true
+		}
+	}
+	return res
+}
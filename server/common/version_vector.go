@@ -85,3 +85,21 @@ func (vec *VersionVector) Before(other *VersionVector) bool {
 func (vec *VersionVector) After(other *VersionVector) bool {
 	return other.Before(vec)
 }
+
+// Merge sets vec[x] to max(vec[x], other[x]) for all x in other.
+func (vec *VersionVector) Merge(other *VersionVector) {
+	for k, v := range *other {
+		if vec.Get(k) < v {
+			vec.Put(k, v)
+		}
+	}
+}
+
+// Intersect sets vec[x] to min(vec[x], other[x]) for all x in vec.
+func (vec *VersionVector) Intersect(other *VersionVector) {
+	for k, v := range *vec {
+		if o := other.Get(k); o < v {
+			vec.Put(k, o)
+		}
+	}
+}
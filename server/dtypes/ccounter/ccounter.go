@@ -0,0 +1,144 @@
+// Package ccounter defines CCounter, a CRDT counter that supports concurrent
+// increments and decrements (PN-counter).
+package ccounter
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+)
+
+// CCounter is a CRDT counter. It keeps separate positive and negative tallies
+// for each agent; the counter's value is the sum of all positive tallies minus
+// the sum of all negative tallies. Tallies only grow, so patches are merged by
+// taking the max.
+type CCounter struct {
+	P map[uint32]uint64
+	N map[uint32]uint64
+}
+
+// clientPatch is a client patch.
+type clientPatch struct {
+	Add int64
+}
+
+// serverPatch is a server patch. It holds the absolute tallies of the agent
+// that created it, so applying it more than once has no additional effect.
+type serverPatch struct {
+	AgentId uint32
+	P       uint64
+	N       uint64
+}
+
+type jsonCCounter struct {
+	P     map[uint32]uint64
+	N     map[uint32]uint64
+	Total int64
+}
+
+// New returns a new CCounter.
+func New() *CCounter {
+	return &CCounter{P: map[uint32]uint64{}, N: map[uint32]uint64{}}
+}
+
+// DType implements CValue.DType.
+func (c *CCounter) DType() string {
+	return cvalue.DTypeCCounter
+}
+
+// Total returns the counter's value.
+func (c *CCounter) Total() int64 {
+	var res int64
+	for _, v := range c.P {
+		res += int64(v)
+	}
+	for _, v := range c.N {
+		res -= int64(v)
+	}
+	return res
+}
+
+// Encode implements CValue.Encode.
+func (c *CCounter) Encode() (string, error) {
+	buf, err := json.Marshal(jsonCCounter{P: c.P, N: c.N, Total: c.Total()})
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Decode decodes the given value into a CCounter.
+func Decode(s string) (*CCounter, error) {
+	x := jsonCCounter{}
+	if err := json.Unmarshal([]byte(s), &x); err != nil {
+		return nil, err
+	}
+	c := New()
+	for k, v := range x.P {
+		c.P[k] = v
+	}
+	for k, v := range x.N {
+		c.N[k] = v
+	}
+	return c, nil
+}
+
+func (c *CCounter) applyPatch(sp *serverPatch) {
+	if sp.P > c.P[sp.AgentId] {
+		c.P[sp.AgentId] = sp.P
+	}
+	if sp.N > c.N[sp.AgentId] {
+		c.N[sp.AgentId] = sp.N
+	}
+}
+
+// ApplyServerPatch implements CValue.ApplyServerPatch.
+func (c *CCounter) ApplyServerPatch(patch string) error {
+	sp := &serverPatch{}
+	if err := json.Unmarshal([]byte(patch), sp); err != nil {
+		return err
+	}
+	c.applyPatch(sp)
+	return nil
+}
+
+// ApplyClientPatch implements CValue.ApplyClientPatch.
+func (c *CCounter) ApplyClientPatch(agentId uint32, vec *common.VersionVector, t time.Time, patch string) (string, error) {
+	cp := &clientPatch{}
+	if err := json.Unmarshal([]byte(patch), cp); err != nil {
+		return "", err
+	}
+	sp := &serverPatch{AgentId: agentId, P: c.P[agentId], N: c.N[agentId]}
+	if cp.Add >= 0 {
+		sp.P += uint64(cp.Add)
+	} else {
+		sp.N += uint64(-cp.Add)
+	}
+	if sp.P < c.P[agentId] || sp.N < c.N[agentId] {
+		return "", errors.New("counter overflow")
+	}
+	buf, err := json.Marshal(sp)
+	if err != nil {
+		return "", err
+	}
+	c.applyPatch(sp)
+	return string(buf), nil
+}
+
+// Merge implements CValue.Merge.
+func (c *CCounter) Merge(vec *common.VersionVector, other string, otherVec *common.VersionVector) error {
+	o, err := Decode(other)
+	if err != nil {
+		return err
+	}
+	for agentId, p := range o.P {
+		c.applyPatch(&serverPatch{AgentId: agentId, P: p})
+	}
+	for agentId, n := range o.N {
+		c.applyPatch(&serverPatch{AgentId: agentId, N: n})
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package ccounter
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// add adds n to c as the given agent, and returns the resulting server patch.
+func add(t *testing.T, c *CCounter, agentId uint32, n int64) string {
+	t.Helper()
+	sp, err := c.ApplyClientPatch(agentId, &common.VersionVector{}, time.Time{}, fmt.Sprintf(`{"Add":%d}`, n))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func checkTotal(t *testing.T, c *CCounter, want int64) {
+	t.Helper()
+	if got := c.Total(); got != want {
+		t.Fatalf("got %d, want %d", got, want)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	c := New()
+	add(t, c, 1, 5)
+	add(t, c, 2, -7)
+	add(t, c, 1, -1)
+	checkTotal(t, c, -3)
+	if c.P[1] != 5 || c.N[1] != 1 || c.N[2] != 7 {
+		t.Fatalf("got tallies %v, %v", c.P, c.N)
+	}
+	c.P[1] = math.MaxUint64
+	if _, err := c.ApplyClientPatch(1, &common.VersionVector{}, time.Time{}, `{"Add":1}`); err == nil {
+		t.Fatal("expected overflow error")
+	}
+}
+
+func TestServerPatches(t *testing.T) {
+	a, b := New(), New()
+	patches := []string{add(t, a, 1, 3), add(t, a, 1, -2), add(t, a, 2, 10)}
+	// Server patches carry absolute tallies, so they can be applied in any order,
+	// and more than once.
+	for _, i := range []int{2, 1, 0, 1} {
+		if err := b.ApplyServerPatch(patches[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkTotal(t, b, 11)
+}
+
+func TestDecode(t *testing.T) {
+	c := New()
+	add(t, c, 1, 4)
+	add(t, c, 2, -6)
+	s, err := c.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTotal(t, d, -2)
+	// The encoded total is for clients; the tallies are what count.
+	if d, err = Decode(`{"P":{"1":2},"Total":100}`); err != nil {
+		t.Fatal(err)
+	}
+	checkTotal(t, d, 2)
+	add(t, d, 1, 1)
+	checkTotal(t, d, 3)
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	for _, sp := range []string{add(t, a, 1, 2), add(t, a, 2, -1)} {
+		if err := b.ApplyServerPatch(sp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Concurrent updates by different agents, and by the same agent.
+	add(t, a, 1, 5)
+	add(t, b, 2, -4)
+	add(t, b, 3, 1)
+	for _, c := range []struct {
+		c, other *CCounter
+	}{{a, b}, {b, a}} {
+		s, err := c.other.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.c.Merge(&common.VersionVector{}, s, &common.VersionVector{}); err != nil {
+			t.Fatal(err)
+		}
+		checkTotal(t, c.c, 3)
+	}
+}
@@ -0,0 +1,540 @@
+// Package clist defines CList, a Logoot-based CRDT list of JSON values.
+//
+// Each element has an immutable id (the Logoot position identifier assigned
+// when the element was inserted) and a mutable position (a Logoot position
+// identifier that determines the element's place in the list). Moving an
+// element assigns it a new position; concurrent moves of the same element are
+// resolved last-one-wins.
+package clist
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+	"github.com/asadovsky/cdb/server/dtypes/logoot"
+)
+
+// stamp orders concurrent moves of the same element.
+type stamp struct {
+	Time    int64 // nanoseconds since the Unix epoch
+	AgentId uint32
+}
+
+// Less returns true iff s is less than other.
+func (s stamp) Less(other stamp) bool {
+	return s.Time < other.Time || (s.Time == other.Time && s.AgentId < other.AgentId)
+}
+
+// Encode encodes this stamp.
+func (s stamp) Encode() string {
+	return fmt.Sprintf("%d.%d", s.Time, s.AgentId)
+}
+
+// decodeStamp decodes the given string into a stamp.
+func decodeStamp(s string) (stamp, error) {
+	var res stamp
+	if _, err := fmt.Sscanf(s, "%d.%d", &res.Time, &res.AgentId); err != nil {
+		return stamp{}, fmt.Errorf("invalid stamp: %s", s)
+	}
+	return res, nil
+}
+
+// op is an operation.
+type op interface {
+	// Encode encodes this op.
+	Encode() (string, error)
+}
+
+// clientInsert represents an insertion of one or more elements from a client.
+type clientInsert struct {
+	PrevPid *logoot.Pid   // nil means start of list
+	NextPid *logoot.Pid   // nil means end of list
+	Values  []interface{} // inserted in order
+}
+
+// Encode encodes this op.
+func (op *clientInsert) Encode() (string, error) {
+	buf, err := json.Marshal(op.Values)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("ci,%s,%s,%s", encodeOptionalPid(op.PrevPid), encodeOptionalPid(op.NextPid), buf), nil
+}
+
+// clientMove represents an element move from a client.
+type clientMove struct {
+	Id      *logoot.Pid
+	PrevPid *logoot.Pid // nil means start of list
+	NextPid *logoot.Pid // nil means end of list
+}
+
+// Encode encodes this op.
+func (op *clientMove) Encode() (string, error) {
+	return fmt.Sprintf("cm,%s,%s,%s", op.Id.Encode(), encodeOptionalPid(op.PrevPid), encodeOptionalPid(op.NextPid)), nil
+}
+
+// insert represents an element insertion. The element's id is its initial
+// position.
+type insert struct {
+	Pid   *logoot.Pid
+	Value interface{}
+}
+
+// Encode encodes this op.
+func (op *insert) Encode() (string, error) {
+	buf, err := json.Marshal(op.Value)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("i,%s,%s", op.Pid.Encode(), buf), nil
+}
+
+// remove represents an element deletion.
+type remove struct {
+	Id *logoot.Pid
+}
+
+// Encode encodes this op.
+func (op *remove) Encode() (string, error) {
+	return fmt.Sprintf("d,%s", op.Id.Encode()), nil
+}
+
+// move represents an element move.
+type move struct {
+	Id    *logoot.Pid
+	Pid   *logoot.Pid // new position
+	Stamp stamp
+}
+
+// Encode encodes this op.
+func (op *move) Encode() (string, error) {
+	return fmt.Sprintf("m,%s,%s,%s", op.Id.Encode(), op.Pid.Encode(), op.Stamp.Encode()), nil
+}
+
+func encodeOptionalPid(p *logoot.Pid) string {
+	if p == nil {
+		return ""
+	}
+	return p.Encode()
+}
+
+func decodeOptionalPid(s string) (*logoot.Pid, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return logoot.DecodePid(s)
+}
+
+func newParseError(s string) error {
+	return fmt.Errorf("failed to parse op: %s", s)
+}
+
+// decodeOp decodes the given string into an op.
+func decodeOp(s string) (op, error) {
+	parts := strings.SplitN(s, ",", 2)
+	t := parts[0]
+	switch t {
+	case "ci":
+		parts = strings.SplitN(s, ",", 4)
+		if len(parts) < 4 {
+			return nil, newParseError(s)
+		}
+		prevPid, err := decodeOptionalPid(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		nextPid, err := decodeOptionalPid(parts[2])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		values := []interface{}{}
+		if err := json.Unmarshal([]byte(parts[3]), &values); err != nil {
+			return nil, newParseError(s)
+		}
+		return &clientInsert{prevPid, nextPid, values}, nil
+	case "cm":
+		parts = strings.SplitN(s, ",", 4)
+		if len(parts) < 4 {
+			return nil, newParseError(s)
+		}
+		id, err := logoot.DecodePid(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		prevPid, err := decodeOptionalPid(parts[2])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		nextPid, err := decodeOptionalPid(parts[3])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &clientMove{id, prevPid, nextPid}, nil
+	case "i":
+		parts = strings.SplitN(s, ",", 3)
+		if len(parts) < 3 {
+			return nil, newParseError(s)
+		}
+		pid, err := logoot.DecodePid(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(parts[2]), &value); err != nil {
+			return nil, newParseError(s)
+		}
+		return &insert{pid, value}, nil
+	case "d":
+		parts = strings.SplitN(s, ",", 2)
+		if len(parts) < 2 {
+			return nil, newParseError(s)
+		}
+		id, err := logoot.DecodePid(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &remove{id}, nil
+	case "m":
+		parts = strings.SplitN(s, ",", 4)
+		if len(parts) < 4 {
+			return nil, newParseError(s)
+		}
+		id, err := logoot.DecodePid(parts[1])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		pid, err := logoot.DecodePid(parts[2])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		st, err := decodeStamp(parts[3])
+		if err != nil {
+			return nil, newParseError(s)
+		}
+		return &move{id, pid, st}, nil
+	default:
+		return nil, fmt.Errorf("unknown op type: %s", t)
+	}
+}
+
+func encodePatch(ops []op) (string, error) {
+	strs := make([]string, len(ops))
+	for i, v := range ops {
+		var err error
+		if strs[i], err = v.Encode(); err != nil {
+			return "", err
+		}
+	}
+	buf, err := json.Marshal(strs)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func decodePatch(s string) ([]op, error) {
+	strs := []string{}
+	if err := json.Unmarshal([]byte(s), &strs); err != nil {
+		return nil, err
+	}
+	ops := make([]op, len(strs))
+	for i, v := range strs {
+		op, err := decodeOp(v)
+		if err != nil {
+			return nil, err
+		}
+		ops[i] = op
+	}
+	return ops, nil
+}
+
+// elem is an element of a list.
+type elem struct {
+	Id    *logoot.Pid
+	Pid   *logoot.Pid
+	Stamp stamp // stamp of the most recent move; zero if never moved
+	Value interface{}
+}
+
+var (
+	_ json.Marshaler   = (*elem)(nil)
+	_ json.Unmarshaler = (*elem)(nil)
+)
+
+type jsonElem struct {
+	Id    string
+	Pid   string
+	Stamp string
+	Value interface{}
+}
+
+// MarshalJSON marshals to JSON.
+func (e *elem) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonElem{
+		Id:    e.Id.Encode(),
+		Pid:   e.Pid.Encode(),
+		Stamp: e.Stamp.Encode(),
+		Value: e.Value,
+	})
+}
+
+// UnmarshalJSON unmarshals from JSON.
+func (e *elem) UnmarshalJSON(data []byte) error {
+	var x jsonElem
+	if err := json.Unmarshal(data, &x); err != nil {
+		return err
+	}
+	id, err := logoot.DecodePid(x.Id)
+	if err != nil {
+		return err
+	}
+	pid, err := logoot.DecodePid(x.Pid)
+	if err != nil {
+		return err
+	}
+	st, err := decodeStamp(x.Stamp)
+	if err != nil {
+		return err
+	}
+	*e = elem{Id: id, Pid: pid, Stamp: st, Value: x.Value}
+	return nil
+}
+
+// CList is a CRDT list (Logoot, plus moves).
+type CList struct {
+	elems []*elem          // sorted by Pid
+	ids   map[string]*elem // keyed by encoded Id
+}
+
+// New returns a new CList.
+func New() *CList {
+	return &CList{ids: map[string]*elem{}}
+}
+
+// DType implements CValue.DType.
+func (l *CList) DType() string {
+	return cvalue.DTypeCList
+}
+
+// Encode implements CValue.Encode.
+func (l *CList) Encode() (string, error) {
+	buf, err := json.Marshal(l.elems)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Decode decodes the given value into a CList.
+func Decode(s string) (*CList, error) {
+	elems := []*elem{}
+	if err := json.Unmarshal([]byte(s), &elems); err != nil {
+		return nil, err
+	}
+	l := New()
+	for i, e := range elems {
+		if i > 0 && !elems[i-1].Pid.Less(e.Pid) {
+			return nil, fmt.Errorf("elems out of order: %s", e.Pid.Encode())
+		}
+		idStr := e.Id.Encode()
+		if _, ok := l.ids[idStr]; ok {
+			return nil, fmt.Errorf("duplicate elem: %s", idStr)
+		}
+		l.ids[idStr] = e
+	}
+	l.elems = elems
+	return l, nil
+}
+
+// ApplyServerPatch implements CValue.ApplyServerPatch.
+func (l *CList) ApplyServerPatch(patch string) error {
+	ops, err := decodePatch(patch)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		var err error
+		switch v := op.(type) {
+		case *insert:
+			err = l.applyInsert(v)
+		case *remove:
+			err = l.applyRemove(v)
+		case *move:
+			err = l.applyMove(v)
+		default:
+			err = fmt.Errorf("invalid op type: %T", v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyClientPatch implements CValue.ApplyClientPatch.
+func (l *CList) ApplyClientPatch(agentId uint32, vec *common.VersionVector, t time.Time, patch string) (string, error) {
+	agentSeq := vec.Get(agentId)
+	// Sanity check.
+	if agentSeq == 0 {
+		return "", fmt.Errorf("unknown agent: %d", agentId)
+	}
+	ops, err := decodePatch(patch)
+	if err != nil {
+		return "", err
+	}
+	appliedOps := make([]op, 0, len(ops))
+	for _, op := range ops {
+		switch v := op.(type) {
+		case *clientInsert:
+			prevPid := v.PrevPid
+			for _, value := range v.Values {
+				x := &insert{logoot.GenPid(agentId, agentSeq, prevPid, v.NextPid), value}
+				if err := l.applyInsert(x); err != nil {
+					return "", err
+				}
+				appliedOps = append(appliedOps, x)
+				prevPid = x.Pid
+			}
+		case *clientMove:
+			if _, ok := l.ids[v.Id.Encode()]; !ok {
+				return "", fmt.Errorf("unknown elem: %s", v.Id.Encode())
+			}
+			x := &move{v.Id, logoot.GenPid(agentId, agentSeq, v.PrevPid, v.NextPid), stamp{t.UnixNano(), agentId}}
+			if err := l.applyMove(x); err != nil {
+				return "", err
+			}
+			appliedOps = append(appliedOps, x)
+		case *insert:
+			if err := l.applyInsert(v); err != nil {
+				return "", err
+			}
+			appliedOps = append(appliedOps, op)
+		case *remove:
+			if err := l.applyRemove(v); err != nil {
+				return "", err
+			}
+			appliedOps = append(appliedOps, op)
+		default:
+			return "", fmt.Errorf("unknown op type: %T", v)
+		}
+	}
+	return encodePatch(appliedOps)
+}
+
+// applyInsert applies the given insertion. Insertions of existing elements are
+// ignored. Returns an error if the element's position is already taken.
+func (l *CList) applyInsert(op *insert) error {
+	idStr := op.Pid.Encode()
+	if _, ok := l.ids[idStr]; ok {
+		return nil
+	}
+	e := &elem{Id: op.Pid, Pid: op.Pid, Value: op.Value}
+	if err := l.insertElem(e); err != nil {
+		return err
+	}
+	l.ids[idStr] = e
+	return nil
+}
+
+func (l *CList) applyRemove(op *remove) error {
+	idStr := op.Id.Encode()
+	e, ok := l.ids[idStr]
+	if !ok {
+		return nil
+	}
+	if err := l.removeElem(e); err != nil {
+		return err
+	}
+	delete(l.ids, idStr)
+	return nil
+}
+
+// applyMove applies the given move. Moves of deleted elements are ignored, as
+// are moves older than the element's most recent move. Returns an error if the
+// new position is taken by another element.
+func (l *CList) applyMove(op *move) error {
+	e, ok := l.ids[op.Id.Encode()]
+	if !ok || op.Stamp.Less(e.Stamp) {
+		return nil
+	}
+	if p := l.search(op.Pid); p < len(l.elems) && l.elems[p] != e && l.elems[p].Pid.Equal(op.Pid) {
+		return fmt.Errorf("duplicate pid: %s", op.Pid.Encode())
+	}
+	if err := l.removeElem(e); err != nil {
+		return err
+	}
+	e.Pid, e.Stamp = op.Pid, op.Stamp
+	return l.insertElem(e)
+}
+
+// insertElem inserts the given elem at its position. Positions are unique, so
+// returns an error if the position is already taken.
+func (l *CList) insertElem(e *elem) error {
+	p := l.search(e.Pid)
+	if p < len(l.elems) && l.elems[p].Pid.Equal(e.Pid) {
+		return fmt.Errorf("duplicate pid: %s", e.Pid.Encode())
+	}
+	// https://github.com/golang/go/wiki/SliceTricks
+	l.elems = append(l.elems, nil)
+	copy(l.elems[p+1:], l.elems[p:])
+	l.elems[p] = e
+	return nil
+}
+
+// removeElem removes the given elem, which must be at its position.
+func (l *CList) removeElem(e *elem) error {
+	a := l.elems
+	p := l.search(e.Pid)
+	if p == len(a) || a[p] != e {
+		return fmt.Errorf("elem not found: %s", e.Id.Encode())
+	}
+	// https://github.com/golang/go/wiki/SliceTricks
+	a, a[len(a)-1] = append(a[:p], a[p+1:]...), nil
+	l.elems = a
+	return nil
+}
+
+// search returns the position of the first elem with pid >= the given pid.
+func (l *CList) search(p *logoot.Pid) int {
+	return sort.Search(len(l.elems), func(i int) bool { return !l.elems[i].Pid.Less(p) })
+}
+
+// Merge implements CValue.Merge.
+func (l *CList) Merge(vec *common.VersionVector, other string, otherVec *common.VersionVector) error {
+	o, err := Decode(other)
+	if err != nil {
+		return err
+	}
+	// Drop elements that the other list has removed.
+	for idStr, e := range l.ids {
+		if _, ok := o.ids[idStr]; !ok && otherVec.Contains(e.Id.Dot()) {
+			if err := l.applyRemove(&remove{e.Id}); err != nil {
+				return err
+			}
+		}
+	}
+	for idStr, oe := range o.ids {
+		if e, ok := l.ids[idStr]; ok {
+			if e.Stamp.Less(oe.Stamp) {
+				if err := l.applyMove(&move{oe.Id, oe.Pid, oe.Stamp}); err != nil {
+					return err
+				}
+			}
+		} else if !vec.Contains(oe.Id.Dot()) {
+			if err := l.applyInsert(&insert{oe.Id, oe.Value}); err != nil {
+				return err
+			}
+			if oe.Stamp != (stamp{}) {
+				if err := l.applyMove(&move{oe.Id, oe.Pid, oe.Stamp}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
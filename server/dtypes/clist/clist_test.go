@@ -0,0 +1,261 @@
+package clist
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// replica is a CList along with the patches it reflects.
+type replica struct {
+	l   *CList
+	vec *common.VersionVector
+}
+
+func newReplica() *replica {
+	return &replica{New(), &common.VersionVector{}}
+}
+
+// apply applies the given client ops as a new patch from the given agent at the
+// given time, and returns the resulting server patch.
+func (r *replica) apply(t *testing.T, agentId uint32, ts int64, ops ...string) string {
+	t.Helper()
+	r.vec.Put(agentId, r.vec.Get(agentId)+1)
+	patch, err := encodeStrings(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := r.l.ApplyClientPatch(agentId, r.vec.Copy(), time.Unix(ts, 0), patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+// bounds returns the encoded pids on either side of position p.
+func (r *replica) bounds(p int) (prev, next string) {
+	if p > 0 {
+		prev = r.l.elems[p-1].Pid.Encode()
+	}
+	if p < len(r.l.elems) {
+		next = r.l.elems[p].Pid.Encode()
+	}
+	return
+}
+
+// insertAt returns a client op that inserts the given encoded values at
+// position p.
+func (r *replica) insertAt(p int, values string) string {
+	prev, next := r.bounds(p)
+	return fmt.Sprintf("ci,%s,%s,%s", prev, next, values)
+}
+
+// moveTo returns a client op that moves the element at position from to
+// position to, as counted before the move.
+func (r *replica) moveTo(from, to int) string {
+	prev, next := r.bounds(to)
+	return fmt.Sprintf("cm,%s,%s,%s", r.l.elems[from].Id.Encode(), prev, next)
+}
+
+// removeAt returns a client op that removes the element at position p.
+func (r *replica) removeAt(p int) string {
+	return "d," + r.l.elems[p].Id.Encode()
+}
+
+func encodeStrings(ops []string) (string, error) {
+	decoded := make([]op, len(ops))
+	for i, s := range ops {
+		var err error
+		if decoded[i], err = decodeOp(s); err != nil {
+			return "", err
+		}
+	}
+	return encodePatch(decoded)
+}
+
+func checkValues(t *testing.T, l *CList, want ...interface{}) {
+	t.Helper()
+	got := []interface{}{}
+	for _, e := range l.elems {
+		got = append(got, e.Value)
+	}
+	if want == nil {
+		want = []interface{}{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func encode(t *testing.T, l *CList) string {
+	t.Helper()
+	s, err := l.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func decode(t *testing.T, s string) *CList {
+	t.Helper()
+	l, err := Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestInsertRemoveMove(t *testing.T) {
+	r := newReplica()
+	r.apply(t, 1, 1, r.insertAt(0, `["a","b","c"]`))
+	r.apply(t, 1, 2, r.insertAt(1, `[1,{"x":null}]`))
+	checkValues(t, r.l, "a", 1.0, map[string]interface{}{"x": nil}, "b", "c")
+	r.apply(t, 1, 3, r.removeAt(2), r.moveTo(0, 5))
+	checkValues(t, r.l, 1.0, "b", "c", "a")
+	// Moving or removing a removed element is rejected or ignored respectively.
+	id := r.l.elems[0].Id.Encode()
+	r.apply(t, 1, 4, "d,"+id, "d,"+id)
+	checkValues(t, r.l, "b", "c", "a")
+	if _, err := r.l.ApplyClientPatch(1, r.vec, time.Unix(5, 0), fmt.Sprintf(`["cm,%s,,"]`, id)); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := r.l.ApplyClientPatch(1, &common.VersionVector{}, time.Unix(5, 0), `["ci,,,[1]"]`); err == nil {
+		t.Fatal("expected error for unknown agent")
+	}
+}
+
+func TestConcurrentMoves(t *testing.T) {
+	a, b := newReplica(), newReplica()
+	if err := b.l.ApplyServerPatch(a.apply(t, 1, 1, a.insertAt(0, `["x","y","z"]`))); err != nil {
+		t.Fatal(err)
+	}
+	b.vec.Put(1, 1)
+	// a moves x to the end at time 3; b concurrently moves x between y and z at
+	// time 2. The later move wins on both replicas.
+	pa := a.apply(t, 1, 3, a.moveTo(0, 3))
+	pb := b.apply(t, 2, 2, b.moveTo(0, 2))
+	for _, c := range []struct {
+		r     *replica
+		patch string
+	}{{a, pb}, {b, pa}} {
+		if err := c.r.l.ApplyServerPatch(c.patch); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, c.r.l, "y", "z", "x")
+	}
+	if got, want := encode(t, b.l), encode(t, a.l); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	r := newReplica()
+	r.apply(t, 1, 1, r.insertAt(0, `["a",2,true]`))
+	r.apply(t, 2, 2, r.moveTo(2, 0), r.removeAt(1))
+	s := encode(t, r.l)
+	l := decode(t, s)
+	checkValues(t, l, true, "a")
+	if got := encode(t, l); got != s {
+		t.Fatalf("got %s, want %s", got, s)
+	}
+	// The decoded list keeps element ids and move stamps, so an older move of
+	// the moved element is ignored.
+	if err := l.ApplyServerPatch(r.apply(t, 3, 1, r.moveTo(0, 2))); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, l, true, "a")
+	if err := l.ApplyServerPatch(`["d,` + l.elems[1].Id.Encode() + `"]`); err != nil {
+		t.Fatal(err)
+	}
+	checkValues(t, l, true)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	r := newReplica()
+	r.apply(t, 1, 1, r.insertAt(0, `["a","b"]`))
+	x, y := r.l.elems[0], r.l.elems[1]
+	marshal := func(e *elem) string {
+		buf, err := json.Marshal(e)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf)
+	}
+	for _, value := range []string{
+		`{}`,
+		`[{"Id":"bad","Pid":"bad","Stamp":"0.0"}]`,
+		fmt.Sprintf(`[{"Id":%q,"Pid":%q,"Stamp":"bad"}]`, x.Id.Encode(), x.Pid.Encode()),
+		"[" + marshal(y) + "," + marshal(x) + "]",
+		"[" + marshal(x) + "," + marshal(&elem{Id: x.Id, Pid: y.Pid}) + "]",
+	} {
+		if _, err := Decode(value); err == nil {
+			t.Errorf("%s: expected error", value)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := newReplica()
+	base.apply(t, 1, 1, base.insertAt(0, `["a","b","c"]`))
+	a := &replica{decode(t, encode(t, base.l)), base.vec.Copy()}
+	b := &replica{decode(t, encode(t, base.l)), base.vec.Copy()}
+	// Concurrently, a removes "b" and moves "a" to the end, and b inserts "x" at
+	// the start and moves "a" before "c".
+	pa := a.apply(t, 1, 3, a.removeAt(1), a.moveTo(0, 3))
+	pb := b.apply(t, 2, 2, b.insertAt(0, `["x"]`), b.moveTo(1, 3))
+	for _, c := range []struct {
+		r, other *replica
+		patch    string
+	}{{a, b, pb}, {b, a, pa}} {
+		want := decode(t, encode(t, c.r.l))
+		if err := want.ApplyServerPatch(c.patch); err != nil {
+			t.Fatal(err)
+		}
+		got := decode(t, encode(t, c.r.l))
+		if err := got.Merge(c.r.vec, encode(t, c.other.l), c.other.vec); err != nil {
+			t.Fatal(err)
+		}
+		checkValues(t, got, "x", "c", "a")
+		if encode(t, got) != encode(t, want) {
+			t.Fatalf("got %s, want %s", encode(t, got), encode(t, want))
+		}
+	}
+	if err := a.l.Merge(a.vec, `[{"Id":"bad"}]`, b.vec); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// TestDuplicatePid checks that an insertion at a position taken by a moved
+// element is rejected, rather than corrupting the list.
+func TestDuplicatePid(t *testing.T) {
+	l, vec := New(), &common.VersionVector{1: 1}
+	if _, err := l.ApplyClientPatch(1, vec, time.Unix(1, 0), `["ci,,,[1,2]"]`); err != nil {
+		t.Fatal(err)
+	}
+	x := l.elems[0]
+	vec.Put(1, 2)
+	if _, err := l.ApplyClientPatch(1, vec, time.Unix(2, 0), fmt.Sprintf("[%q]", "cm,"+x.Id.Encode()+","+l.elems[1].Pid.Encode()+",")); err != nil {
+		t.Fatal(err)
+	}
+	if l.elems[1] != x {
+		t.Fatalf("elem not moved: %v", l.elems)
+	}
+	vec.Put(1, 3)
+	patch := fmt.Sprintf("[%q]", "i,"+x.Pid.Encode()+",3")
+	if _, err := l.ApplyClientPatch(1, vec, time.Unix(3, 0), patch); err == nil {
+		t.Fatal("expected error")
+	}
+	if err := l.ApplyServerPatch(patch); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, err := l.ApplyClientPatch(1, vec, time.Unix(3, 0), fmt.Sprintf("[%q]", "d,"+x.Id.Encode())); err != nil {
+		t.Fatal(err)
+	}
+	if len(l.elems) != 1 || l.elems[0] == x {
+		t.Fatalf("wrong elem removed: %v", l.elems)
+	}
+}
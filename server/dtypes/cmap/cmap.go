@@ -0,0 +1,419 @@
+// Package cmap defines CMap, a CRDT map whose entries are CValues of any dtype,
+// including CMap itself.
+//
+// Key presence has observed-remove (add-wins) semantics: each update of an
+// entry tags it with the update's dot, i.e. its creator's agent id and
+// sequence number, and each deletion removes only the tags its creator had
+// observed. An entry is present iff it has at least one tag.
+//
+// Values, on the other hand, behave like the store's keys: a deletion trumps
+// any concurrent updates of the deleted value. Each entry has a tombstone, the
+// merge of the version vectors of all deletions of the entry. A deletion resets
+// the entry's value, and an update is applied to the value iff its creator had
+// observed every deletion in the tombstone; otherwise, it only tags the entry.
+// Thus, an entry recreated after a deletion starts from a zero value, possibly
+// of a different dtype.
+//
+// Concurrent updates may create an entry with different dtypes. The entry
+// keeps a value per dtype, and its dtype is that of its lowest tag, so that all
+// replicas agree on it regardless of the order in which updates are applied.
+package cmap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+)
+
+const (
+	opUpdate = "update"
+	opDelete = "delete"
+)
+
+// op is an operation on the entry at Path. All but the last path element must
+// name CMap entries.
+//
+// Client ops have Op, Path, and (for updates) DType and Patch, where Patch is a
+// client patch for the nested value. Server ops additionally have Vec, the
+// version vector of the patch's creator, and (for updates) Dot, and Patch is a
+// server patch for the nested value.
+type op struct {
+	Op    string
+	Path  []string
+	DType string                `json:",omitempty"`
+	Patch string                `json:",omitempty"` // encoded
+	Dot   string                `json:",omitempty"` // tag added by an update
+	Vec   *common.VersionVector `json:",omitempty"`
+}
+
+func decodePatch(s string) ([]*op, error) {
+	ops := []*op{}
+	if err := json.Unmarshal([]byte(s), &ops); err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		if len(op.Path) == 0 {
+			return nil, errors.New("empty path")
+		}
+		if op.Op != opUpdate && op.Op != opDelete {
+			return nil, fmt.Errorf("unknown op type: %s", op.Op)
+		}
+	}
+	return ops, nil
+}
+
+func encodePatch(ops []*op) (string, error) {
+	buf, err := json.Marshal(ops)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// entry is a map entry.
+type entry struct {
+	Tags map[common.Dot]string // tag -> dtype of the update that added it
+	// Merged version vectors of all deletions of this entry. Nil if the entry
+	// has never been deleted.
+	Tombstone *common.VersionVector
+	Values    map[string]cvalue.CValue // dtype -> value
+}
+
+func newEntry() *entry {
+	return &entry{Tags: map[common.Dot]string{}, Values: map[string]cvalue.CValue{}}
+}
+
+// present returns true iff the entry is present, i.e. not deleted.
+func (e *entry) present() bool {
+	return len(e.Tags) > 0
+}
+
+// dtype returns the dtype of the entry's lowest tag, or "" if the entry is not
+// present.
+func (e *entry) dtype() string {
+	var min common.Dot
+	res := ""
+	for d, dtype := range e.Tags {
+		if res == "" || dotLess(d, min) {
+			min, res = d, dtype
+		}
+	}
+	return res
+}
+
+// tombstone returns the tombstone, or an empty version vector if the entry has
+// never been deleted.
+func (e *entry) tombstone() *common.VersionVector {
+	if e.Tombstone == nil {
+		return &common.VersionVector{}
+	}
+	return e.Tombstone
+}
+
+// delete drops the tags covered by the given version vector and merges it into
+// the tombstone. Resets the entry's values if the tombstone grew.
+func (e *entry) delete(vec *common.VersionVector) {
+	for d := range e.Tags {
+		if vec.Contains(d) {
+			delete(e.Tags, d)
+		}
+	}
+	if vec.Leq(e.tombstone()) {
+		return
+	}
+	if e.Tombstone == nil {
+		e.Tombstone = &common.VersionVector{}
+	}
+	e.Tombstone.Merge(vec)
+	e.Values = map[string]cvalue.CValue{}
+}
+
+// dotLess orders dots by agent id, then by sequence number.
+func dotLess(a, b common.Dot) bool {
+	return a.AgentId < b.AgentId || (a.AgentId == b.AgentId && a.AgentSeq < b.AgentSeq)
+}
+
+type jsonEntry struct {
+	Tags      map[string]string     // encoded dot -> dtype
+	Tombstone *common.VersionVector `json:",omitempty"`
+	Values    map[string]string     // dtype -> encoded value
+}
+
+// CMap is a CRDT map of CValues.
+type CMap struct {
+	f cvalue.Factory
+	m map[string]*entry
+}
+
+// New returns a new CMap that uses the given factory to create nested values.
+func New(f cvalue.Factory) *CMap {
+	return &CMap{f: f, m: map[string]*entry{}}
+}
+
+// DType implements CValue.DType.
+func (m *CMap) DType() string {
+	return cvalue.DTypeCMap
+}
+
+// Encode implements CValue.Encode.
+func (m *CMap) Encode() (string, error) {
+	x := map[string]jsonEntry{}
+	for k, e := range m.m {
+		je := jsonEntry{Tags: map[string]string{}, Tombstone: e.Tombstone, Values: map[string]string{}}
+		for d, dtype := range e.Tags {
+			je.Tags[d.Encode()] = dtype
+		}
+		for dtype, value := range e.Values {
+			valueStr, err := value.Encode()
+			if err != nil {
+				return "", err
+			}
+			je.Values[dtype] = valueStr
+		}
+		x[k] = je
+	}
+	buf, err := json.Marshal(x)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Decode decodes the given value into a CMap that uses the given factory to
+// create nested values.
+func Decode(f cvalue.Factory, s string) (*CMap, error) {
+	x := map[string]jsonEntry{}
+	if err := json.Unmarshal([]byte(s), &x); err != nil {
+		return nil, err
+	}
+	m := New(f)
+	for k, je := range x {
+		e := newEntry()
+		e.Tombstone = je.Tombstone
+		for tag, dtype := range je.Tags {
+			d, err := common.DecodeDot(tag)
+			if err != nil {
+				return nil, err
+			}
+			e.Tags[d] = dtype
+		}
+		for dtype, valueStr := range je.Values {
+			value, err := f.DecodeValue(dtype, valueStr)
+			if err != nil {
+				return nil, err
+			}
+			e.Values[dtype] = value
+		}
+		m.m[k] = e
+	}
+	return m, nil
+}
+
+// value returns the entry's value of the given dtype, creating a zero value if
+// needed.
+func (m *CMap) value(e *entry, dtype string) (cvalue.CValue, error) {
+	if v, ok := e.Values[dtype]; ok {
+		return v, nil
+	}
+	v, err := m.f.NewZeroValue(dtype)
+	if err != nil {
+		return nil, err
+	}
+	e.Values[dtype] = v
+	return v, nil
+}
+
+// applyUpdate applies an update, identified by the given dot and created by
+// an agent whose knowledge is vec, of the value at the given path, tagging
+// every entry along the path. Calls apply with the value to update, unless the
+// update is concurrent with a deletion along the path. If strict is true,
+// returns an error if an entry along the path is present with another dtype.
+func (m *CMap) applyUpdate(path []string, dtype string, d common.Dot, vec *common.VersionVector, strict bool, apply func(cvalue.CValue) error) error {
+	key, entryDType := path[0], dtype
+	if len(path) > 1 {
+		entryDType = cvalue.DTypeCMap
+	}
+	// Validate the dtype before tagging the entry with it.
+	if _, err := m.f.NewZeroValue(entryDType); err != nil {
+		return err
+	}
+	e, ok := m.m[key]
+	if !ok {
+		e = newEntry()
+		m.m[key] = e
+	}
+	if strict && e.present() && e.dtype() != entryDType {
+		return fmt.Errorf("wrong dtype for key %s: got %s, want %s", key, entryDType, e.dtype())
+	}
+	e.Tags[d] = entryDType
+	if !e.tombstone().Leq(vec) {
+		return nil
+	}
+	v, err := m.value(e, entryDType)
+	if err != nil {
+		return err
+	}
+	if len(path) == 1 {
+		return apply(v)
+	}
+	return v.(*CMap).applyUpdate(path[1:], dtype, d, vec, strict, apply)
+}
+
+// lookup returns the entry at the given path, or nil if any entry or map value
+// along the path is missing. Also returns nil if an op created by an agent
+// whose knowledge is vec is concurrent with a deletion of an entry along the
+// path, excluding the last.
+func (m *CMap) lookup(path []string, vec *common.VersionVector) *entry {
+	e := m.m[path[0]]
+	if e == nil || len(path) == 1 {
+		return e
+	}
+	if !e.tombstone().Leq(vec) {
+		return nil
+	}
+	child, ok := e.Values[cvalue.DTypeCMap].(*CMap)
+	if !ok {
+		return nil
+	}
+	return child.lookup(path[1:], vec)
+}
+
+// ApplyServerPatch implements CValue.ApplyServerPatch.
+func (m *CMap) ApplyServerPatch(patch string) error {
+	ops, err := decodePatch(patch)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if op.Vec == nil {
+			return errors.New("missing vec")
+		}
+		switch op.Op {
+		case opUpdate:
+			d, err := common.DecodeDot(op.Dot)
+			if err != nil {
+				return err
+			}
+			if err := m.applyUpdate(op.Path, op.DType, d, op.Vec, false, func(v cvalue.CValue) error {
+				return v.ApplyServerPatch(op.Patch)
+			}); err != nil {
+				return err
+			}
+		case opDelete:
+			if e := m.lookup(op.Path, op.Vec); e != nil {
+				e.delete(op.Vec)
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyClientPatch implements CValue.ApplyClientPatch.
+func (m *CMap) ApplyClientPatch(agentId uint32, vec *common.VersionVector, t time.Time, patch string) (string, error) {
+	d := common.Dot{AgentId: agentId, AgentSeq: vec.Get(agentId)}
+	// Sanity check.
+	if d.AgentSeq == 0 {
+		return "", fmt.Errorf("unknown agent: %d", agentId)
+	}
+	ops, err := decodePatch(patch)
+	if err != nil {
+		return "", err
+	}
+	appliedOps := make([]*op, 0, len(ops))
+	for _, v := range ops {
+		switch v.Op {
+		case opUpdate:
+			var serverPatch string
+			if err := m.applyUpdate(v.Path, v.DType, d, vec, true, func(value cvalue.CValue) error {
+				var err error
+				serverPatch, err = value.ApplyClientPatch(agentId, vec, t, v.Patch)
+				return err
+			}); err != nil {
+				return "", err
+			}
+			appliedOps = append(appliedOps, &op{Op: opUpdate, Path: v.Path, DType: v.DType, Patch: serverPatch, Dot: d.Encode(), Vec: vec})
+		case opDelete:
+			e := m.lookup(v.Path, vec)
+			if e == nil || !e.present() {
+				continue
+			}
+			e.delete(vec)
+			appliedOps = append(appliedOps, &op{Op: opDelete, Path: v.Path, Vec: vec})
+		}
+	}
+	return encodePatch(appliedOps)
+}
+
+// Merge implements CValue.Merge.
+func (m *CMap) Merge(vec *common.VersionVector, other string, otherVec *common.VersionVector) error {
+	o, err := Decode(m.f, other)
+	if err != nil {
+		return err
+	}
+	for k, oe := range o.m {
+		e, ok := m.m[k]
+		if !ok {
+			e = newEntry()
+			m.m[k] = e
+		}
+		if err := m.mergeEntry(e, vec, oe, otherVec); err != nil {
+			return err
+		}
+	}
+	for k, e := range m.m {
+		if _, ok := o.m[k]; !ok {
+			if err := m.mergeEntry(e, vec, newEntry(), otherVec); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeEntry merges other into e. Values survive only from states that had
+// applied every deletion in the merged tombstone.
+func (m *CMap) mergeEntry(e *entry, vec *common.VersionVector, other *entry, otherVec *common.VersionVector) error {
+	ts := e.tombstone().Copy()
+	ts.Merge(other.tombstone())
+	full, otherFull := ts.Leq(e.tombstone()), ts.Leq(other.tombstone())
+	dots, otherDots := map[common.Dot]bool{}, map[common.Dot]bool{}
+	dtypes := map[common.Dot]string{}
+	for d, dtype := range e.Tags {
+		dots[d], dtypes[d] = true, dtype
+	}
+	for d, dtype := range other.Tags {
+		otherDots[d], dtypes[d] = true, dtype
+	}
+	e.Tags = map[common.Dot]string{}
+	for d := range common.MergeDots(dots, vec, otherDots, otherVec) {
+		e.Tags[d] = dtypes[d]
+	}
+	if e.Tombstone != nil || other.Tombstone != nil {
+		e.Tombstone = ts
+	}
+	switch {
+	case full && otherFull:
+		for dtype, ov := range other.Values {
+			valueStr, err := ov.Encode()
+			if err != nil {
+				return err
+			}
+			v, err := m.value(e, dtype)
+			if err != nil {
+				return err
+			}
+			if err := v.Merge(vec, valueStr, otherVec); err != nil {
+				return err
+			}
+		}
+	case otherFull:
+		e.Values = other.Values
+	case !full:
+		e.Values = map[string]cvalue.CValue{}
+	}
+	return nil
+}
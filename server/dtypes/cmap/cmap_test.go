@@ -0,0 +1,315 @@
+package cmap
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cregister"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+)
+
+// factory implements cvalue.Factory for the dtypes used by these tests.
+type factory struct{}
+
+func (factory) NewZeroValue(dtype string) (cvalue.CValue, error) {
+	switch dtype {
+	case cvalue.DTypeCRegister:
+		return cregister.New(), nil
+	case cvalue.DTypeCMap:
+		return New(factory{}), nil
+	default:
+		return nil, fmt.Errorf("unknown dtype: %s", dtype)
+	}
+}
+
+func (factory) DecodeValue(dtype, value string) (cvalue.CValue, error) {
+	switch dtype {
+	case cvalue.DTypeCRegister:
+		return cregister.Decode(value)
+	case cvalue.DTypeCMap:
+		return Decode(factory{}, value)
+	default:
+		return nil, fmt.Errorf("unknown dtype: %s", dtype)
+	}
+}
+
+func encode(t *testing.T, c *CMap) string {
+	t.Helper()
+	s, err := c.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func decode(t *testing.T, s string) *CMap {
+	t.Helper()
+	c, err := Decode(factory{}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// canonical re-encodes the given encoded map such that equal maps have equal
+// encodings. Nested maps are encoded in map iteration order.
+func canonical(t *testing.T, s string) string {
+	t.Helper()
+	x := map[string]jsonEntry{}
+	if err := json.Unmarshal([]byte(s), &x); err != nil {
+		t.Fatal(err)
+	}
+	for k, je := range x {
+		if v, ok := je.Values[cvalue.DTypeCMap]; ok {
+			je.Values[cvalue.DTypeCMap] = canonical(t, v)
+			x[k] = je
+		}
+	}
+	buf, err := json.Marshal(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+// applyClient applies a client patch with the given ops from the given agent,
+// whose knowledge (including the patch) is vec, and returns the server patch.
+func applyClient(t *testing.T, m *CMap, agentId uint32, vec common.VersionVector, ops ...*op) string {
+	t.Helper()
+	patch, err := encodePatch(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := m.ApplyClientPatch(agentId, &vec, time.Unix(1, 0), patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func applyServer(t *testing.T, m *CMap, patches ...string) {
+	t.Helper()
+	for _, sp := range patches {
+		if err := m.ApplyServerPatch(sp); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// set returns a client op that sets the register at the given path to the
+// given encoded value.
+func set(value string, path ...string) *op {
+	return &op{Op: opUpdate, Path: path, DType: cvalue.DTypeCRegister, Patch: value}
+}
+
+// del returns a client op that deletes the entry at the given path.
+func del(path ...string) *op {
+	return &op{Op: opDelete, Path: path}
+}
+
+// absent is the value of an entry that is not present.
+const absent = "<absent>"
+
+// val returns the value of the register at the given path, nil if the entry
+// has no register value, or absent if the entry is not present.
+func val(m *CMap, path ...string) interface{} {
+	e := m.m[path[0]]
+	if e == nil || !e.present() {
+		return absent
+	}
+	if len(path) > 1 {
+		child, ok := e.Values[cvalue.DTypeCMap].(*CMap)
+		if !ok {
+			return absent
+		}
+		return val(child, path[1:]...)
+	}
+	r, ok := e.Values[cvalue.DTypeCRegister].(*cregister.CRegister)
+	if !ok {
+		return nil
+	}
+	return r.Val
+}
+
+func checkVal(t *testing.T, m *CMap, want interface{}, path ...string) {
+	t.Helper()
+	if got := val(m, path...); got != want {
+		t.Fatalf("%v: got %v, want %v", path, got, want)
+	}
+}
+
+func TestUpdateDelete(t *testing.T) {
+	m := New(factory{})
+	applyClient(t, m, 1, common.VersionVector{1: 1}, set(`1`, "k"))
+	applyClient(t, m, 1, common.VersionVector{1: 2}, set(`2`, "n", "a"), set(`3`, "n", "b"))
+	checkVal(t, m, 1.0, "k")
+	checkVal(t, m, 2.0, "n", "a")
+	checkVal(t, m, 3.0, "n", "b")
+	if sp := applyClient(t, m, 1, common.VersionVector{1: 3}, del("n", "a"), del("x")); sp != `[{"Op":"delete","Path":["n","a"],"Vec":{"1":3}}]` {
+		t.Fatalf("got server patch %s", sp)
+	}
+	checkVal(t, m, absent, "n", "a")
+	checkVal(t, m, 3.0, "n", "b")
+	for _, patch := range []string{
+		`{}`,
+		`[{"Op":"update","Path":[],"DType":"cregister","Patch":"1"}]`,
+		`[{"Op":"clear","Path":["k"]}]`,
+		`[{"Op":"update","Path":["y"],"DType":"cfoo","Patch":"1"}]`,
+		// Present entries keep their dtype.
+		`[{"Op":"update","Path":["k","a"],"DType":"cregister","Patch":"1"}]`,
+		`[{"Op":"update","Path":["n"],"DType":"cregister","Patch":"1"}]`,
+	} {
+		if _, err := m.ApplyClientPatch(1, &common.VersionVector{1: 4}, time.Unix(1, 0), patch); err == nil {
+			t.Errorf("%s: expected error", patch)
+		}
+	}
+	if _, ok := m.m["y"]; ok {
+		t.Fatal("entry created with unknown dtype")
+	}
+	if err := m.ApplyServerPatch(`[{"Op":"delete","Path":["k"]}]`); err == nil {
+		t.Fatal("expected error for missing vec")
+	}
+}
+
+// TestConcurrentDelete checks that an update concurrent with a deletion keeps
+// the entry present, but does not resurrect its deleted value.
+func TestConcurrentDelete(t *testing.T) {
+	a, b := New(factory{}), New(factory{})
+	applyServer(t, b, applyClient(t, a, 1, common.VersionVector{1: 1}, set(`1`, "k")))
+	spA := applyClient(t, a, 1, common.VersionVector{1: 2}, set(`2`, "k"))
+	spB := applyClient(t, b, 2, common.VersionVector{1: 1, 2: 1}, del("k"))
+	applyServer(t, a, spB)
+	applyServer(t, b, spA)
+	for _, m := range []*CMap{a, b} {
+		checkVal(t, m, nil, "k")
+	}
+	if got, want := canonical(t, encode(t, a)), canonical(t, encode(t, b)); got != want {
+		t.Fatalf("replicas diverged: %s != %s", got, want)
+	}
+	// Later updates apply to the zero value.
+	applyClient(t, a, 1, common.VersionVector{1: 3, 2: 1}, set(`3`, "k"))
+	checkVal(t, a, 3.0, "k")
+}
+
+// TestConcurrentCreates checks that replicas agree on the dtype of an entry
+// created concurrently with different dtypes, regardless of the order in which
+// they apply the creates.
+func TestConcurrentCreates(t *testing.T) {
+	for _, x := range []struct {
+		op1, op2 *op
+		want     string
+	}{
+		{set(`1`, "k"), set(`1`, "k", "a"), cvalue.DTypeCRegister},
+		{set(`1`, "k", "a"), set(`1`, "k"), cvalue.DTypeCMap},
+	} {
+		a, b := New(factory{}), New(factory{})
+		spA := applyClient(t, a, 1, common.VersionVector{1: 1}, x.op1)
+		spB := applyClient(t, b, 2, common.VersionVector{2: 1}, x.op2)
+		applyServer(t, a, spB)
+		applyServer(t, b, spA)
+		if got, want := canonical(t, encode(t, a)), canonical(t, encode(t, b)); got != want {
+			t.Fatalf("replicas diverged: %s != %s", got, want)
+		}
+		if got := a.m["k"].dtype(); got != x.want {
+			t.Fatalf("got dtype %s, want %s", got, x.want)
+		}
+		// The losing dtype's value is retained, but hidden.
+		if got := len(a.m["k"].Values); got != 2 {
+			t.Fatalf("got %d values, want 2", got)
+		}
+	}
+}
+
+// TestDeleteThenRecreate checks that an entry recreated after a deletion starts
+// from a zero value, of the same or a different dtype.
+func TestDeleteThenRecreate(t *testing.T) {
+	a, b := New(factory{}), New(factory{})
+	sps := []string{
+		applyClient(t, a, 1, common.VersionVector{1: 1}, set(`1`, "k", "a")),
+		applyClient(t, a, 1, common.VersionVector{1: 2}, del("k")),
+		applyClient(t, a, 1, common.VersionVector{1: 3}, set(`2`, "k", "b")),
+	}
+	checkVal(t, a, absent, "k", "a")
+	checkVal(t, a, 2.0, "k", "b")
+	sps = append(sps,
+		applyClient(t, a, 1, common.VersionVector{1: 4}, del("k")),
+		applyClient(t, a, 1, common.VersionVector{1: 5}, set(`3`, "k")))
+	e := a.m["k"]
+	if e.dtype() != cvalue.DTypeCRegister || len(e.Values) != 1 {
+		t.Fatalf("entry not recreated as a register: %s", encode(t, a))
+	}
+	checkVal(t, a, 3.0, "k")
+	applyServer(t, b, sps...)
+	if got, want := canonical(t, encode(t, b)), canonical(t, encode(t, a)); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	m := New(factory{})
+	applyClient(t, m, 1, common.VersionVector{1: 1}, set(`1`, "k", "a"))
+	// A replica that has not seen the deletion below.
+	stale := decode(t, encode(t, m))
+	applyClient(t, m, 2, common.VersionVector{1: 1, 2: 1}, del("k", "a"))
+	d := decode(t, encode(t, m))
+	if got, want := canonical(t, encode(t, d)), canonical(t, encode(t, m)); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	if got := d.m["k"].dtype(); got != cvalue.DTypeCMap {
+		t.Fatalf("got dtype %s, want %s", got, cvalue.DTypeCMap)
+	}
+	checkVal(t, d, absent, "k", "a")
+	// The decoded map keeps tombstones, so an update concurrent with the
+	// deletion does not resurrect the deleted value.
+	applyServer(t, d, applyClient(t, stale, 1, common.VersionVector{1: 2}, set(`5`, "k", "a")))
+	checkVal(t, d, nil, "k", "a")
+	for _, value := range []string{
+		`[]`,
+		`{"k":{"Tags":{"bad":"cregister"},"Values":{}}}`,
+		`{"k":{"Tags":{"1.1":"cregister"},"Values":{"cfoo":"{}"}}}`,
+		`{"k":{"Tags":{"1.1":"cmap"},"Values":{"cmap":"[]"}}}`,
+	} {
+		if _, err := Decode(factory{}, value); err == nil {
+			t.Errorf("%s: expected error", value)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := New(factory{})
+	applyClient(t, base, 1, common.VersionVector{1: 1}, set(`1`, "k", "a"))
+	applyClient(t, base, 1, common.VersionVector{1: 2}, set(`1`, "j"))
+	a, b := decode(t, encode(t, base)), decode(t, encode(t, base))
+	// Concurrently, a deletes k and sets j, and b sets k.b and deletes j.
+	spA := applyClient(t, a, 1, common.VersionVector{1: 3}, del("k"), set(`2`, "j"))
+	spB := applyClient(t, b, 2, common.VersionVector{1: 2, 2: 1}, set(`3`, "k", "b"), del("j"))
+	for _, x := range []struct {
+		m, other      *CMap
+		vec, otherVec common.VersionVector
+		patch         string
+	}{
+		{a, b, common.VersionVector{1: 3}, common.VersionVector{1: 2, 2: 1}, spB},
+		{b, a, common.VersionVector{1: 2, 2: 1}, common.VersionVector{1: 3}, spA},
+	} {
+		want := decode(t, encode(t, x.m))
+		applyServer(t, want, x.patch)
+		got := decode(t, encode(t, x.m))
+		if err := got.Merge(&x.vec, encode(t, x.other), &x.otherVec); err != nil {
+			t.Fatal(err)
+		}
+		if g, w := canonical(t, encode(t, got)), canonical(t, encode(t, want)); g != w {
+			t.Fatalf("got %s, want %s", g, w)
+		}
+		// Both entries survive the concurrent deletions, but their values do
+		// not.
+		checkVal(t, got, absent, "k", "a")
+		checkVal(t, got, absent, "k", "b")
+		checkVal(t, got, nil, "j")
+	}
+	if err := a.Merge(&common.VersionVector{}, `{"k":{"Tags":{"bad":"cregister"}}}`, &common.VersionVector{}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,137 @@
+// Package cmvregister defines CMVRegister, a multi-value CRDT register that
+// keeps all causally concurrent values rather than picking a winner.
+package cmvregister
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+)
+
+// Version is a value written by some agent, along with the version vector at
+// which it was written.
+type Version struct {
+	AgentId uint32
+	Vec     *common.VersionVector
+	Val     interface{}
+}
+
+// seq returns the writer's sequence number for this version.
+func (v *Version) seq() uint32 {
+	return v.Vec.Get(v.AgentId)
+}
+
+// CMVRegister is a CRDT multi-value register. It holds one version per
+// causally concurrent write; a write that dominates all current versions
+// collapses them into a single version.
+// Fields are exported to support CMVRegister.Encode.
+type CMVRegister struct {
+	Versions []*Version // sorted by AgentId, then by seq
+}
+
+// New returns a new CMVRegister.
+func New() *CMVRegister {
+	return &CMVRegister{Versions: []*Version{}}
+}
+
+// DType implements CValue.DType.
+func (r *CMVRegister) DType() string {
+	return cvalue.DTypeCMVRegister
+}
+
+// Encode implements CValue.Encode.
+func (r *CMVRegister) Encode() (string, error) {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Decode decodes the given value into a CMVRegister.
+func Decode(s string) (*CMVRegister, error) {
+	r := New()
+	if err := json.Unmarshal([]byte(s), r); err != nil {
+		return nil, err
+	}
+	if r.Versions == nil {
+		r.Versions = []*Version{}
+	}
+	for _, v := range r.Versions {
+		if v.Vec == nil {
+			v.Vec = &common.VersionVector{}
+		}
+	}
+	return r, nil
+}
+
+func (r *CMVRegister) applyPatch(other *Version) {
+	versions := make([]*Version, 0, len(r.Versions)+1)
+	for _, v := range r.Versions {
+		// Drop the new version if some existing version dominates or equals it.
+		if other.Vec.Leq(v.Vec) {
+			return
+		}
+		if !v.Vec.Leq(other.Vec) {
+			versions = append(versions, v)
+		}
+	}
+	versions = append(versions, other)
+	sort.Slice(versions, func(i, j int) bool {
+		vi, vj := versions[i], versions[j]
+		if vi.AgentId != vj.AgentId {
+			return vi.AgentId < vj.AgentId
+		}
+		return vi.seq() < vj.seq()
+	})
+	r.Versions = versions
+}
+
+// ApplyServerPatch implements CValue.ApplyServerPatch.
+func (r *CMVRegister) ApplyServerPatch(patch string) error {
+	// For server patches, 'patch' is an encoded Version.
+	other := &Version{}
+	if err := json.Unmarshal([]byte(patch), other); err != nil {
+		return err
+	}
+	if other.Vec == nil {
+		other.Vec = &common.VersionVector{}
+	}
+	r.applyPatch(other)
+	return nil
+}
+
+// ApplyClientPatch implements CValue.ApplyClientPatch.
+func (r *CMVRegister) ApplyClientPatch(agentId uint32, vec *common.VersionVector, t time.Time, patch string) (string, error) {
+	// For client patches, 'patch' is an encoded value.
+	var val interface{}
+	if err := json.Unmarshal([]byte(patch), &val); err != nil {
+		return "", err
+	}
+	other := &Version{
+		AgentId: agentId,
+		Vec:     vec.Copy(),
+		Val:     val,
+	}
+	buf, err := json.Marshal(other)
+	if err != nil {
+		return "", err
+	}
+	r.applyPatch(other)
+	return string(buf), nil
+}
+
+// Merge implements CValue.Merge.
+func (r *CMVRegister) Merge(vec *common.VersionVector, other string, otherVec *common.VersionVector) error {
+	o, err := Decode(other)
+	if err != nil {
+		return err
+	}
+	for _, v := range o.Versions {
+		r.applyPatch(v)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package cmvregister
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// write applies a client patch setting r to the given encoded value, as the
+// given agent with the given knowledge, and returns the resulting server patch.
+func write(t *testing.T, r *CMVRegister, agentId uint32, vec common.VersionVector, value string) string {
+	t.Helper()
+	sp, err := r.ApplyClientPatch(agentId, &vec, time.Time{}, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+// checkVals checks r's values, in version order.
+func checkVals(t *testing.T, r *CMVRegister, want ...interface{}) {
+	t.Helper()
+	got := []interface{}{}
+	for _, v := range r.Versions {
+		got = append(got, v.Val)
+	}
+	if want == nil {
+		want = []interface{}{}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func encode(t *testing.T, r *CMVRegister) string {
+	t.Helper()
+	s, err := r.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func decode(t *testing.T, s string) *CMVRegister {
+	t.Helper()
+	r, err := Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	r := New()
+	write(t, r, 2, common.VersionVector{2: 1}, `"b"`)
+	write(t, r, 1, common.VersionVector{1: 1}, `"a"`)
+	// Concurrent versions are all kept, ordered by agent id.
+	checkVals(t, r, "a", "b")
+	// A write that has observed only one of them replaces only that one.
+	write(t, r, 3, common.VersionVector{1: 1, 3: 1}, `"c"`)
+	checkVals(t, r, "b", "c")
+	// A write that has observed all of them collapses them.
+	write(t, r, 2, common.VersionVector{1: 1, 2: 2, 3: 1}, `"d"`)
+	checkVals(t, r, "d")
+	// A write that has been overwritten is dropped.
+	write(t, r, 1, common.VersionVector{1: 1}, `"a"`)
+	checkVals(t, r, "d")
+	if _, err := r.ApplyClientPatch(1, &common.VersionVector{1: 2}, time.Time{}, `{`); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestServerPatches(t *testing.T) {
+	a, b := New(), New()
+	patches := []string{
+		write(t, a, 1, common.VersionVector{1: 1}, `1`),
+		write(t, a, 2, common.VersionVector{2: 1}, `2`),
+		write(t, a, 1, common.VersionVector{1: 2}, `3`),
+	}
+	// Patches converge regardless of the order in which they are applied, and
+	// applying a patch twice is a no-op.
+	for _, i := range []int{2, 1, 0, 1} {
+		if err := b.ApplyServerPatch(patches[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkVals(t, b, 3.0, 2.0)
+	if got, want := encode(t, b), encode(t, a); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	r := New()
+	write(t, r, 1, common.VersionVector{1: 1}, `"a"`)
+	write(t, r, 2, common.VersionVector{2: 1}, `{"x":null}`)
+	d := decode(t, encode(t, r))
+	if !reflect.DeepEqual(d, r) {
+		t.Fatalf("got %+v, want %+v", d, r)
+	}
+	// The decoded register still orders later writes.
+	write(t, d, 1, common.VersionVector{1: 2, 2: 1}, `"c"`)
+	checkVals(t, d, "c")
+	if d = decode(t, `{"Versions":[{"AgentId":1,"Val":1}]}`); d.Versions[0].Vec == nil {
+		t.Fatal("got nil vec")
+	}
+	checkVals(t, decode(t, `{}`))
+	if _, err := Decode(`[]`); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	if err := b.ApplyServerPatch(write(t, a, 1, common.VersionVector{1: 1}, `"x"`)); err != nil {
+		t.Fatal(err)
+	}
+	// a overwrites x; b concurrently writes y without having seen a's write.
+	write(t, a, 1, common.VersionVector{1: 2}, `"a"`)
+	write(t, b, 2, common.VersionVector{2: 1}, `"b"`)
+	for _, c := range []struct {
+		r, other *CMVRegister
+	}{{a, b}, {b, a}} {
+		got := decode(t, encode(t, c.r))
+		if err := got.Merge(&common.VersionVector{}, encode(t, c.other), &common.VersionVector{}); err != nil {
+			t.Fatal(err)
+		}
+		checkVals(t, got, "a", "b")
+	}
+}
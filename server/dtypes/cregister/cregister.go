@@ -21,7 +21,7 @@ type CRegister struct {
 
 // New returns a new CRegister.
 func New() *CRegister {
-	return &CRegister{}
+	return &CRegister{Vec: &common.VersionVector{}}
 }
 
 // DType implements CValue.DType.
@@ -40,7 +40,14 @@ func (r *CRegister) Encode() (string, error) {
 
 // Decode decodes the given value into a CRegister.
 func Decode(s string) (*CRegister, error) {
-	return nil, errors.New("not implemented")
+	r := New()
+	if err := json.Unmarshal([]byte(s), r); err != nil {
+		return nil, err
+	}
+	if r.Vec == nil {
+		r.Vec = &common.VersionVector{}
+	}
+	return r, nil
 }
 
 func (r *CRegister) applyPatch(other *CRegister) {
@@ -56,6 +63,9 @@ func (r *CRegister) ApplyServerPatch(patch string) error {
 	if err := json.Unmarshal([]byte(patch), &other); err != nil {
 		return err
 	}
+	if other.Vec == nil {
+		return errors.New("missing vec")
+	}
 	r.applyPatch(&other)
 	return nil
 }
@@ -80,3 +90,13 @@ func (r *CRegister) ApplyClientPatch(agentId uint32, vec *common.VersionVector,
 	r.applyPatch(other)
 	return res, nil
 }
+
+// Merge implements CValue.Merge.
+func (r *CRegister) Merge(vec *common.VersionVector, other string, otherVec *common.VersionVector) error {
+	o, err := Decode(other)
+	if err != nil {
+		return err
+	}
+	r.applyPatch(o)
+	return nil
+}
@@ -0,0 +1,108 @@
+package cregister
+
+import (
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// write applies a client patch setting r to the given encoded value, as the
+// given agent with the given knowledge and time, and returns the resulting
+// server patch.
+func write(t *testing.T, r *CRegister, agentId uint32, vec common.VersionVector, ts int64, value string) string {
+	t.Helper()
+	sp, err := r.ApplyClientPatch(agentId, &vec, time.Unix(ts, 0), value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+func checkVal(t *testing.T, r *CRegister, want interface{}) {
+	t.Helper()
+	if r.Val != want {
+		t.Fatalf("got %v, want %v", r.Val, want)
+	}
+}
+
+func TestLastWriterWins(t *testing.T) {
+	r := New()
+	write(t, r, 1, common.VersionVector{1: 1}, 10, `"a"`)
+	checkVal(t, r, "a")
+	// A causally later write wins, even if its clock is behind.
+	write(t, r, 1, common.VersionVector{1: 2}, 5, `"b"`)
+	checkVal(t, r, "b")
+	// Among concurrent writes, the later one wins.
+	write(t, r, 3, common.VersionVector{3: 1}, 4, `"c"`)
+	checkVal(t, r, "b")
+	write(t, r, 4, common.VersionVector{4: 1}, 6, `"d"`)
+	checkVal(t, r, "d")
+	// Concurrent writes at the same time are ordered by agent id.
+	write(t, r, 5, common.VersionVector{5: 1}, 6, `"e"`)
+	checkVal(t, r, "e")
+	write(t, r, 2, common.VersionVector{2: 1}, 6, `"f"`)
+	checkVal(t, r, "e")
+}
+
+func TestServerPatches(t *testing.T) {
+	a, b := New(), New()
+	patches := []string{
+		write(t, a, 1, common.VersionVector{1: 1}, 1, `{"x":[1,2]}`),
+		write(t, a, 2, common.VersionVector{2: 1}, 2, `3`),
+	}
+	// Patches converge regardless of the order in which they are applied.
+	for i := len(patches) - 1; i >= 0; i-- {
+		if err := b.ApplyServerPatch(patches[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkVal(t, b, 3.0)
+	if err := b.ApplyServerPatch(`{"AgentId":1,"Val":1}`); err == nil {
+		t.Fatal("expected error for missing vec")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	r := New()
+	write(t, r, 1, common.VersionVector{1: 1}, 1, `"a"`)
+	s, err := r.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVal(t, d, "a")
+	if d.AgentId != 1 || !d.Time.Equal(r.Time) || d.Vec.Get(1) != 1 {
+		t.Fatalf("got %+v, want %+v", d, r)
+	}
+	// The decoded register orders later writes as the original would.
+	write(t, d, 1, common.VersionVector{1: 1}, 0, `"b"`)
+	checkVal(t, d, "a")
+	if d, err = Decode(`{}`); err != nil || d.Vec == nil {
+		t.Fatalf("got %+v, %v; want empty register", d, err)
+	}
+	if _, err := Decode(`[]`); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := New(), New()
+	write(t, a, 1, common.VersionVector{1: 1}, 2, `"a"`)
+	write(t, b, 2, common.VersionVector{2: 1}, 1, `"b"`)
+	for _, c := range []struct {
+		r, other *CRegister
+	}{{a, b}, {b, a}} {
+		s, err := c.other.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.r.Merge(c.r.Vec, s, c.other.Vec); err != nil {
+			t.Fatal(err)
+		}
+		checkVal(t, c.r, "a")
+	}
+}
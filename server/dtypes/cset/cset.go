@@ -0,0 +1,268 @@
+// Package cset defines CSet, an observed-remove (add-wins) CRDT set of JSON
+// scalars.
+//
+// Each add of an element tags it with the add's dot, i.e. its creator's agent
+// id and sequence number, and each remove removes only the tags its creator had
+// observed. An element is in the set iff it has at least one tag, so an add
+// that is concurrent with a remove of the same element wins.
+package cset
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+)
+
+const (
+	opAdd    = "add"
+	opRemove = "remove"
+)
+
+// op is an operation on an element.
+//
+// Client ops have Op and Value. Server ops additionally have Dot (for adds) or
+// Tags (for removes).
+type op struct {
+	Op    string
+	Value interface{}
+	Dot   string   `json:",omitempty"` // tag added by an add
+	Tags  []string `json:",omitempty"` // tags removed by a remove
+}
+
+func decodePatch(s string) ([]*op, error) {
+	ops := []*op{}
+	if err := json.Unmarshal([]byte(s), &ops); err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		if op.Op != opAdd && op.Op != opRemove {
+			return nil, fmt.Errorf("unknown op type: %s", op.Op)
+		}
+		switch op.Value.(type) {
+		case nil, bool, float64, string:
+		default:
+			return nil, fmt.Errorf("not a scalar: %v", op.Value)
+		}
+	}
+	return ops, nil
+}
+
+func encodePatch(ops []*op) (string, error) {
+	buf, err := json.Marshal(ops)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// key returns the key for the given element, i.e. its JSON encoding.
+func key(value interface{}) (string, error) {
+	buf, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// elem is a set element.
+type elem struct {
+	Value interface{}
+	Tags  map[common.Dot]bool
+}
+
+type jsonElem struct {
+	Value interface{}
+	Tags  []string
+}
+
+// CSet is a CRDT set.
+type CSet struct {
+	m map[string]*elem // map of key to element
+}
+
+// New returns a new CSet.
+func New() *CSet {
+	return &CSet{m: map[string]*elem{}}
+}
+
+// DType implements CValue.DType.
+func (s *CSet) DType() string {
+	return cvalue.DTypeCSet
+}
+
+// Encode implements CValue.Encode.
+func (s *CSet) Encode() (string, error) {
+	keys := make([]string, 0, len(s.m))
+	for k := range s.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	x := make([]jsonElem, len(keys))
+	for i, k := range keys {
+		e := s.m[k]
+		x[i] = jsonElem{Value: e.Value, Tags: common.EncodeDots(e.Tags)}
+	}
+	buf, err := json.Marshal(x)
+	if err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Decode decodes the given value into a CSet.
+func Decode(s string) (*CSet, error) {
+	x := []jsonElem{}
+	if err := json.Unmarshal([]byte(s), &x); err != nil {
+		return nil, err
+	}
+	res := New()
+	for _, je := range x {
+		k, err := key(je.Value)
+		if err != nil {
+			return nil, err
+		}
+		e := &elem{Value: je.Value, Tags: map[common.Dot]bool{}}
+		for _, tag := range je.Tags {
+			d, err := common.DecodeDot(tag)
+			if err != nil {
+				return nil, err
+			}
+			e.Tags[d] = true
+		}
+		res.m[k] = e
+	}
+	return res, nil
+}
+
+// add tags the given element with the given dot, adding the element if needed.
+func (s *CSet) add(value interface{}, d common.Dot) error {
+	k, err := key(value)
+	if err != nil {
+		return err
+	}
+	e, ok := s.m[k]
+	if !ok {
+		e = &elem{Value: value, Tags: map[common.Dot]bool{}}
+		s.m[k] = e
+	}
+	e.Tags[d] = true
+	return nil
+}
+
+// remove removes the given tags from the given element, removing the element if
+// it has no tags left.
+func (s *CSet) remove(value interface{}, tags map[common.Dot]bool) error {
+	k, err := key(value)
+	if err != nil {
+		return err
+	}
+	e, ok := s.m[k]
+	if !ok {
+		return nil
+	}
+	for d := range tags {
+		delete(e.Tags, d)
+	}
+	if len(e.Tags) == 0 {
+		delete(s.m, k)
+	}
+	return nil
+}
+
+// ApplyServerPatch implements CValue.ApplyServerPatch.
+func (s *CSet) ApplyServerPatch(patch string) error {
+	ops, err := decodePatch(patch)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		switch op.Op {
+		case opAdd:
+			d, err := common.DecodeDot(op.Dot)
+			if err != nil {
+				return err
+			}
+			if err := s.add(op.Value, d); err != nil {
+				return err
+			}
+		case opRemove:
+			tags := map[common.Dot]bool{}
+			for _, tag := range op.Tags {
+				d, err := common.DecodeDot(tag)
+				if err != nil {
+					return err
+				}
+				tags[d] = true
+			}
+			if err := s.remove(op.Value, tags); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyClientPatch implements CValue.ApplyClientPatch.
+func (s *CSet) ApplyClientPatch(agentId uint32, vec *common.VersionVector, t time.Time, patch string) (string, error) {
+	d := common.Dot{AgentId: agentId, AgentSeq: vec.Get(agentId)}
+	// Sanity check.
+	if d.AgentSeq == 0 {
+		return "", fmt.Errorf("unknown agent: %d", agentId)
+	}
+	ops, err := decodePatch(patch)
+	if err != nil {
+		return "", err
+	}
+	appliedOps := make([]*op, 0, len(ops))
+	for _, v := range ops {
+		switch v.Op {
+		case opAdd:
+			if err := s.add(v.Value, d); err != nil {
+				return "", err
+			}
+			appliedOps = append(appliedOps, &op{Op: opAdd, Value: v.Value, Dot: d.Encode()})
+		case opRemove:
+			k, err := key(v.Value)
+			if err != nil {
+				return "", err
+			}
+			e, ok := s.m[k]
+			if !ok {
+				continue
+			}
+			tags := common.EncodeDots(e.Tags)
+			if err := s.remove(v.Value, e.Tags); err != nil {
+				return "", err
+			}
+			appliedOps = append(appliedOps, &op{Op: opRemove, Value: v.Value, Tags: tags})
+		}
+	}
+	return encodePatch(appliedOps)
+}
+
+// Merge implements CValue.Merge.
+func (s *CSet) Merge(vec *common.VersionVector, other string, otherVec *common.VersionVector) error {
+	o, err := Decode(other)
+	if err != nil {
+		return err
+	}
+	for k, oe := range o.m {
+		if _, ok := s.m[k]; !ok {
+			s.m[k] = &elem{Value: oe.Value, Tags: map[common.Dot]bool{}}
+		}
+	}
+	for k, e := range s.m {
+		oe, ok := o.m[k]
+		if !ok {
+			oe = &elem{Tags: map[common.Dot]bool{}}
+		}
+		if e.Tags = common.MergeDots(e.Tags, vec, oe.Tags, otherVec); len(e.Tags) == 0 {
+			delete(s.m, k)
+		}
+	}
+	return nil
+}
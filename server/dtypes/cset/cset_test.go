@@ -0,0 +1,149 @@
+package cset
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// replica is a CSet along with the patches it reflects.
+type replica struct {
+	s   *CSet
+	vec *common.VersionVector
+}
+
+func newReplica() *replica {
+	return &replica{New(), &common.VersionVector{}}
+}
+
+// apply applies the given client patch as the given agent, and returns the
+// resulting server patch.
+func (r *replica) apply(t *testing.T, agentId uint32, patch string) string {
+	t.Helper()
+	r.vec.Put(agentId, r.vec.Get(agentId)+1)
+	sp, err := r.s.ApplyClientPatch(agentId, r.vec.Copy(), time.Time{}, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
+
+// applyServer applies the given server patch, created by the given agent.
+func (r *replica) applyServer(t *testing.T, agentId uint32, sp string) {
+	t.Helper()
+	if err := r.s.ApplyServerPatch(sp); err != nil {
+		t.Fatal(err)
+	}
+	r.vec.Put(agentId, r.vec.Get(agentId)+1)
+}
+
+// keys returns the keys of the elements in s, sorted.
+func keys(s *CSet) []string {
+	res := []string{}
+	for k := range s.m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func checkKeys(t *testing.T, s *CSet, want ...string) {
+	t.Helper()
+	if want == nil {
+		want = []string{}
+	}
+	if got := keys(s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestAddRemove(t *testing.T) {
+	r := newReplica()
+	r.apply(t, 1, `[{"Op":"add","Value":1},{"Op":"add","Value":"1"},{"Op":"add","Value":null}]`)
+	checkKeys(t, r.s, `"1"`, `1`, `null`)
+	r.apply(t, 1, `[{"Op":"remove","Value":1},{"Op":"remove","Value":true}]`)
+	checkKeys(t, r.s, `"1"`, `null`)
+	for _, patch := range []string{
+		`[{"Op":"add","Value":[1]}]`,
+		`[{"Op":"add","Value":{}}]`,
+		`[{"Op":"clear"}]`,
+	} {
+		if _, err := r.s.ApplyClientPatch(1, r.vec, time.Time{}, patch); err == nil {
+			t.Fatalf("%s: expected error", patch)
+		}
+	}
+}
+
+func TestAddWins(t *testing.T) {
+	a, b := newReplica(), newReplica()
+	b.applyServer(t, 1, a.apply(t, 1, `[{"Op":"add","Value":"x"}]`))
+	// a removes x while b concurrently re-adds it.
+	ra := a.apply(t, 1, `[{"Op":"remove","Value":"x"}]`)
+	rb := b.apply(t, 2, `[{"Op":"add","Value":"x"}]`)
+	a.applyServer(t, 2, rb)
+	b.applyServer(t, 1, ra)
+	checkKeys(t, a.s, `"x"`)
+	checkKeys(t, b.s, `"x"`)
+	// A remove that has observed both adds removes x.
+	a.applyServer(t, 2, b.apply(t, 2, `[{"Op":"remove","Value":"x"}]`))
+	checkKeys(t, a.s)
+	checkKeys(t, b.s)
+}
+
+func TestDecode(t *testing.T) {
+	r := newReplica()
+	r.apply(t, 1, `[{"Op":"add","Value":"a"},{"Op":"add","Value":2.5}]`)
+	r.apply(t, 2, `[{"Op":"add","Value":"a"}]`)
+	s, err := r.s.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(d.m, r.s.m) {
+		t.Fatalf("got %v, want %v", d.m, r.s.m)
+	}
+	for _, s := range []string{`{}`, `[{"Value":1,"Tags":["bad"]}]`} {
+		if _, err := Decode(s); err == nil {
+			t.Fatalf("%s: expected error", s)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	a, b := newReplica(), newReplica()
+	b.applyServer(t, 1, a.apply(t, 1, `[{"Op":"add","Value":"x"},{"Op":"add","Value":"y"}]`))
+	// a removes x and adds z; b removes y and re-adds x.
+	a.apply(t, 1, `[{"Op":"remove","Value":"x"},{"Op":"add","Value":"z"}]`)
+	b.apply(t, 2, `[{"Op":"remove","Value":"y"},{"Op":"add","Value":"x"}]`)
+	for _, c := range []struct {
+		r, other *replica
+	}{{a, b}, {b, a}} {
+		s, err := c.other.s.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decode(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := got.Merge(c.other.vec, mustEncode(t, c.r.s), c.r.vec); err != nil {
+			t.Fatal(err)
+		}
+		checkKeys(t, got, `"x"`, `"z"`)
+	}
+}
+
+func mustEncode(t *testing.T, s *CSet) string {
+	t.Helper()
+	res, err := s.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
@@ -7,106 +7,15 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"math"
-	"math/rand"
 	"sort"
 	"strings"
 	"time"
 
 	"github.com/asadovsky/cdb/server/common"
 	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+	"github.com/asadovsky/cdb/server/dtypes/logoot"
 )
 
-func assert(b bool, v ...interface{}) {
-	if !b {
-		panic(fmt.Sprint(v...))
-	}
-}
-
-// id is a Logoot identifier.
-type id struct {
-	Pos     uint32
-	AgentId uint32
-}
-
-// pid is a Logoot position identifier.
-type pid struct {
-	Ids []id
-	Seq uint32 // logical clock value for the last id's agent
-}
-
-// Less returns true iff p is less than other.
-func (p *pid) Less(other *pid) bool {
-	for i, v := range p.Ids {
-		if i == len(other.Ids) {
-			return false
-		}
-		vo := other.Ids[i]
-		if v.Pos != vo.Pos {
-			return v.Pos < vo.Pos
-		} else if v.AgentId != vo.AgentId {
-			return v.AgentId < vo.AgentId
-		}
-	}
-	if len(p.Ids) == len(other.Ids) {
-		return p.Seq < other.Seq
-	}
-	return true
-}
-
-// Equal returns true iff p is equal to other.
-func (p *pid) Equal(other *pid) bool {
-	if len(p.Ids) != len(other.Ids) || p.Seq != other.Seq {
-		return false
-	}
-	for i, v := range p.Ids {
-		vo := other.Ids[i]
-		if v.Pos != vo.Pos || v.AgentId != vo.AgentId {
-			return false
-		}
-	}
-	return true
-}
-
-// Encode encodes this pid.
-func (p *pid) Encode() string {
-	idStrs := make([]string, len(p.Ids))
-	for i, v := range p.Ids {
-		idStrs[i] = fmt.Sprintf("%d.%d", v.Pos, v.AgentId)
-	}
-	return strings.Join(idStrs, ":") + "~" + common.Itoa(p.Seq)
-}
-
-// decodePid decodes the given string into a pid.
-func decodePid(s string) (*pid, error) {
-	idsAndSeq := strings.Split(s, "~")
-	if len(idsAndSeq) != 2 {
-		return nil, fmt.Errorf("invalid pid: %s", s)
-	}
-	seq, err := common.Atoi(idsAndSeq[1])
-	if err != nil {
-		return nil, fmt.Errorf("invalid seq: %s", s)
-	}
-	idStrs := strings.Split(idsAndSeq[0], ":")
-	ids := make([]id, len(idStrs))
-	for i, v := range idStrs {
-		parts := strings.Split(v, ".")
-		if len(parts) != 2 {
-			return nil, fmt.Errorf("invalid id: %s", v)
-		}
-		pos, err := common.Atoi(parts[0])
-		if err != nil {
-			return nil, fmt.Errorf("invalid pos: %s", v)
-		}
-		agentId, err := common.Atoi(parts[1])
-		if err != nil {
-			return nil, fmt.Errorf("invalid agentId: %s", v)
-		}
-		ids[i] = id{Pos: uint32(pos), AgentId: agentId}
-	}
-	return &pid{Ids: ids, Seq: seq}, nil
-}
-
 // op is an operation.
 type op interface {
 	// Encode encodes this op.
@@ -115,9 +24,9 @@ type op interface {
 
 // clientInsert represents an atom insertion from a client.
 type clientInsert struct {
-	PrevPid *pid   // nil means start of document
-	NextPid *pid   // nil means end of document
-	Value   string // may contain multiple characters
+	PrevPid *logoot.Pid // nil means start of document
+	NextPid *logoot.Pid // nil means end of document
+	Value   string      // may contain multiple characters
 }
 
 // Encode encodes this op.
@@ -134,7 +43,7 @@ func (op *clientInsert) Encode() string {
 
 // insert represents an atom insertion.
 type insert struct {
-	Pid   *pid
+	Pid   *logoot.Pid
 	Value string
 }
 
@@ -149,7 +58,7 @@ func (op *insert) Encode() string {
 // TODO: To reduce client->server message size, maybe add a clientDelete
 // operation defined as a [start, end] range.
 type delete struct {
-	Pid *pid
+	Pid *logoot.Pid
 }
 
 // Encode encodes this op.
@@ -171,15 +80,15 @@ func decodeOp(s string) (op, error) {
 		if len(parts) < 4 {
 			return nil, newParseError(s)
 		}
-		var prevPid, nextPid *pid
+		var prevPid, nextPid *logoot.Pid
 		var err error
 		if parts[1] != "" {
-			if prevPid, err = decodePid(parts[1]); err != nil {
+			if prevPid, err = logoot.DecodePid(parts[1]); err != nil {
 				return nil, newParseError(s)
 			}
 		}
 		if parts[2] != "" {
-			if nextPid, err = decodePid(parts[2]); err != nil {
+			if nextPid, err = logoot.DecodePid(parts[2]); err != nil {
 				return nil, newParseError(s)
 			}
 		}
@@ -192,8 +101,9 @@ func decodeOp(s string) (op, error) {
 		if len(parts) < 3 {
 			return nil, newParseError(s)
 		}
-		pid, err := decodePid(parts[1])
-		if err != nil {
+		pid, err := logoot.DecodePid(parts[1])
+		// Each atom holds a single character.
+		if err != nil || len(parts[2]) != 1 {
 			return nil, newParseError(s)
 		}
 		return &insert{pid, parts[2]}, nil
@@ -202,7 +112,7 @@ func decodeOp(s string) (op, error) {
 		if len(parts) < 2 {
 			return nil, newParseError(s)
 		}
-		pid, err := decodePid(parts[1])
+		pid, err := logoot.DecodePid(parts[1])
 		if err != nil {
 			return nil, newParseError(s)
 		}
@@ -242,12 +152,15 @@ func decodePatch(s string) ([]op, error) {
 
 // atom is an atom in a Logoot document.
 type atom struct {
-	Pid *pid
+	Pid *logoot.Pid
 	// TODO: Switch to rune?
 	Value string
 }
 
-var _ json.Marshaler = (*atom)(nil)
+var (
+	_ json.Marshaler   = (*atom)(nil)
+	_ json.Unmarshaler = (*atom)(nil)
+)
 
 // MarshalJSON marshals to JSON.
 func (a *atom) MarshalJSON() ([]byte, error) {
@@ -260,6 +173,23 @@ func (a *atom) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// UnmarshalJSON unmarshals from JSON.
+func (a *atom) UnmarshalJSON(data []byte) error {
+	var x struct {
+		Pid   string
+		Value string
+	}
+	if err := json.Unmarshal(data, &x); err != nil {
+		return err
+	}
+	pid, err := logoot.DecodePid(x.Pid)
+	if err != nil {
+		return err
+	}
+	*a = atom{Pid: pid, Value: x.Value}
+	return nil
+}
+
 // CString is a CRDT string (Logoot).
 type CString struct {
 	atoms []atom
@@ -287,7 +217,22 @@ func (s *CString) Encode() (string, error) {
 
 // Decode decodes the given value into a CString.
 func Decode(s string) (*CString, error) {
-	return nil, errors.New("not implemented")
+	atoms := []atom{}
+	if err := json.Unmarshal([]byte(s), &atoms); err != nil {
+		return nil, err
+	}
+	values := make([]string, len(atoms))
+	for i, a := range atoms {
+		if i > 0 && !atoms[i-1].Pid.Less(a.Pid) {
+			return nil, fmt.Errorf("atoms out of order: %s", a.Pid.Encode())
+		}
+		// Each atom holds a single character.
+		if len(a.Value) != 1 {
+			return nil, fmt.Errorf("invalid atom value: %q", a.Value)
+		}
+		values[i] = a.Value
+	}
+	return &CString{atoms: atoms, text: strings.Join(values, "")}, nil
 }
 
 // ApplyServerPatch implements CValue.ApplyServerPatch.
@@ -299,7 +244,9 @@ func (s *CString) ApplyServerPatch(patch string) error {
 	for _, op := range ops {
 		switch v := op.(type) {
 		case *insert:
-			s.applyInsertText(v)
+			if err := s.applyInsertText(v); err != nil {
+				return err
+			}
 		case *delete:
 			s.applyDeleteText(v)
 		default:
@@ -332,13 +279,17 @@ func (s *CString) ApplyClientPatch(agentId uint32, vec *common.VersionVector, _
 			// TODO: Smarter pid allocation.
 			prevPid := v.PrevPid
 			for j := 0; j < len(v.Value); j++ {
-				x := &insert{genPid(agentId, agentSeq, prevPid, v.NextPid), string(v.Value[j])}
-				s.applyInsertText(x)
+				x := &insert{logoot.GenPid(agentId, agentSeq, prevPid, v.NextPid), string(v.Value[j])}
+				if err := s.applyInsertText(x); err != nil {
+					return "", err
+				}
 				appliedOps = append(appliedOps, x)
 				prevPid = x.Pid
 			}
 		case *insert:
-			s.applyInsertText(v)
+			if err := s.applyInsertText(v); err != nil {
+				return "", err
+			}
 			appliedOps = append(appliedOps, op)
 		case *delete:
 			s.applyDeleteText(v)
@@ -350,43 +301,16 @@ func (s *CString) ApplyClientPatch(agentId uint32, vec *common.VersionVector, _
 	return encodePatch(appliedOps)
 }
 
-func randUint32Between(prev, next uint32) uint32 {
-	return prev + 1 + uint32(rand.Int63n(int64(next-prev-1)))
-}
-
-// TODO: Smarter pid allocation, e.g. LSEQ. Also, maybe do something to ensure
-// that concurrent multi-atom insertions from different agents do not get
-// interleaved.
-func genIds(agentId uint32, prev, next []id) []id {
-	if len(prev) == 0 {
-		prev = []id{{Pos: 0, AgentId: agentId}}
-	}
-	if len(next) == 0 {
-		next = []id{{Pos: math.MaxUint32, AgentId: agentId}}
-	}
-	if prev[0].Pos+1 < next[0].Pos {
-		return []id{{Pos: randUint32Between(prev[0].Pos, next[0].Pos), AgentId: agentId}}
-	}
-	return append([]id{prev[0]}, genIds(agentId, prev[1:], next[1:])...)
-}
-
-func genPid(agentId, agentSeq uint32, prev, next *pid) *pid {
-	prevIds, nextIds := []id{}, []id{}
-	if prev != nil {
-		prevIds = prev.Ids
-	}
-	if next != nil {
-		nextIds = next.Ids
-	}
-	return &pid{Ids: genIds(agentId, prevIds, nextIds), Seq: agentSeq}
-}
-
-func (s *CString) applyInsertText(op *insert) {
+// applyInsertText applies the given insertion. Insertions of existing atoms are
+// ignored. Returns an error if a different atom exists at the same position.
+func (s *CString) applyInsertText(op *insert) error {
 	a := s.atoms
 	p := s.search(op.Pid)
 	if p != len(a) && a[p].Pid.Equal(op.Pid) {
-		assert(a[p].Value == op.Value)
-		return
+		if a[p].Value != op.Value {
+			return fmt.Errorf("conflicting insert at pid %s", op.Pid.Encode())
+		}
+		return nil
 	}
 	// https://github.com/golang/go/wiki/SliceTricks
 	a = append(a, atom{})
@@ -394,6 +318,7 @@ func (s *CString) applyInsertText(op *insert) {
 	a[p] = atom{Pid: op.Pid, Value: op.Value}
 	s.atoms = a
 	s.text = s.text[:p] + op.Value + s.text[p:]
+	return nil
 }
 
 func (s *CString) applyDeleteText(op *delete) {
@@ -409,6 +334,45 @@ func (s *CString) applyDeleteText(op *delete) {
 }
 
 // search returns the position of the first atom with pid >= the given pid.
-func (s *CString) search(pid *pid) int {
-	return sort.Search(len(s.atoms), func(i int) bool { return !s.atoms[i].Pid.Less(pid) })
+func (s *CString) search(p *logoot.Pid) int {
+	return sort.Search(len(s.atoms), func(i int) bool { return !s.atoms[i].Pid.Less(p) })
+}
+
+// Merge implements CValue.Merge.
+func (s *CString) Merge(vec *common.VersionVector, other string, otherVec *common.VersionVector) error {
+	o, err := Decode(other)
+	if err != nil {
+		return err
+	}
+	// Atoms present in only one document were either inserted there, or deleted
+	// from the other document. Keep only the former.
+	ops := []op{}
+	atoms, oatoms := s.atoms, o.atoms
+	for len(atoms) > 0 || len(oatoms) > 0 {
+		switch {
+		case len(oatoms) == 0 || len(atoms) > 0 && atoms[0].Pid.Less(oatoms[0].Pid):
+			if otherVec.Contains(atoms[0].Pid.Dot()) {
+				ops = append(ops, &delete{atoms[0].Pid})
+			}
+			atoms = atoms[1:]
+		case len(atoms) == 0 || oatoms[0].Pid.Less(atoms[0].Pid):
+			if !vec.Contains(oatoms[0].Pid.Dot()) {
+				ops = append(ops, &insert{oatoms[0].Pid, oatoms[0].Value})
+			}
+			oatoms = oatoms[1:]
+		default:
+			atoms, oatoms = atoms[1:], oatoms[1:]
+		}
+	}
+	for _, op := range ops {
+		switch v := op.(type) {
+		case *insert:
+			if err := s.applyInsertText(v); err != nil {
+				return err
+			}
+		case *delete:
+			s.applyDeleteText(v)
+		}
+	}
+	return nil
 }
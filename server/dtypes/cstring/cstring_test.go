@@ -0,0 +1,202 @@
+package cstring
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// replica is a CString along with the patches it reflects.
+type replica struct {
+	s   *CString
+	vec *common.VersionVector
+}
+
+func newReplica() *replica {
+	return &replica{New(), &common.VersionVector{}}
+}
+
+// apply applies the given client ops as a new patch from the given agent, and
+// returns the resulting server patch.
+func (r *replica) apply(t *testing.T, agentId uint32, ops ...string) string {
+	t.Helper()
+	r.vec.Put(agentId, r.vec.Get(agentId)+1)
+	patch, err := encodeStrings(ops)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp, err := r.s.ApplyClientPatch(agentId, r.vec.Copy(), time.Time{}, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkText(t, r.s)
+	return sp
+}
+
+// insertAt returns a client op that inserts value at position p.
+func (r *replica) insertAt(p int, value string) string {
+	var prev, next string
+	if p > 0 {
+		prev = r.s.atoms[p-1].Pid.Encode()
+	}
+	if p < len(r.s.atoms) {
+		next = r.s.atoms[p].Pid.Encode()
+	}
+	return fmt.Sprintf("ci,%s,%s,%s", prev, next, value)
+}
+
+// deleteAt returns a client op that deletes the character at position p.
+func (r *replica) deleteAt(p int) string {
+	return "d," + r.s.atoms[p].Pid.Encode()
+}
+
+func encodeStrings(strs []string) (string, error) {
+	ops := make([]op, len(strs))
+	for i, s := range strs {
+		var err error
+		if ops[i], err = decodeOp(s); err != nil {
+			return "", err
+		}
+	}
+	return encodePatch(ops)
+}
+
+// checkText checks that s's text matches its atoms.
+func checkText(t *testing.T, s *CString) {
+	t.Helper()
+	values := make([]string, len(s.atoms))
+	for i, a := range s.atoms {
+		values[i] = a.Value
+	}
+	if want := strings.Join(values, ""); s.text != want {
+		t.Fatalf("text %q does not match atoms %q", s.text, want)
+	}
+}
+
+func encode(t *testing.T, s *CString) string {
+	t.Helper()
+	res, err := s.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func decode(t *testing.T, value string) *CString {
+	t.Helper()
+	s, err := Decode(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkText(t, s)
+	return s
+}
+
+func TestInsertDelete(t *testing.T) {
+	r := newReplica()
+	r.apply(t, 1, r.insertAt(0, "held"))
+	r.apply(t, 1, r.insertAt(3, "lo wor"))
+	r.apply(t, 1, r.deleteAt(2), r.deleteAt(9))
+	if got, want := r.s.text, "helo wor"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	// Deleting a deleted atom is a no-op.
+	if _, err := r.s.ApplyClientPatch(1, r.vec, time.Time{}, `["d,`+r.s.atoms[0].Pid.Encode()+`"]`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerPatches(t *testing.T) {
+	a, b := newReplica(), newReplica()
+	for _, ops := range []func() []string{
+		func() []string { return []string{a.insertAt(0, "abc")} },
+		func() []string { return []string{a.deleteAt(1)} },
+		func() []string { return []string{a.insertAt(1, "x")} },
+	} {
+		sp := a.apply(t, 1, ops()...)
+		if err := b.s.ApplyServerPatch(sp); err != nil {
+			t.Fatal(err)
+		}
+		// Server patches are idempotent.
+		if err := b.s.ApplyServerPatch(sp); err != nil {
+			t.Fatal(err)
+		}
+		checkText(t, b.s)
+		if b.s.text != a.s.text {
+			t.Fatalf("got %q, want %q", b.s.text, a.s.text)
+		}
+	}
+	// An insert of a different character at an existing position is rejected.
+	bad := fmt.Sprintf(`["i,%s,z"]`, b.s.atoms[0].Pid.Encode())
+	if err := b.s.ApplyServerPatch(bad); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	r := newReplica()
+	r.apply(t, 1, r.insertAt(0, "hello"))
+	r.apply(t, 2, r.deleteAt(0), r.insertAt(5, "!"))
+	s := decode(t, encode(t, r.s))
+	if s.text != "ello!" {
+		t.Fatalf("got %q, want %q", s.text, "ello!")
+	}
+	if got, want := encode(t, s), encode(t, r.s); got != want {
+		t.Fatalf("got %s, want %s", got, want)
+	}
+	// The decoded value remains usable.
+	if err := s.ApplyServerPatch(`["d,` + s.atoms[4].Pid.Encode() + `"]`); err != nil {
+		t.Fatal(err)
+	}
+	checkText(t, s)
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	for _, value := range []string{
+		`{}`,
+		`[{"Pid":"bad","Value":"a"}]`,
+		`[{"Pid":"5.1~1","Value":""}]`,
+		`[{"Pid":"5.1~1","Value":"ab"}]`,
+		`[{"Pid":"6.1~1","Value":"a"},{"Pid":"5.1~1","Value":"b"}]`,
+		`[{"Pid":"5.1~1","Value":"a"},{"Pid":"5.1~1","Value":"a"}]`,
+	} {
+		if _, err := Decode(value); err == nil {
+			t.Errorf("%s: expected error", value)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	base := newReplica()
+	base.apply(t, 1, base.insertAt(0, "abcd"))
+	a := &replica{decode(t, encode(t, base.s)), base.vec.Copy()}
+	b := &replica{decode(t, encode(t, base.s)), base.vec.Copy()}
+	// Concurrently, a deletes "b" and appends "e", and b deletes "c" and inserts
+	// "x" at the start.
+	pa := a.apply(t, 1, a.deleteAt(1), a.insertAt(4, "e"))
+	pb := b.apply(t, 2, b.deleteAt(2), b.insertAt(0, "x"))
+	for _, c := range []struct {
+		r, other *replica
+		patch    string
+	}{{a, b, pb}, {b, a, pa}} {
+		want := decode(t, encode(t, c.r.s))
+		if err := want.ApplyServerPatch(c.patch); err != nil {
+			t.Fatal(err)
+		}
+		got := decode(t, encode(t, c.r.s))
+		if err := got.Merge(c.r.vec, encode(t, c.other.s), c.other.vec); err != nil {
+			t.Fatal(err)
+		}
+		checkText(t, got)
+		if got.text != "xade" || encode(t, got) != encode(t, want) {
+			t.Fatalf("got %q, want %q", got.text, want.text)
+		}
+	}
+	// Values that fail to decode are rejected.
+	if err := a.s.Merge(a.vec, `[{"Pid":"5.1~1","Value":""}]`, b.vec); err == nil {
+		t.Fatal("expected error")
+	}
+}
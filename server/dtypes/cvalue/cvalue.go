@@ -8,9 +8,14 @@ import (
 )
 
 const (
-	DTypeCRegister = "cregister"
-	DTypeCString   = "cstring"
-	DTypeDelete    = "delete"
+	DTypeCCounter    = "ccounter"
+	DTypeCList       = "clist"
+	DTypeCMap        = "cmap"
+	DTypeCMVRegister = "cmvregister"
+	DTypeCRegister   = "cregister"
+	DTypeCSet        = "cset"
+	DTypeCString     = "cstring"
+	DTypeDelete      = "delete"
 )
 
 // TODO: Switch to using []byte for encoded values, here and elsewhere.
@@ -31,4 +36,20 @@ type CValue interface {
 	// patch may include client-only operations; the returned patch will never
 	// contain such operations.
 	ApplyClientPatch(agentId uint32, vec *common.VersionVector, t time.Time, patch string) (string, error)
+
+	// Merge merges the given encoded value, of the same dtype, into this value.
+	// vec and otherVec represent the patches reflected in this value and the
+	// given value, respectively; dtypes whose state does not record removals use
+	// them to tell removed elements from ones not yet seen.
+	Merge(vec *common.VersionVector, other string, otherVec *common.VersionVector) error
+}
+
+// Factory creates and decodes CValues of any dtype. Composable dtypes use it to
+// create nested values.
+type Factory interface {
+	// NewZeroValue returns a new zero value of the given dtype.
+	NewZeroValue(dtype string) (CValue, error)
+
+	// DecodeValue decodes the given value.
+	DecodeValue(dtype, value string) (CValue, error)
 }
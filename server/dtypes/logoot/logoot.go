@@ -0,0 +1,135 @@
+// Package logoot defines Logoot position identifiers, shared by the
+// sequence CRDTs.
+// https://hal.inria.fr/inria-00432368/document
+package logoot
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strings"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// Id is a Logoot identifier.
+type Id struct {
+	Pos     uint32
+	AgentId uint32
+}
+
+// Pid is a Logoot position identifier.
+type Pid struct {
+	Ids []Id
+	Seq uint32 // logical clock value for the last id's agent
+}
+
+// Less returns true iff p is less than other.
+func (p *Pid) Less(other *Pid) bool {
+	for i, v := range p.Ids {
+		if i == len(other.Ids) {
+			return false
+		}
+		vo := other.Ids[i]
+		if v.Pos != vo.Pos {
+			return v.Pos < vo.Pos
+		} else if v.AgentId != vo.AgentId {
+			return v.AgentId < vo.AgentId
+		}
+	}
+	if len(p.Ids) == len(other.Ids) {
+		return p.Seq < other.Seq
+	}
+	return true
+}
+
+// Equal returns true iff p is equal to other.
+func (p *Pid) Equal(other *Pid) bool {
+	if len(p.Ids) != len(other.Ids) || p.Seq != other.Seq {
+		return false
+	}
+	for i, v := range p.Ids {
+		vo := other.Ids[i]
+		if v.Pos != vo.Pos || v.AgentId != vo.AgentId {
+			return false
+		}
+	}
+	return true
+}
+
+// Dot returns the dot of the patch that generated p.
+func (p *Pid) Dot() common.Dot {
+	return common.Dot{AgentId: p.Ids[len(p.Ids)-1].AgentId, AgentSeq: p.Seq}
+}
+
+// Encode encodes this Pid.
+func (p *Pid) Encode() string {
+	idStrs := make([]string, len(p.Ids))
+	for i, v := range p.Ids {
+		idStrs[i] = fmt.Sprintf("%d.%d", v.Pos, v.AgentId)
+	}
+	return strings.Join(idStrs, ":") + "~" + common.Itoa(p.Seq)
+}
+
+// DecodePid decodes the given string into a Pid.
+func DecodePid(s string) (*Pid, error) {
+	idsAndSeq := strings.Split(s, "~")
+	if len(idsAndSeq) != 2 {
+		return nil, fmt.Errorf("invalid pid: %s", s)
+	}
+	seq, err := common.Atoi(idsAndSeq[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid seq: %s", s)
+	}
+	idStrs := strings.Split(idsAndSeq[0], ":")
+	ids := make([]Id, len(idStrs))
+	for i, v := range idStrs {
+		parts := strings.Split(v, ".")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid id: %s", v)
+		}
+		pos, err := common.Atoi(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pos: %s", v)
+		}
+		agentId, err := common.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid agentId: %s", v)
+		}
+		ids[i] = Id{Pos: uint32(pos), AgentId: agentId}
+	}
+	return &Pid{Ids: ids, Seq: seq}, nil
+}
+
+func randUint32Between(prev, next uint32) uint32 {
+	return prev + 1 + uint32(rand.Int63n(int64(next-prev-1)))
+}
+
+// TODO: Smarter pid allocation, e.g. LSEQ. Also, maybe do something to ensure
+// that concurrent multi-atom insertions from different agents do not get
+// interleaved.
+func genIds(agentId uint32, prev, next []Id) []Id {
+	if len(prev) == 0 {
+		prev = []Id{{Pos: 0, AgentId: agentId}}
+	}
+	if len(next) == 0 {
+		next = []Id{{Pos: math.MaxUint32, AgentId: agentId}}
+	}
+	if prev[0].Pos+1 < next[0].Pos {
+		return []Id{{Pos: randUint32Between(prev[0].Pos, next[0].Pos), AgentId: agentId}}
+	}
+	return append([]Id{prev[0]}, genIds(agentId, prev[1:], next[1:])...)
+}
+
+// GenPid returns a new Pid for the given agent, between prev and next. A nil
+// prev means start of document; a nil next means end of document.
+func GenPid(agentId, agentSeq uint32, prev, next *Pid) *Pid {
+	prevIds, nextIds := []Id{}, []Id{}
+	if prev != nil {
+		prevIds = prev.Ids
+	}
+	if next != nil {
+		nextIds = next.Ids
+	}
+	return &Pid{Ids: genIds(agentId, prevIds, nextIds), Seq: agentSeq}
+}
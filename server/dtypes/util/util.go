@@ -4,7 +4,12 @@ package util
 import (
 	"fmt"
 
+	"github.com/asadovsky/cdb/server/dtypes/ccounter"
+	"github.com/asadovsky/cdb/server/dtypes/clist"
+	"github.com/asadovsky/cdb/server/dtypes/cmap"
+	"github.com/asadovsky/cdb/server/dtypes/cmvregister"
 	"github.com/asadovsky/cdb/server/dtypes/cregister"
+	"github.com/asadovsky/cdb/server/dtypes/cset"
 	"github.com/asadovsky/cdb/server/dtypes/cstring"
 	"github.com/asadovsky/cdb/server/dtypes/cvalue"
 )
@@ -12,8 +17,18 @@ import (
 // DecodeValue decodes the given value.
 func DecodeValue(dtype, value string) (cvalue.CValue, error) {
 	switch dtype {
+	case cvalue.DTypeCCounter:
+		return ccounter.Decode(value)
+	case cvalue.DTypeCList:
+		return clist.Decode(value)
+	case cvalue.DTypeCMap:
+		return cmap.Decode(factory{}, value)
+	case cvalue.DTypeCMVRegister:
+		return cmvregister.Decode(value)
 	case cvalue.DTypeCRegister:
 		return cregister.Decode(value)
+	case cvalue.DTypeCSet:
+		return cset.Decode(value)
 	case cvalue.DTypeCString:
 		return cstring.Decode(value)
 	default:
@@ -24,11 +39,32 @@ func DecodeValue(dtype, value string) (cvalue.CValue, error) {
 // NewZeroValue returns a new zero value of the given dtype.
 func NewZeroValue(dtype string) (cvalue.CValue, error) {
 	switch dtype {
+	case cvalue.DTypeCCounter:
+		return ccounter.New(), nil
+	case cvalue.DTypeCList:
+		return clist.New(), nil
+	case cvalue.DTypeCMap:
+		return cmap.New(factory{}), nil
+	case cvalue.DTypeCMVRegister:
+		return cmvregister.New(), nil
 	case cvalue.DTypeCRegister:
 		return cregister.New(), nil
+	case cvalue.DTypeCSet:
+		return cset.New(), nil
 	case cvalue.DTypeCString:
 		return cstring.New(), nil
 	default:
 		return nil, fmt.Errorf("unknown dtype: %s", dtype)
 	}
 }
+
+// factory implements cvalue.Factory.
+type factory struct{}
+
+func (factory) NewZeroValue(dtype string) (cvalue.CValue, error) {
+	return NewZeroValue(dtype)
+}
+
+func (factory) DecodeValue(dtype, value string) (cvalue.CValue, error) {
+	return DecodeValue(dtype, value)
+}
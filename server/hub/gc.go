@@ -0,0 +1,82 @@
+package hub
+
+import (
+	"log"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// How often to garbage collect the log.
+const logGCPeriod = time.Minute
+
+// Log garbage collection: A patch is causally stable once every member has
+// applied it. No member will ever request a causally stable patch, so we can
+// drop such patches from the log. Members report the patches they have applied
+// in SubscribeI2R and AckI2R messages, and gossip these reports (along with
+// their own version vectors) in PeersR2I messages. The intersection of the
+// version vectors of all live members (including this hub) is the stable
+// frontier. Since each member's version vector is causally closed, so is the
+// frontier.
+//
+// Peers, whether configured or learned via gossip, hold back the frontier until
+// they have reported their own version vectors, even if they have never been
+// reachable; only once a peer has been seen and then gone unseen for
+// memberExpiry is it excluded. Other members are excluded if they have not been
+// seen for memberExpiry, or if we have learned their current identity only via
+// gossip (a stale report could otherwise hold back, or prematurely advance, the
+// frontier). Members that are excluded, or that join later, are behind the log
+// base, and must be bootstrapped from a value snapshot. Client streams that are
+// behind the log base are closed, and their clients fall back to a value
+// snapshot when they resubscribe.
+//
+// Members' version vectors are persisted before each truncation, so that after
+// a restart, the frontier does not advance past what members had applied until
+// they report again.
+
+// stableFrontier returns the stable frontier, or nil if any peer's version
+// vector, or any other live member's, is not yet known. Mutex must be held.
+func (h *hub) stableFrontier() *common.VersionVector {
+	res := h.store.Log.Head()
+	now := time.Now()
+	expiry := now.Add(-memberExpiry)
+	for addr, m := range h.members {
+		lastSeen := h.lastSeen(m, now)
+		if _, ok := h.peers[addr]; ok {
+			if !lastSeen.IsZero() && !lastSeen.After(expiry) {
+				continue
+			}
+		} else if !lastSeen.After(expiry) || !m.confirmed {
+			continue
+		}
+		if !m.confirmed || m.VersionVector == nil {
+			return nil
+		}
+		res.Intersect(m.VersionVector)
+	}
+	return res
+}
+
+// collectGarbage periodically truncates the log up to the stable frontier.
+func (h *hub) collectGarbage() {
+	for range time.Tick(logGCPeriod) {
+		if err := h.truncateLog(); err != nil {
+			log.Printf("failed to truncate log: %v", err)
+		}
+	}
+}
+
+// truncateLog truncates the log up to the stable frontier, if any.
+func (h *hub) truncateLog() (err error) {
+	defer catchPanic(&err)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	vec := h.stableFrontier()
+	if vec == nil {
+		return nil
+	}
+	if err := h.saveMembers(); err != nil {
+		return err
+	}
+	return h.store.Truncate(vec)
+}
@@ -0,0 +1,59 @@
+package hub
+
+import (
+	"fmt"
+	"time"
+)
+
+// maxClockOffset bounds how far ahead of the physical clock an observed
+// timestamp may be. Without a bound, a single peer with a badly skewed clock
+// would drag every agent's timestamps arbitrarily far ahead of physical time,
+// and its patches would win every last-writer-wins conflict.
+const maxClockOffset = time.Minute
+
+// hlc is a hybrid logical clock. It provides timestamps that are close to
+// physical time, but that never decrease and that always exceed the timestamps
+// of all patches this agent has observed. Thus, if patch A causally precedes
+// patch B, A's timestamp is less than B's, even if the creators' physical
+// clocks are skewed. The divergence from physical time is bounded by the skew
+// of the fastest clock in the system.
+//
+// Logical ticks are represented as nanoseconds added to the physical
+// component, so that timestamps remain plain time.Time values.
+// https://cse.buffalo.edu/tech-reports/2014-04.pdf
+type hlc struct {
+	now  func() time.Time // physical clock
+	last time.Time        // last timestamp issued or observed
+}
+
+func newHLC(now func() time.Time) *hlc {
+	return &hlc{now: now}
+}
+
+// Now returns a new timestamp, greater than all previously issued or observed
+// timestamps.
+func (c *hlc) Now() time.Time {
+	// Strip any monotonic clock reading, so that timestamps compare the same way
+	// before and after encoding.
+	pt := c.now().Round(0)
+	if pt.After(c.last) {
+		c.last = pt
+	} else {
+		c.last = c.last.Add(time.Nanosecond)
+	}
+	return c.last
+}
+
+// Update advances the clock past the given observed timestamp. If the timestamp
+// is more than maxClockOffset ahead of the physical clock, leaves the clock
+// unchanged and returns an error; the caller should reject whatever carried the
+// timestamp.
+func (c *hlc) Update(t time.Time) error {
+	if bound := c.now().Round(0).Add(maxClockOffset); t.After(bound) {
+		return fmt.Errorf("timestamp %v is more than %v ahead of physical time", t, maxClockOffset)
+	}
+	if t.After(c.last) {
+		c.last = t.Round(0)
+	}
+	return nil
+}
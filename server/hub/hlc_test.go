@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// simClock is a physical clock that is offset from simulated real time by a
+// fixed skew.
+type simClock struct {
+	real *time.Time
+	skew time.Duration
+}
+
+func (c *simClock) now() time.Time {
+	return c.real.Add(c.skew)
+}
+
+func TestHLCMonotonic(t *testing.T) {
+	real := time.Unix(1000, 0)
+	clock := &simClock{real: &real}
+	c := newHLC(clock.now)
+	prev := c.Now()
+	for i := 0; i < 100; i++ {
+		// Occasionally move the physical clock backwards.
+		if i%10 == 0 {
+			clock.skew -= time.Second
+		}
+		next := c.Now()
+		if !next.After(prev) {
+			t.Fatalf("timestamp did not increase: %v then %v", prev, next)
+		}
+		prev = next
+	}
+}
+
+func TestHLCUpdate(t *testing.T) {
+	real := time.Unix(1000, 0)
+	c := newHLC((&simClock{real: &real}).now)
+	remote := real.Add(maxClockOffset)
+	c.Update(remote)
+	if got := c.Now(); !got.After(remote) {
+		t.Fatalf("got %v, want after %v", got, remote)
+	}
+	// Stale remote timestamps have no effect.
+	before := c.Now()
+	c.Update(real)
+	if got := c.Now(); got != before.Add(time.Nanosecond) {
+		t.Fatalf("got %v, want %v", got, before.Add(time.Nanosecond))
+	}
+}
+
+func TestHLCUpdateFarFuture(t *testing.T) {
+	real := time.Unix(1000, 0)
+	c := newHLC((&simClock{real: &real}).now)
+	bound := real.Add(maxClockOffset)
+	if err := c.Update(bound.Add(time.Nanosecond)); err == nil {
+		t.Fatal("expected error")
+	}
+	// Rejected timestamps have no effect.
+	if got := c.Now(); got != real {
+		t.Fatalf("got %v, want %v", got, real)
+	}
+	// Timestamps within the bound are accepted.
+	if err := c.Update(bound); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHLCSkewedClocks simulates agents with skewed physical clocks exchanging
+// timestamped messages, and checks that (1) each message is timestamped after
+// every message its sender had received, and (2) every timestamp stays within
+// the maximum skew of real time.
+func TestHLCSkewedClocks(t *testing.T) {
+	const (
+		numSteps = 10000
+		step     = time.Millisecond
+	)
+	skews := []time.Duration{0, 5 * time.Second, -3 * time.Second, 200 * time.Millisecond}
+	maxSkew, minSkew := time.Duration(0), time.Duration(0)
+	for _, skew := range skews {
+		if skew > maxSkew {
+			maxSkew = skew
+		}
+		if skew < minSkew {
+			minSkew = skew
+		}
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	real := time.Unix(1000, 0)
+	clocks := make([]*hlc, len(skews))
+	// For each agent, the latest timestamp it has observed.
+	observed := make([]time.Time, len(skews))
+	for i, skew := range skews {
+		clocks[i] = newHLC((&simClock{real: &real, skew: skew}).now)
+	}
+	for i := 0; i < numSteps; i++ {
+		real = real.Add(step)
+		from, to := rng.Intn(len(skews)), rng.Intn(len(skews))
+		ts := clocks[from].Now()
+		if !ts.After(observed[from]) {
+			t.Fatalf("step %d: agent %d issued %v, not after observed %v", i, from, ts, observed[from])
+		}
+		if d := ts.Sub(real); d > maxSkew+step || d < minSkew {
+			t.Fatalf("step %d: agent %d issued %v, which is %v from real time", i, from, ts, d)
+		}
+		observed[from] = ts
+		clocks[to].Update(ts)
+		if ts.After(observed[to]) {
+			observed[to] = ts
+		}
+	}
+}
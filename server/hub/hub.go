@@ -8,6 +8,9 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"path/filepath"
+	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -16,6 +19,7 @@ import (
 	"github.com/gorilla/websocket"
 
 	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
 	"github.com/asadovsky/cdb/server/store"
 )
 
@@ -23,14 +27,23 @@ var (
 	errAlreadyInitialized = errors.New("already initialized")
 )
 
-func init() {
-	rand.Seed(time.Now().UTC().UnixNano())
+// protocolError is an error that should be reported to the other end of a
+// stream, along with the given error code.
+type protocolError struct {
+	code string
+	err  error
 }
 
-func ok(err error, v ...interface{}) {
-	if err != nil {
-		panic(fmt.Sprintf("%v: %s", err, fmt.Sprint(v...)))
-	}
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("%s: %v", e.code, e.err)
+}
+
+func newProtocolError(code string, err error) error {
+	return &protocolError{code: code, err: err}
+}
+
+func init() {
+	rand.Seed(time.Now().UTC().UnixNano())
 }
 
 func assert(b bool, v ...interface{}) {
@@ -39,10 +52,14 @@ func assert(b bool, v ...interface{}) {
 	}
 }
 
-func jsonMarshal(v interface{}) []byte {
-	buf, err := json.Marshal(v)
-	ok(err)
-	return buf
+// catchPanic recovers from a panic, if any, and stores it in *err. Deferred by
+// the code that handles streams and peers, so that a bug triggered by a stream
+// or peer ends that stream or sync, rather than crashing the hub. Mutexes held
+// when the panic occurs must be released by deferred calls.
+func catchPanic(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+	}
 }
 
 func isReadFromClosedConnError(err error) bool {
@@ -58,90 +75,133 @@ func isWriteToClosedConnError(err error) bool {
 }
 
 type hub struct {
-	agentId uint32
-	addr    string
-	mu      sync.Mutex // protects the fields below
-	store   *store.Store
-	peers   map[string]bool // set of active peers, keyed by addr
+	agentId      uint32
+	addr         string
+	identityPath string     // empty if the hub is not persistent
+	membersPath  string     // empty if the hub is not persistent
+	reservedSeq  uint32     // highest sequence number reserved in the identity file
+	mu           sync.Mutex // protects the fields below
+	store        *store.Store
+	clock        *hlc               // timestamps patches created by this agent
+	peers        map[string]*peer   // hubs we sync with, keyed by addr
+	members      map[string]*Member // known hubs other than this one, keyed by addr
+	maxPeers     int                // max number of peers to add via gossip; 0 means no limit
 }
 
-func newHub(addr string, peerAddrs []string) *hub {
-	// TODO: Attempt to read agent id from persistent storage.
+func newHub(addr string, peerAddrs []string, dataDir string, maxPeers int) (*hub, error) {
 	h := &hub{
-		agentId: uint32(rand.Int31()),
-		addr:    addr,
-		peers:   make(map[string]bool),
+		addr:     addr,
+		peers:    make(map[string]*peer),
+		members:  make(map[string]*Member),
+		maxPeers: maxPeers,
+	}
+	storeDir := ""
+	if dataDir != "" {
+		storeDir = filepath.Join(dataDir, "store")
+	}
+	var err error
+	if h.store, err = store.OpenStore(&h.mu, storeDir); err != nil {
+		return nil, err
+	}
+	// Ensure that new patches are timestamped after all logged patches, even if
+	// the physical clock has gone backwards since they were created.
+	h.clock = newHLC(time.Now)
+	if err := h.clock.Update(h.store.Log.MaxTime()); err != nil {
+		h.store.Close()
+		return nil, fmt.Errorf("log: %v", err)
+	}
+	if err := h.initIdentity(dataDir); err != nil {
+		h.store.Close()
+		return nil, err
 	}
-	h.store = store.OpenStore(&h.mu)
 	log.Printf("started agent %d", h.agentId)
 	// Start streaming updates from peers.
+	h.mu.Lock()
+	if dataDir != "" {
+		h.membersPath = filepath.Join(dataDir, "members")
+	}
+	if err := h.loadMembers(); err != nil {
+		h.mu.Unlock()
+		h.store.Close()
+		return nil, err
+	}
 	for _, peerAddr := range peerAddrs {
 		if peerAddr != "" {
-			go h.requestPatchesFromPeer(peerAddr)
+			h.addPeer(peerAddr)
 		}
 	}
-	return h
+	h.mu.Unlock()
+	go h.collectGarbage()
+	return h, nil
 }
 
-// requestPatchesFromPeer requests patches from the given peer. If the peer is
-// available, they will reply with a never-ending stream of patches.
-func (h *hub) requestPatchesFromPeer(peerAddr string) {
-	h.mu.Lock()
-	if h.peers[peerAddr] {
-		// We're already streaming patches from this peer.
-		h.mu.Unlock()
-		return
+// initIdentity initializes the hub's agent id, reading it from the given data
+// directory if possible. If dataDir is empty, picks a random agent id.
+func (h *hub) initIdentity(dataDir string) error {
+	if dataDir == "" {
+		h.agentId = uint32(rand.Int31())
+		return nil
 	}
-	h.peers[peerAddr] = true
-	vec := h.store.Log.Head()
-	h.mu.Unlock()
-	defer func() {
-		h.mu.Lock()
-		delete(h.peers, peerAddr)
-		h.mu.Unlock()
-	}()
-	// Dial peer.
-	conn, _, err := websocket.DefaultDialer.Dial("ws://"+peerAddr, nil)
+	h.identityPath = filepath.Join(dataDir, "identity")
+	id, err := readIdentity(h.identityPath)
 	if err != nil {
-		log.Printf("peer %s: dial failed: %v", peerAddr, err)
-		return
+		return err
 	}
-	log.Printf("peer %s: established connection", peerAddr)
-	// Send SubscribeI2R message.
-	ok(conn.WriteJSON(&SubscribeI2R{
-		Type:          "SubscribeI2R",
-		AgentId:       h.agentId,
-		Addr:          h.addr,
-		VersionVector: vec,
-	}))
-	// Process patches streamed from peer.
-	for {
-		_, buf, err := conn.ReadMessage()
-		if isReadFromClosedConnError(err) {
-			log.Printf("peer %s: conn closed: %v", peerAddr, err)
-			conn.Close()
-			return
+	vec := h.store.Log.Head()
+	if id == nil {
+		if len(*vec) > 0 {
+			return fmt.Errorf("oplog is not empty, but identity file %s does not exist", h.identityPath)
 		}
-		var msg PatchR2I
-		ok(json.Unmarshal(buf, &msg))
-		assert(msg.Type == "PatchR2I", msg)
-		// Update store and log.
-		h.mu.Lock()
-		err = h.store.ApplyServerPatch(msg.AgentId, msg.AgentSeq, msg.Key, msg.DType, msg.Patch)
-		h.mu.Unlock()
-		ok(err)
+		id = &identity{AgentId: uint32(rand.Int31())}
+		if err := writeIdentity(h.identityPath, id); err != nil {
+			return err
+		}
+	} else if err := checkIdentity(id, vec.Get(id.AgentId)); err != nil {
+		return err
+	}
+	h.agentId, h.reservedSeq = id.AgentId, id.AgentSeq
+	return nil
+}
+
+// reserveAgentSeq ensures that the sequence number that the next patch created
+// by this agent will use has been reserved in the identity file, reserving a
+// new block of sequence numbers if needed. Mutex must be held.
+func (h *hub) reserveAgentSeq() error {
+	if h.identityPath == "" {
+		return nil
+	}
+	seq := h.store.Log.Head().Get(h.agentId) + 1
+	if seq <= h.reservedSeq {
+		return nil
 	}
+	reservedSeq := seq + agentSeqBlock - 1
+	if err := writeIdentity(h.identityPath, &identity{
+		AgentId:  h.agentId,
+		AgentSeq: reservedSeq,
+	}); err != nil {
+		return err
+	}
+	h.reservedSeq = reservedSeq
+	return nil
 }
 
-// forEachLogEntry iterates over log entries beyond the given version vector.
-func (h *hub) forEachLogEntry(vec *common.VersionVector, handleLogEntry func(*store.LogIterator) error) error {
+// forEachLogEntry iterates over log entries beyond the given version vector,
+// until handleLogEntry returns an error or done is closed. If caughtUp is not
+// nil, calls it with the current position whenever the iteration catches up
+// with the log.
+func (h *hub) forEachLogEntry(vec *common.VersionVector, done <-chan struct{}, handleLogEntry func(*store.LogIterator) error, caughtUp func(*common.VersionVector) error) (err error) {
+	defer catchPanic(&err)
 	for {
-		h.store.Log.Wait(vec)
+		if !h.store.Log.Wait(vec, done) {
+			return nil
+		}
 		it := h.store.Log.NewIterator(vec)
 		for {
-			h.mu.Lock()
-			advanced := it.Advance()
-			h.mu.Unlock()
+			advanced := func() bool {
+				h.mu.Lock()
+				defer h.mu.Unlock()
+				return it.Advance()
+			}()
 			if !advanced {
 				break
 			}
@@ -153,16 +213,29 @@ func (h *hub) forEachLogEntry(vec *common.VersionVector, handleLogEntry func(*st
 		if err := it.Err(); err != nil {
 			return err
 		}
+		if caughtUp != nil {
+			if err := caughtUp(vec); err != nil {
+				return err
+			}
+		}
 	}
 }
 
 type stream struct {
-	h    *hub
-	conn *websocket.Conn
-	mu   sync.Mutex
+	h       *hub
+	conn    *websocket.Conn
+	done    chan struct{} // closed when the stream ends
+	writeMu sync.Mutex    // serializes writes to conn
+	mu      sync.Mutex
 
 	// Populated if connection is from a client.
 	gotSubscribeC2S bool
+	// Protects sub and skips. Held while checking whether to send a value or
+	// patch and sending it, so that no patch for a newly subscribed key is sent
+	// before that key's value.
+	subMu sync.Mutex
+	sub   *subscription
+	skips []*skip
 	// Queue of written local sequence numbers. Used to determine whether a log
 	// record originated from this particular client.
 	// TODO: Use a linked list or somesuch.
@@ -171,23 +244,48 @@ type stream struct {
 	// Populated if connection is from a peer.
 	gotSubscribeI2R bool
 	agentId         uint32
+	addr            string
+}
+
+func (s *stream) writeJSON(v interface{}) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	return s.conn.WriteJSON(v)
+}
+
+// streamLogEntries sends log entries beyond the given version vector using
+// handleLogEntry (and caughtUp; see forEachLogEntry) until the stream ends. If
+// sending fails, closes the conn, which in turn ends the stream.
+func (s *stream) streamLogEntries(vec *common.VersionVector, handleLogEntry func(*store.LogIterator) error, caughtUp func(*common.VersionVector) error) {
+	if err := s.h.forEachLogEntry(vec, s.done, handleLogEntry, caughtUp); err != nil {
+		if !isWriteToClosedConnError(err) {
+			log.Printf("streaming failed: %v", err)
+		}
+		s.conn.Close()
+	}
 }
 
-func (s *stream) snapshot() ([]ValueS2C, *common.VersionVector, error) {
+// snapshot returns the values of all keys in the given collection for which
+// include returns true, along with the current log head.
+func (s *stream) snapshot(collection string, include func(key string) bool) ([]ValueS2C, *common.VersionVector, error) {
 	s.h.mu.Lock()
 	defer s.h.mu.Unlock()
 	valueMsgs := []ValueS2C{}
-	it := s.h.store.NewIterator()
+	it := s.h.store.NewIterator(collection)
 	for it.Advance() {
+		if !include(it.Key()) {
+			continue
+		}
 		valueStr, err := it.Value().Value.Encode()
 		if err != nil {
 			return nil, nil, err
 		}
 		valueMsgs = append(valueMsgs, ValueS2C{
-			Type:  "ValueS2C",
-			Key:   it.Key(),
-			DType: it.Value().DType,
-			Value: valueStr,
+			Type:       "ValueS2C",
+			Collection: collection,
+			Key:        it.Key(),
+			DType:      it.Value().DType,
+			Value:      valueStr,
 		})
 	}
 	if err := it.Err(); err != nil {
@@ -199,100 +297,402 @@ func (s *stream) snapshot() ([]ValueS2C, *common.VersionVector, error) {
 func (s *stream) processSubscribeC2S(msg *SubscribeC2S) error {
 	s.mu.Lock()
 	if s.gotSubscribeC2S || s.gotSubscribeI2R {
-		return errAlreadyInitialized
+		s.mu.Unlock()
+		return newProtocolError(ErrCodeBadState, errAlreadyInitialized)
 	}
 	s.gotSubscribeC2S = true
 	s.mu.Unlock()
-	valueMsgs, vec, err := s.snapshot()
-	if err != nil {
-		return err
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	s.sub = newSubscription(msg.Collection, msg.Keys, msg.Prefixes)
+	// If possible, resume from the client's version vector, sending only the
+	// patches it is missing. Otherwise, send all subscribed values.
+	vec, resumed := msg.VersionVector, false
+	if vec != nil {
+		s.h.mu.Lock()
+		resumed = s.h.store.Log.Covers(vec)
+		s.h.mu.Unlock()
 	}
-	for _, valueMsg := range valueMsgs {
-		if err := s.conn.WriteJSON(valueMsg); err != nil {
+	if !resumed {
+		var err error
+		if vec, err = s.sendValues(s.sub.collection, s.sub.matches); err != nil {
 			return err
 		}
 	}
-	if err := s.conn.WriteJSON(&ValuesDoneS2C{
-		Type: "ValuesDoneS2C",
+	if err := s.writeJSON(&ValuesDoneS2C{
+		Type:          "ValuesDoneS2C",
+		VersionVector: vec,
+		Resumed:       resumed,
 	}); err != nil {
 		return err
 	}
-	go func() {
-		ok(s.h.forEachLogEntry(vec, func(it *store.LogIterator) error {
-			patch := it.Patch()
-			isLocal := false
-			s.mu.Lock()
-			if len(s.localSeqs) > 0 && s.localSeqs[0] == patch.LocalSeq {
-				isLocal = true
-				s.localSeqs = s.localSeqs[1:]
+	progress := vec.Copy()
+	go s.streamLogEntries(vec.Copy(), func(it *store.LogIterator) error {
+		patch := it.Patch()
+		isLocal := false
+		s.mu.Lock()
+		if len(s.localSeqs) > 0 && s.localSeqs[0] == patch.LocalSeq {
+			isLocal = true
+			s.localSeqs = s.localSeqs[1:]
+		}
+		s.mu.Unlock()
+		if patch.Dropped {
+			return nil
+		}
+		s.subMu.Lock()
+		defer s.subMu.Unlock()
+		defer s.pruneSkips(it.VersionVector())
+		if patch.DType == store.DTypeBatch {
+			patches := s.batchPatches(patch, it.AgentId(), it.AgentSeq())
+			// Always send local batches, so that the client knows they were applied.
+			if len(patches) == 0 && !isLocal {
+				return nil
 			}
-			s.mu.Unlock()
-			// TODO: If the patch had no effect on the value, perhaps we should
-			// somehow avoid broadcasting it to subscribers.
-			err := s.conn.WriteJSON(&PatchS2C{
-				Type:    "PatchS2C",
+			return s.writeJSON(&BatchS2C{
+				Type:    "BatchS2C",
 				AgentId: it.AgentId(),
 				IsLocal: isLocal,
-				Key:     patch.Key,
-				DType:   patch.DType,
-				Patch:   patch.Patch,
+				Patches: patches,
 			})
-			if isWriteToClosedConnError(err) {
-				return nil
+		}
+		if !s.wantPatch(patch, it.AgentId(), it.AgentSeq()) {
+			return nil
+		}
+		if patch.Reset {
+			// The value was deleted before this patch was applied.
+			if err := s.writeJSON(&PatchS2C{
+				Type:       "PatchS2C",
+				AgentId:    it.AgentId(),
+				Collection: patch.Collection,
+				Key:        patch.Key,
+				DType:      cvalue.DTypeDelete,
+			}); err != nil {
+				return err
 			}
-			return err
-		}))
-	}()
+		}
+		// TODO: If the patch had no effect on the value, perhaps we should
+		// somehow avoid broadcasting it to subscribers.
+		return s.writeJSON(&PatchS2C{
+			Type:       "PatchS2C",
+			AgentId:    it.AgentId(),
+			IsLocal:    isLocal,
+			Collection: patch.Collection,
+			Key:        patch.Key,
+			DType:      patch.DType,
+			Patch:      patch.Patch,
+		})
+	}, func(vec *common.VersionVector) error {
+		// Report our position, so that the client can resume from it, unless the
+		// client has subscribed to new keys whose values reflect patches beyond
+		// this position.
+		s.subMu.Lock()
+		defer s.subMu.Unlock()
+		if vec.Leq(progress) || !s.pruneSkips(vec) {
+			return nil
+		}
+		progress = vec
+		return s.writeJSON(&ProgressS2C{
+			Type:          "ProgressS2C",
+			VersionVector: vec,
+		})
+	})
+	return nil
+}
+
+// sendValues sends the values of all keys in the given collection for which
+// include returns true. Returns the log head as of when the values were read.
+// subMu must be held.
+func (s *stream) sendValues(collection string, include func(key string) bool) (*common.VersionVector, error) {
+	valueMsgs, vec, err := s.snapshot(collection, include)
+	if err != nil {
+		return nil, err
+	}
+	for _, valueMsg := range valueMsgs {
+		if err := s.writeJSON(valueMsg); err != nil {
+			return nil, err
+		}
+	}
+	return vec, nil
+}
+
+// wantPatch returns true iff the given patch should be sent to the client.
+// subMu must be held.
+func (s *stream) wantPatch(pe *store.PatchEnvelope, agentId, agentSeq uint32) bool {
+	want := s.sub.matchesPatch(pe)
+	for _, sk := range s.skips {
+		if want && sk.covers(pe, agentId, agentSeq) {
+			want = false
+		}
+	}
+	return want
+}
+
+// batchPatches returns the patches in the given batch that should be sent to
+// the client, each preceded by a delete of its key if the value was deleted
+// before the patch was applied. subMu must be held.
+func (s *stream) batchPatches(pe *store.PatchEnvelope, agentId, agentSeq uint32) []BatchPatch {
+	patches := []BatchPatch{}
+	for _, bpe := range pe.Batch {
+		if bpe.Dropped || !s.wantPatch(bpe, agentId, agentSeq) {
+			continue
+		}
+		if bpe.Reset {
+			patches = append(patches, BatchPatch{
+				Collection: bpe.Collection,
+				Key:        bpe.Key,
+				DType:      cvalue.DTypeDelete,
+			})
+		}
+		patches = append(patches, BatchPatch{
+			Collection: bpe.Collection,
+			Key:        bpe.Key,
+			DType:      bpe.DType,
+			Patch:      bpe.Patch,
+		})
+	}
+	return patches
+}
+
+// pruneSkips drops skips that the log stream, now at the given position, has
+// caught up with. Returns true iff no skips remain. subMu must be held.
+func (s *stream) pruneSkips(vec *common.VersionVector) bool {
+	skips := s.skips[:0]
+	for _, sk := range s.skips {
+		if !sk.vec.Leq(vec) {
+			skips = append(skips, sk)
+		}
+	}
+	s.skips = skips
+	return len(skips) == 0
+}
+
+func (s *stream) processUpdateSubscriptionC2S(msg *UpdateSubscriptionC2S) error {
+	s.mu.Lock()
+	if !s.gotSubscribeC2S {
+		s.mu.Unlock()
+		return newProtocolError(ErrCodeBadState, errors.New("did not get SubscribeC2S message"))
+	}
+	s.mu.Unlock()
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	old, sub := s.sub, newSubscription(msg.Collection, msg.Keys, msg.Prefixes)
+	// Send values for newly subscribed keys. The client drops values for keys
+	// that are no longer subscribed.
+	vec, err := s.sendValues(sub.collection, func(key string) bool {
+		return sub.matches(key) && !(old.collection == sub.collection && old.matches(key))
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.writeJSON(&ValuesDoneS2C{
+		Type: "ValuesDoneS2C",
+	}); err != nil {
+		return err
+	}
+	s.sub = sub
+	s.skips = append(s.skips, &skip{old: old, new: sub, vec: vec})
 	return nil
 }
 
 func (s *stream) processSubscribeI2R(msg *SubscribeI2R) error {
 	s.mu.Lock()
 	if s.gotSubscribeC2S || s.gotSubscribeI2R {
-		return errAlreadyInitialized
+		s.mu.Unlock()
+		return newProtocolError(ErrCodeBadState, errAlreadyInitialized)
 	}
 	s.gotSubscribeI2R = true
 	s.agentId = msg.AgentId
+	s.addr = msg.Addr
 	s.mu.Unlock()
-	go func() {
-		ok(s.h.forEachLogEntry(msg.VersionVector, func(it *store.LogIterator) error {
-			// TODO: Update our notion of the peer's knowledge based on patches we
-			// receive from them.
-			if s.agentId == it.AgentId() {
-				return nil
-			}
-			patch := it.Patch()
-			err := s.conn.WriteJSON(&PatchR2I{
-				Type:     "PatchR2I",
-				AgentId:  it.AgentId(),
-				AgentSeq: it.AgentSeq(),
-				Key:      patch.Key,
-				DType:    patch.DType,
-				Patch:    patch.Patch,
-			})
-			if isWriteToClosedConnError(err) {
-				return nil
-			}
+	vec := msg.VersionVector
+	if vec == nil {
+		vec = &common.VersionVector{}
+	}
+	// Record the peer's knowledge, and turn around and request patches from this
+	// peer.
+	s.h.mu.Lock()
+	s.h.observeMember(msg.Addr, msg.AgentId, time.Now(), vec, true)
+	s.h.addPeer(msg.Addr)
+	base := s.h.store.Log.Base()
+	s.h.mu.Unlock()
+	if !base.Leq(vec) {
+		// Our log no longer has some of the patches the peer is missing, so send
+		// values instead.
+		var err error
+		if vec, err = s.sendValuesR2I(); err != nil {
 			return err
-		}))
+		}
+	}
+	go s.streamLogEntries(vec, func(it *store.LogIterator) error {
+		// Skip patches the peer is known to have, i.e. its own patches, and those
+		// in its acks, in the patches and values it sends us, and in version
+		// vectors gossiped by other members.
+		if s.agentId == it.AgentId() {
+			return nil
+		}
+		s.h.mu.Lock()
+		has := s.h.memberHas(s.addr, s.agentId, common.Dot{AgentId: it.AgentId(), AgentSeq: it.AgentSeq()})
+		s.h.mu.Unlock()
+		if has {
+			return nil
+		}
+		patch := it.Patch()
+		msg := &PatchR2I{
+			Type:       "PatchR2I",
+			AgentId:    it.AgentId(),
+			AgentSeq:   it.AgentSeq(),
+			Collection: patch.Collection,
+			Key:        patch.Key,
+			DType:      patch.DType,
+			Patch:      patch.Patch,
+			Tombstone:  patch.Tombstone,
+			Time:       patch.Time,
+			Deps:       patch.Deps,
+		}
+		for _, bpe := range patch.Batch {
+			msg.Batch = append(msg.Batch, BatchPatchR2I{
+				Collection: bpe.Collection,
+				Key:        bpe.Key,
+				DType:      bpe.DType,
+				Patch:      bpe.Patch,
+				Tombstone:  bpe.Tombstone,
+			})
+		}
+		return s.writeJSON(msg)
+	}, nil)
+	go s.gossipMembers()
+	return nil
+}
+
+// sendValuesR2I sends all collections and their values, followed by a
+// ValuesDoneR2I message. Returns the log head as of when the values were read.
+func (s *stream) sendValuesR2I() (*common.VersionVector, error) {
+	var collections map[string]*store.EncodedCollection
+	var vec *common.VersionVector
+	var t time.Time
+	err := func() error {
+		s.h.mu.Lock()
+		defer s.h.mu.Unlock()
+		var err error
+		collections, err = s.h.store.EncodeValues()
+		vec, t = s.h.store.Log.Head(), s.h.store.Log.MaxTime()
+		return err
 	}()
-	// Turn around and request patches from this peer.
-	go s.h.requestPatchesFromPeer(msg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(collections))
+	for name := range collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ec := collections[name]
+		if err := s.writeJSON(&CollectionR2I{
+			Type:       "CollectionR2I",
+			Collection: name,
+			Creates:    ec.Creates,
+			Tombstone:  ec.Tombstone,
+		}); err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(ec.Values))
+		for key := range ec.Values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ev := ec.Values[key]
+			if err := s.writeJSON(&ValueR2I{
+				Type:       "ValueR2I",
+				Collection: name,
+				Key:        key,
+				DType:      ev.DType,
+				Value:      ev.Value,
+				Tombstone:  ev.Tombstone,
+			}); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := s.writeJSON(&ValuesDoneR2I{
+		Type:          "ValuesDoneR2I",
+		VersionVector: vec,
+		Time:          t,
+	}); err != nil {
+		return nil, err
+	}
+	return vec, nil
+}
+
+func (s *stream) processAckI2R(msg *AckI2R) error {
+	s.mu.Lock()
+	if !s.gotSubscribeI2R {
+		s.mu.Unlock()
+		return newProtocolError(ErrCodeBadState, errors.New("did not get SubscribeI2R message"))
+	}
+	addr, agentId := s.addr, s.agentId
+	s.mu.Unlock()
+	if msg.VersionVector == nil {
+		return newProtocolError(ErrCodeBadMessage, errors.New("missing version vector"))
+	}
+	s.h.mu.Lock()
+	s.h.observeMember(addr, agentId, time.Now(), msg.VersionVector, true)
+	s.h.mu.Unlock()
 	return nil
 }
 
 func (s *stream) processPatchC2S(msg *PatchC2S) error {
+	return s.applyClientPatch(func(agentId uint32, t time.Time) (uint32, error) {
+		return s.h.store.ApplyClientPatch(agentId, t, msg.Collection, msg.Key, msg.DType, msg.Patch)
+	})
+}
+
+func (s *stream) processBatchC2S(msg *BatchC2S) error {
+	patches := make([]store.ClientPatch, len(msg.Patches))
+	for i, p := range msg.Patches {
+		patches[i] = store.ClientPatch{Collection: p.Collection, Key: p.Key, DType: p.DType, Patch: p.Patch}
+	}
+	return s.applyClientPatch(func(agentId uint32, t time.Time) (uint32, error) {
+		return s.h.store.ApplyClientBatch(agentId, t, patches)
+	})
+}
+
+func (s *stream) processCreateCollectionC2S(msg *CreateCollectionC2S) error {
+	return s.applyClientPatch(func(agentId uint32, t time.Time) (uint32, error) {
+		return s.h.store.CreateCollection(agentId, t, msg.Collection)
+	})
+}
+
+func (s *stream) processDestroyCollectionC2S(msg *DestroyCollectionC2S) error {
+	return s.applyClientPatch(func(agentId uint32, t time.Time) (uint32, error) {
+		return s.h.store.DestroyCollection(agentId, t, msg.Collection)
+	})
+}
+
+// applyClientPatch updates the store and log by calling apply, which returns
+// the local sequence number of the written log record, or zero if it wrote
+// nothing.
+func (s *stream) applyClientPatch(apply func(agentId uint32, t time.Time) (uint32, error)) error {
 	s.mu.Lock()
 	if !s.gotSubscribeC2S {
 		s.mu.Unlock()
-		return errors.New("did not get SubscribeC2S message")
+		return newProtocolError(ErrCodeBadState, errors.New("did not get SubscribeC2S message"))
 	}
 	s.mu.Unlock()
-	// Update store and log.
-	s.h.mu.Lock()
-	localSeq, err := s.h.store.ApplyClientPatch(s.h.agentId, msg.Key, msg.DType, msg.Patch)
-	s.h.mu.Unlock()
-	if err != nil {
+	localSeq, err := func() (uint32, error) {
+		s.h.mu.Lock()
+		defer s.h.mu.Unlock()
+		if err := s.h.reserveAgentSeq(); err != nil {
+			return 0, err
+		}
+		localSeq, err := apply(s.h.agentId, s.h.clock.Now())
+		if err != nil && !store.IsInternal(err) {
+			err = newProtocolError(ErrCodeBadPatch, err)
+		}
+		return localSeq, err
+	}()
+	if err != nil || localSeq == 0 {
 		return err
 	}
 	s.mu.Lock()
@@ -301,45 +701,228 @@ func (s *stream) processPatchC2S(msg *PatchC2S) error {
 	return nil
 }
 
+// Maximum number of values per ScanS2C message.
+const maxScanPageSize = 1000
+
+// scanRange returns the range of keys to scan for the given message.
+func scanRange(msg *ScanC2S) (string, string) {
+	start, limit := msg.Start, msg.Limit
+	if msg.Prefix == "" {
+		return start, limit
+	}
+	prefixStart, prefixLimit := store.PrefixRange(msg.Prefix)
+	if start < prefixStart {
+		start = prefixStart
+	}
+	if limit == "" || (prefixLimit != "" && prefixLimit < limit) {
+		limit = prefixLimit
+	}
+	return start, limit
+}
+
+// scan adds up to pageSize values in [start, limit) from reply's collection to
+// reply, along with the current log head.
+func (s *stream) scan(reply *ScanS2C, start, limit string, reverse bool, pageSize int) error {
+	s.h.mu.Lock()
+	defer s.h.mu.Unlock()
+	it := s.h.store.NewRangeIterator(reply.Collection, start, limit, reverse)
+	for it.Advance() {
+		if len(reply.Values) == pageSize {
+			reply.More = true
+			break
+		}
+		valueStr, err := it.Value().Value.Encode()
+		if err != nil {
+			return err
+		}
+		reply.Values = append(reply.Values, ScanValue{
+			Key:   it.Key(),
+			DType: it.Value().DType,
+			Value: valueStr,
+		})
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	reply.VersionVector = s.h.store.Log.Head()
+	return nil
+}
+
+func (s *stream) processScanC2S(msg *ScanC2S) error {
+	s.mu.Lock()
+	if s.gotSubscribeI2R {
+		s.mu.Unlock()
+		return newProtocolError(ErrCodeBadState, errors.New("got ScanC2S on peer stream"))
+	}
+	s.mu.Unlock()
+	pageSize := msg.PageSize
+	if pageSize < 0 {
+		return newProtocolError(ErrCodeBadMessage, fmt.Errorf("invalid page size: %d", pageSize))
+	} else if pageSize == 0 || pageSize > maxScanPageSize {
+		pageSize = maxScanPageSize
+	}
+	start, limit := scanRange(msg)
+	reply := &ScanS2C{Type: "ScanS2C", Collection: msg.Collection, Values: []ScanValue{}}
+	if err := s.scan(reply, start, limit, msg.Reverse, pageSize); err != nil {
+		return err
+	}
+	return s.writeJSON(reply)
+}
+
+// processMessage decodes and processes the given message.
+func (s *stream) processMessage(buf []byte) (err error) {
+	defer catchPanic(&err)
+	// TODO: Avoid decoding multiple times.
+	var mt MsgType
+	if err := json.Unmarshal(buf, &mt); err != nil {
+		return newProtocolError(ErrCodeBadMessage, err)
+	}
+	switch mt.Type {
+	case "SubscribeC2S":
+		var msg SubscribeC2S
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processSubscribeC2S(&msg)
+	case "SubscribeI2R":
+		var msg SubscribeI2R
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processSubscribeI2R(&msg)
+	case "AckI2R":
+		var msg AckI2R
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processAckI2R(&msg)
+	case "UpdateSubscriptionC2S":
+		var msg UpdateSubscriptionC2S
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processUpdateSubscriptionC2S(&msg)
+	case "PatchC2S":
+		var msg PatchC2S
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processPatchC2S(&msg)
+	case "BatchC2S":
+		var msg BatchC2S
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processBatchC2S(&msg)
+	case "CreateCollectionC2S":
+		var msg CreateCollectionC2S
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processCreateCollectionC2S(&msg)
+	case "DestroyCollectionC2S":
+		var msg DestroyCollectionC2S
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processDestroyCollectionC2S(&msg)
+	case "ScanC2S":
+		var msg ScanC2S
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return newProtocolError(ErrCodeBadMessage, err)
+		}
+		return s.processScanC2S(&msg)
+	default:
+		return newProtocolError(ErrCodeBadMessage, fmt.Errorf("unknown message type: %s", mt.Type))
+	}
+}
+
+// reportError sends the given error to the other end of the stream.
+func (s *stream) reportError(err error) {
+	code, message := ErrCodeInternal, err.Error()
+	if e, ok := err.(*protocolError); ok {
+		code, message = e.code, e.err.Error()
+	}
+	s.mu.Lock()
+	isPeer := s.gotSubscribeI2R
+	s.mu.Unlock()
+	var msg interface{} = &ErrorS2C{Type: "ErrorS2C", Code: code, Message: message}
+	if isPeer {
+		msg = &ErrorR2I{Type: "ErrorR2I", Code: code, Message: message}
+	}
+	if err := s.writeJSON(msg); err != nil && !isWriteToClosedConnError(err) {
+		log.Printf("failed to report error: %v", err)
+	}
+}
+
+// close ends the stream, stopping any goroutines that are sending log entries.
+func (s *stream) close() {
+	close(s.done)
+	s.h.store.Log.Interrupt()
+	s.conn.Close()
+}
+
 func (h *hub) handleConn(w http.ResponseWriter, r *http.Request) {
 	conn, err := websocket.Upgrade(w, r, nil, 0, 0)
-	ok(err)
-	s := &stream{h: h, conn: conn}
+	if err != nil {
+		// Upgrade has already replied with an HTTP error.
+		log.Printf("upgrade failed: %v", err)
+		return
+	}
+	s := &stream{h: h, conn: conn, done: make(chan struct{})}
+	defer s.close()
 
 	for {
 		_, buf, err := conn.ReadMessage()
 		if isReadFromClosedConnError(err) {
 			log.Printf("conn closed: %v", err)
-			break
+			return
+		} else if err != nil {
+			log.Printf("read failed: %v", err)
+			return
+		}
+		if err := s.processMessage(buf); err != nil {
+			log.Printf("closing stream: %v", err)
+			s.reportError(err)
+			return
 		}
-		ok(err)
-		// TODO: Avoid decoding multiple times.
-		var mt MsgType
-		ok(json.Unmarshal(buf, &mt))
-		switch mt.Type {
-		case "SubscribeC2S":
-			var msg SubscribeC2S
-			ok(json.Unmarshal(buf, &msg))
-			ok(s.processSubscribeC2S(&msg))
-		case "SubscribeI2R":
-			var msg SubscribeI2R
-			ok(json.Unmarshal(buf, &msg))
-			ok(s.processSubscribeI2R(&msg))
-		case "PatchC2S":
-			var msg PatchC2S
-			ok(json.Unmarshal(buf, &msg))
-			ok(s.processPatchC2S(&msg))
-		default:
-			panic(fmt.Errorf("unknown message type: %s", mt.Type))
-		}
-	}
-
-	conn.Close()
-}
-
-func Serve(addr string, peerAddrs []string) error {
-	h := newHub(addr, peerAddrs)
+	}
+}
+
+// writeJSONResponse writes the given value as a JSON HTTP response.
+func writeJSONResponse(w http.ResponseWriter, v interface{}) {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(buf)
+}
+
+// handleDebugPeers reports the state of syncing with each peer, as JSON.
+func (h *hub) handleDebugPeers(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, h.PeerStates())
+}
+
+// handleDebugMembers reports all known members, as JSON.
+func (h *hub) handleDebugMembers(w http.ResponseWriter, r *http.Request) {
+	writeJSONResponse(w, h.Members())
+}
+
+// Serve runs a hub at the given address. If dataDir is non-empty, the hub's
+// state is persisted in the given directory. The hub syncs with the given peers,
+// and with up to maxPeers additional hubs learned of via gossip (no limit if
+// maxPeers is 0).
+func Serve(addr string, peerAddrs []string, dataDir string, maxPeers int) error {
+	h, err := newHub(addr, peerAddrs, dataDir, maxPeers)
+	if err != nil {
+		return err
+	}
+	defer h.store.Close()
 	http.HandleFunc("/", h.handleConn)
+	http.HandleFunc("/debug/peers", h.handleDebugPeers)
+	http.HandleFunc("/debug/members", h.handleDebugMembers)
 	go func() {
 		time.Sleep(100 * time.Millisecond)
 		gosh.SendVars(map[string]string{"ready": ""})
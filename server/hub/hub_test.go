@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+	"github.com/asadovsky/cdb/server/store"
+)
+
+// newTestHub returns an in-memory hub with no peers. Unlike newHub, it starts
+// no goroutines.
+func newTestHub(t *testing.T) *hub {
+	h := &hub{
+		agentId: 1,
+		addr:    "a",
+		clock:   newHLC(time.Now),
+		peers:   make(map[string]*peer),
+		members: make(map[string]*Member),
+	}
+	var err error
+	if h.store, err = store.OpenStore(&h.mu, ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.store.Close() })
+	return h
+}
+
+func TestRejectFutureTimes(t *testing.T) {
+	h := newTestHub(t)
+	p := &peer{state: PeerState{Addr: "b"}}
+	future := time.Now().Add(2 * maxClockOffset)
+	for _, msg := range []interface{}{
+		&PatchR2I{Type: "PatchR2I", AgentId: 2, AgentSeq: 1, Collection: store.DefaultCollection, Key: "k", DType: cvalue.DTypeCCounter, Patch: `{"P":{"2":1}}`, Time: future},
+		&ValuesDoneR2I{Type: "ValuesDoneR2I", VersionVector: &common.VersionVector{2: 1}, Time: future},
+	} {
+		buf, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := h.processR2I(p, buf); err == nil {
+			t.Fatalf("%T: expected error", msg)
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if head := h.store.Log.Head(); len(*head) != 0 {
+		t.Fatalf("patch applied: head %v", head)
+	}
+	if now := h.clock.Now(); now.After(time.Now().Add(time.Second)) {
+		t.Fatalf("clock advanced to %v", now)
+	}
+}
+
+// scanAll runs the given scan, following continuations as described in
+// ScanS2C, and returns the keys of all values received.
+func scanAll(t *testing.T, s *stream, msg *ScanC2S) []string {
+	res := []string{}
+	start, limit := scanRange(msg)
+	for {
+		reply := &ScanS2C{Collection: msg.Collection, Values: []ScanValue{}}
+		if err := s.scan(reply, start, limit, msg.Reverse, msg.PageSize); err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Values) > msg.PageSize {
+			t.Fatalf("got %d values, want at most %d", len(reply.Values), msg.PageSize)
+		}
+		for _, v := range reply.Values {
+			res = append(res, v.Key)
+		}
+		if !reply.More {
+			return res
+		}
+		last := reply.Values[len(reply.Values)-1].Key
+		if msg.Reverse {
+			limit = last
+		} else {
+			start = last + "\x00"
+		}
+	}
+}
+
+func TestScan(t *testing.T) {
+	h := newTestHub(t)
+	h.mu.Lock()
+	for _, key := range []string{"a", "ab", "abc", "b", "ba", "c"} {
+		if _, err := h.store.ApplyClientPatch(h.agentId, time.Unix(1, 0), store.DefaultCollection, key, cvalue.DTypeCCounter, `{"Add":1}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.mu.Unlock()
+	s := &stream{h: h}
+	for _, c := range []struct {
+		msg  ScanC2S
+		want []string
+	}{
+		{ScanC2S{}, []string{"a", "ab", "abc", "b", "ba", "c"}},
+		{ScanC2S{Reverse: true}, []string{"c", "ba", "b", "abc", "ab", "a"}},
+		{ScanC2S{Start: "ab", Limit: "ba"}, []string{"ab", "abc", "b"}},
+		{ScanC2S{Start: "ab", Limit: "ba", Reverse: true}, []string{"b", "abc", "ab"}},
+		{ScanC2S{Prefix: "ab"}, []string{"ab", "abc"}},
+		{ScanC2S{Prefix: "ab", Reverse: true}, []string{"abc", "ab"}},
+		// Start and Limit narrow the prefix range.
+		{ScanC2S{Prefix: "a", Start: "ab"}, []string{"ab", "abc"}},
+		{ScanC2S{Prefix: "a", Limit: "abc"}, []string{"a", "ab"}},
+		{ScanC2S{Prefix: "z"}, []string{}},
+	} {
+		for _, pageSize := range []int{1, 2, 3, 100} {
+			msg := c.msg
+			msg.PageSize = pageSize
+			if got := scanAll(t, s, &msg); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%+v: got %v, want %v", msg, got, c.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+// Number of sequence numbers reserved at a time, so that the identity file need
+// not be rewritten for every patch.
+const agentSeqBlock = 1000
+
+// identity is the persistent identity of a hub.
+type identity struct {
+	AgentId uint32
+	// Highest sequence number reserved for patches created by this agent. Written
+	// before any patch with a higher sequence number is appended to the oplog,
+	// reserving the next agentSeqBlock sequence numbers, so the oplog may trail
+	// it by up to agentSeqBlock after a crash.
+	AgentSeq uint32
+}
+
+// readIdentity reads the identity stored at the given path. Returns nil if the
+// file does not exist.
+func readIdentity(path string) (*identity, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var id identity
+	if err := json.Unmarshal(buf, &id); err != nil {
+		return nil, fmt.Errorf("invalid identity file %s: %v", path, err)
+	}
+	return &id, nil
+}
+
+// writeIdentity atomically and durably writes the given identity to the given
+// path.
+func writeIdentity(path string, id *identity) error {
+	buf, err := json.Marshal(id)
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(path, buf)
+}
+
+// checkIdentity returns an error if the given identity is inconsistent with
+// the given oplog sequence number for its agent. Reusing an agent id whose
+// patches were lost from the oplog would make peers drop new patches as
+// duplicates, so we refuse to proceed. (Losses within the last reserved block
+// go undetected.)
+func checkIdentity(id *identity, oplogSeq uint32) error {
+	if oplogSeq > id.AgentSeq || oplogSeq+agentSeqBlock < id.AgentSeq {
+		return fmt.Errorf("identity and oplog disagree for agent %d: identity has seq %d, oplog has seq %d", id.AgentId, id.AgentSeq, oplogSeq)
+	}
+	return nil
+}
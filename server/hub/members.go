@@ -0,0 +1,248 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+const (
+	// How often a responder sends its member list to the initiator.
+	gossipPeriod = 5 * time.Second
+	// Members not seen for this long are not gossiped, so that hubs eventually
+	// forget about members that have gone away.
+	memberExpiry = 24 * time.Hour
+)
+
+// Membership protocol: Every responder periodically sends the initiator a
+// PeersR2I message listing itself and all members it knows about, along with
+// when each member was last seen. The initiator merges the list into its own,
+// and starts syncing with newly learned members, subject to the fan-out limit.
+// Since each initiator-responder pair syncs in both directions, member lists
+// propagate in both directions, and a new hub need only know about one existing
+// hub to discover the rest. Each member entry also carries the member's version
+// vector, as last reported, which we use to garbage collect the log (see
+// gc.go), and to avoid sending patches to members that already have them.
+
+// observeMember records that the given member exists, was seen at the given
+// time, and had applied the patches in vec (if not nil). The direct flag
+// indicates that the report came from the member itself rather than via
+// gossip. Returns true iff the member was not previously known. Mutex must be
+// held.
+func (h *hub) observeMember(addr string, agentId uint32, lastSeen time.Time, vec *common.VersionVector, direct bool) bool {
+	if addr == "" || addr == h.addr {
+		return false
+	}
+	m, ok := h.members[addr]
+	if !ok {
+		m = &Member{Addr: addr}
+		h.members[addr] = m
+	}
+	if agentId != 0 && agentId != m.AgentId {
+		// Gossip about a member can be stale, so a second-hand report may only
+		// change a known identity if it is more recent than what we know.
+		if m.AgentId != 0 && !direct && !lastSeen.After(m.LastSeen) {
+			return !ok
+		}
+		// The member has a new identity, so what we knew about its progress no
+		// longer applies.
+		m.AgentId, m.VersionVector, m.confirmed = agentId, nil, false
+	}
+	if direct && agentId != 0 {
+		m.confirmed = true
+	}
+	if lastSeen.After(m.LastSeen) {
+		m.LastSeen = lastSeen
+	}
+	// A member's knowledge only grows, so every reported version vector is a
+	// lower bound on its current knowledge. Ignore reports not attributed to the
+	// member's current identity.
+	if vec != nil && agentId != 0 && agentId == m.AgentId {
+		if m.VersionVector == nil {
+			m.VersionVector = &common.VersionVector{}
+		}
+		m.VersionVector.Merge(vec)
+	}
+	return !ok
+}
+
+// observePeer records that the member at the given address, which is sending us
+// patches, had applied the patches in vec. Ignored if the member's identity is
+// not yet known. Mutex must be held.
+func (h *hub) observePeer(addr string, vec *common.VersionVector) {
+	if m, ok := h.members[addr]; ok && m.AgentId != 0 {
+		h.observeMember(addr, m.AgentId, time.Time{}, vec, false)
+	}
+}
+
+// memberHas returns true iff the member at the given address, with the given
+// agent id, is known to have applied the patch with the given dot. Mutex must
+// be held.
+func (h *hub) memberHas(addr string, agentId uint32, d common.Dot) bool {
+	m, ok := h.members[addr]
+	if !ok || m.AgentId != agentId || m.VersionVector == nil {
+		return false
+	}
+	return m.VersionVector.Contains(d)
+}
+
+// Members returns all known members, including this hub, sorted by address.
+func (h *hub) Members() []Member {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.liveMembers(time.Time{})
+}
+
+// lastSeen returns the last time the given member was known to be reachable,
+// accounting for our own syncing with it, as of now. Mutex must be held.
+func (h *hub) lastSeen(m *Member, now time.Time) time.Time {
+	p, ok := h.peers[m.Addr]
+	switch {
+	case !ok:
+		return m.LastSeen
+	case p.state.Connected:
+		return now
+	case p.state.LastSync.After(m.LastSeen):
+		return p.state.LastSync
+	}
+	return m.LastSeen
+}
+
+// liveMembers returns all members last seen after the given time, including this
+// hub, sorted by address. Mutex must be held.
+func (h *hub) liveMembers(since time.Time) []Member {
+	now := time.Now()
+	res := []Member{{Addr: h.addr, AgentId: h.agentId, LastSeen: now, VersionVector: h.store.Log.Head()}}
+	for _, m := range h.members {
+		x := *m
+		if m.VersionVector != nil {
+			x.VersionVector = m.VersionVector.Copy()
+		}
+		x.LastSeen = h.lastSeen(m, now)
+		if x.LastSeen.After(since) {
+			res = append(res, x)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+	return res
+}
+
+// savedMember is a member as persisted in the members file.
+type savedMember struct {
+	Member
+	Confirmed bool
+	Peer      bool // whether we were syncing with the member
+}
+
+// readMembers reads the members stored at the given path. Returns nil if the
+// file does not exist.
+func readMembers(path string) ([]savedMember, error) {
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var res []savedMember
+	if err := json.Unmarshal(buf, &res); err != nil {
+		return nil, fmt.Errorf("invalid members file %s: %v", path, err)
+	}
+	return res, nil
+}
+
+// loadMembers restores the members saved in the members file, if any, and
+// resumes syncing with those that were peers. Mutex must be held.
+func (h *hub) loadMembers() error {
+	if h.membersPath == "" {
+		return nil
+	}
+	saved, err := readMembers(h.membersPath)
+	if err != nil {
+		return err
+	}
+	for _, sm := range saved {
+		if sm.Addr == "" || sm.Addr == h.addr {
+			continue
+		}
+		m := sm.Member
+		m.confirmed = sm.Confirmed && m.AgentId != 0
+		h.members[m.Addr] = &m
+	}
+	for _, sm := range saved {
+		if sm.Peer && h.members[sm.Addr] != nil {
+			h.addPeer(sm.Addr)
+		}
+	}
+	return nil
+}
+
+// saveMembers atomically and durably writes all known members to the members
+// file, if the hub is persistent. Mutex must be held.
+func (h *hub) saveMembers() error {
+	if h.membersPath == "" {
+		return nil
+	}
+	saved := make([]savedMember, 0, len(h.members))
+	for addr, m := range h.members {
+		_, peer := h.peers[addr]
+		saved = append(saved, savedMember{Member: *m, Confirmed: m.confirmed, Peer: peer})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].Addr < saved[j].Addr })
+	buf, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomic(h.membersPath, buf)
+}
+
+// processPeersR2I merges the given member list, received from the member at
+// the given address, into ours, and starts syncing with newly learned members
+// if we are below the fan-out limit.
+func (h *hub) processPeersR2I(from string, msg *PeersR2I) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, m := range msg.Members {
+		if !h.observeMember(m.Addr, m.AgentId, m.LastSeen, m.VersionVector, m.Addr == from) {
+			continue
+		}
+		if _, ok := h.peers[m.Addr]; ok {
+			continue
+		}
+		if h.maxPeers > 0 && len(h.peers) >= h.maxPeers {
+			log.Printf("learned of member %s, but already have %d peers", m.Addr, len(h.peers))
+			continue
+		}
+		log.Printf("learned of member %s", m.Addr)
+		h.addPeer(m.Addr)
+	}
+}
+
+// gossipMembers periodically sends our member list to the initiator until the
+// stream ends.
+func (s *stream) gossipMembers() {
+	ticker := time.NewTicker(gossipPeriod)
+	defer ticker.Stop()
+	for {
+		s.h.mu.Lock()
+		members := s.h.liveMembers(time.Now().Add(-memberExpiry))
+		s.h.mu.Unlock()
+		if err := s.writeJSON(&PeersR2I{
+			Type:    "PeersR2I",
+			Members: members,
+		}); err != nil {
+			// Write failures also surface in the stream's other goroutines.
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+	}
+}
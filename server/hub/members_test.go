@@ -0,0 +1,124 @@
+package hub
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+func TestObserveMemberIdentityChange(t *testing.T) {
+	h := newTestHub(t)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	vec := &common.VersionVector{1: 5}
+	h.observeMember("b", 1, now, vec, true)
+
+	// A stale second-hand report of another identity is ignored.
+	h.observeMember("b", 2, now.Add(-time.Second), &common.VersionVector{2: 1}, false)
+	if m := h.members["b"]; m.AgentId != 1 || !m.confirmed || !m.VersionVector.Leq(vec) || !vec.Leq(m.VersionVector) {
+		t.Fatalf("identity changed by stale gossip: %+v", m)
+	}
+
+	// A newer second-hand report is accepted, but leaves the identity
+	// unconfirmed.
+	h.observeMember("b", 2, now.Add(time.Second), nil, false)
+	if m := h.members["b"]; m.AgentId != 2 || m.confirmed || m.VersionVector != nil {
+		t.Fatalf("identity not changed by newer gossip: %+v", m)
+	}
+
+	// A report from the member itself is always accepted.
+	h.observeMember("b", 3, now, &common.VersionVector{3: 1}, true)
+	if m := h.members["b"]; m.AgentId != 3 || !m.confirmed || m.VersionVector == nil {
+		t.Fatalf("identity not changed by direct report: %+v", m)
+	}
+}
+
+func TestStableFrontierSkipsUnconfirmed(t *testing.T) {
+	h := newTestHub(t)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.observeMember("b", 1, time.Now(), &common.VersionVector{}, false)
+	if got := h.stableFrontier(); got == nil || len(*got) != 0 {
+		t.Fatalf("got %v, want empty frontier", got)
+	}
+	h.observeMember("c", 2, time.Now(), nil, true)
+	if got := h.stableFrontier(); got != nil {
+		t.Fatalf("got %v, want nil", got)
+	}
+}
+
+// addTestPeer adds a peer at the given address without syncing with it.
+func addTestPeer(h *hub, addr string) {
+	h.observeMember(addr, 0, time.Time{}, nil, false)
+	h.peers[addr] = &peer{state: PeerState{Addr: addr}}
+}
+
+func TestStableFrontierWaitsForPeers(t *testing.T) {
+	h := newTestHub(t)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	// A peer that has never been reachable holds back the frontier.
+	addTestPeer(h, "b")
+	if got := h.stableFrontier(); got != nil {
+		t.Fatalf("got %v, want nil", got)
+	}
+	// As does a peer whose identity was learned only via gossip.
+	h.observeMember("b", 2, time.Now(), &common.VersionVector{}, false)
+	if got := h.stableFrontier(); got != nil {
+		t.Fatalf("got %v, want nil", got)
+	}
+	h.observeMember("b", 2, time.Now(), &common.VersionVector{}, true)
+	if got := h.stableFrontier(); got == nil || len(*got) != 0 {
+		t.Fatalf("got %v, want empty frontier", got)
+	}
+	// A peer that has not been seen for memberExpiry no longer does.
+	addTestPeer(h, "c")
+	h.observeMember("c", 3, time.Now().Add(-2*memberExpiry), nil, true)
+	if got := h.stableFrontier(); got == nil || len(*got) != 0 {
+		t.Fatalf("got %v, want empty frontier", got)
+	}
+}
+
+func TestSaveMembers(t *testing.T) {
+	dir := t.TempDir()
+	h := newTestHub(t)
+	h.membersPath = filepath.Join(dir, "members")
+	h.mu.Lock()
+	addTestPeer(h, "b")
+	h.observeMember("b", 2, time.Now(), &common.VersionVector{2: 3}, true)
+	h.observeMember("c", 3, time.Now(), &common.VersionVector{3: 1}, false)
+	if err := h.saveMembers(); err != nil {
+		t.Fatal(err)
+	}
+	h.mu.Unlock()
+
+	// Load the members into a fresh hub, without syncing with peers.
+	saved, err := readMembers(h.membersPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2 := newTestHub(t)
+	h2.membersPath = h.membersPath
+	h2.mu.Lock()
+	defer h2.mu.Unlock()
+	h2.peers["b"] = &peer{state: PeerState{Addr: "b"}}
+	if err := h2.loadMembers(); err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || !saved[0].Peer || saved[1].Peer {
+		t.Fatalf("got %+v", saved)
+	}
+	for addr, m := range h.members {
+		got := h2.members[addr]
+		if got == nil || got.AgentId != m.AgentId || got.confirmed != m.confirmed || !got.LastSeen.Equal(m.LastSeen) || !reflect.DeepEqual(got.VersionVector, m.VersionVector) {
+			t.Fatalf("%s: got %+v, want %+v", addr, got, m)
+		}
+	}
+	if _, err := readMembers(filepath.Join(dir, "missing")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,321 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/store"
+)
+
+const (
+	minPeerBackoff = 500 * time.Millisecond
+	maxPeerBackoff = time.Minute
+	// If no message (including pongs) arrives from a peer within peerReadTimeout,
+	// the connection is presumed dead, e.g. because either end went to sleep.
+	peerPingPeriod  = 10 * time.Second
+	peerReadTimeout = 3 * peerPingPeriod
+)
+
+// PeerState describes the state of syncing with a peer.
+type PeerState struct {
+	Addr      string
+	Connected bool
+	LastError string    // empty if no attempt has failed yet
+	LastSync  time.Time // last time a message was received from the peer
+}
+
+// peer tracks syncing with a peer. Fields are protected by hub.mu.
+type peer struct {
+	state PeerState
+	// Used to interrupt backoff, e.g. when the peer dials us.
+	wake chan struct{}
+	// Collections and values received from the peer, if it is sending values
+	// rather than patches, keyed by collection name. Merged into the store upon
+	// ValuesDoneR2I.
+	collections map[string]*store.EncodedCollection
+}
+
+// collection returns the named collection received from the peer, adding it if
+// needed. Mutex must be held.
+func (p *peer) collection(name string) *store.EncodedCollection {
+	if p.collections == nil {
+		p.collections = map[string]*store.EncodedCollection{}
+	}
+	ec, ok := p.collections[name]
+	if !ok {
+		ec = &store.EncodedCollection{Values: map[string]*store.EncodedValue{}}
+		p.collections[name] = ec
+	}
+	return ec
+}
+
+// addPeer starts syncing with the peer at the given address, if we are not
+// already doing so. If we are, and are currently waiting to redial the peer,
+// redials immediately. Mutex must be held.
+func (h *hub) addPeer(addr string) {
+	if p, ok := h.peers[addr]; ok {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+		return
+	}
+	h.observeMember(addr, 0, time.Time{}, nil, false)
+	p := &peer{state: PeerState{Addr: addr}, wake: make(chan struct{}, 1)}
+	h.peers[addr] = p
+	go h.superviseSync(p)
+}
+
+// PeerStates returns the states of all peers, sorted by address.
+func (h *hub) PeerStates() []PeerState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := make([]PeerState, 0, len(h.peers))
+	for _, p := range h.peers {
+		res = append(res, p.state)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Addr < res[j].Addr })
+	return res
+}
+
+// superviseSync syncs with the given peer forever, redialing with exponential
+// backoff and jitter whenever the connection cannot be established or is lost.
+func (h *hub) superviseSync(p *peer) {
+	backoff := minPeerBackoff
+	for {
+		connected, err := h.requestPatchesFromPeer(p)
+		h.mu.Lock()
+		p.state.Connected = false
+		p.state.LastError = err.Error()
+		h.mu.Unlock()
+		log.Printf("peer %s: %v", p.state.Addr, err)
+		if connected {
+			backoff = minPeerBackoff
+		}
+		// Sleep for a random duration in [backoff/2, backoff).
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)))
+		select {
+		case <-time.After(delay):
+		case <-p.wake:
+		}
+		if backoff *= 2; backoff > maxPeerBackoff {
+			backoff = maxPeerBackoff
+		}
+	}
+}
+
+// requestPatchesFromPeer requests patches from the given peer, starting from
+// our current version vector. If the peer is available, they will reply with a
+// never-ending stream of patches. Returns once the stream ends, along with
+// whether the connection was established and the reason the stream ended.
+func (h *hub) requestPatchesFromPeer(p *peer) (connected bool, err error) {
+	defer catchPanic(&err)
+	addr := p.state.Addr
+	h.mu.Lock()
+	vec := h.store.Log.Head()
+	h.mu.Unlock()
+	// Dial peer.
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr, nil)
+	if err != nil {
+		return false, fmt.Errorf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	log.Printf("peer %s: established connection", addr)
+	conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+	})
+	h.mu.Lock()
+	p.state.Connected = true
+	p.state.LastSync = time.Now()
+	p.collections = nil
+	h.mu.Unlock()
+	// Send SubscribeI2R message.
+	if err := conn.WriteJSON(&SubscribeI2R{
+		Type:          "SubscribeI2R",
+		AgentId:       h.agentId,
+		Addr:          h.addr,
+		VersionVector: vec,
+	}); err != nil {
+		return true, fmt.Errorf("subscribe failed: %v", err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go h.pingPeer(conn, done)
+	// Process patches streamed from peer.
+	for {
+		_, buf, err := conn.ReadMessage()
+		if isReadFromClosedConnError(err) {
+			return true, fmt.Errorf("conn closed: %v", err)
+		} else if err != nil {
+			return true, fmt.Errorf("read failed: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(peerReadTimeout))
+		if err := h.processR2I(p, buf); err != nil {
+			return true, err
+		}
+	}
+}
+
+// pingPeer periodically pings the peer at the other end of the given conn, and
+// acknowledges the patches we have applied, until done is closed.
+func (h *hub) pingPeer(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(peerPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Errors surface as read failures in requestPatchesFromPeer.
+			conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(peerPingPeriod))
+			h.mu.Lock()
+			vec := h.store.Log.Head()
+			h.mu.Unlock()
+			conn.WriteJSON(&AckI2R{
+				Type:          "AckI2R",
+				VersionVector: vec,
+			})
+		case <-done:
+			return
+		}
+	}
+}
+
+// validatePatchR2I returns an error if the given patch message is malformed.
+// The store validates the patch contents.
+func validatePatchR2I(msg *PatchR2I) error {
+	if msg.AgentId == 0 || msg.AgentSeq == 0 {
+		return fmt.Errorf("invalid dot: %d.%d", msg.AgentId, msg.AgentSeq)
+	}
+	if msg.DType == "" {
+		return errors.New("missing dtype")
+	}
+	for _, bp := range msg.Batch {
+		if bp.DType == "" {
+			return errors.New("missing dtype in batch")
+		}
+	}
+	return nil
+}
+
+// processR2I processes the given message from a responder.
+func (h *hub) processR2I(p *peer, buf []byte) error {
+	var mt MsgType
+	if err := json.Unmarshal(buf, &mt); err != nil {
+		return err
+	}
+	switch mt.Type {
+	case "PatchR2I":
+		var msg PatchR2I
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return err
+		}
+		if err := validatePatchR2I(&msg); err != nil {
+			return err
+		}
+		// Update clock, store, and log. Reject patches from the far future, rather
+		// than letting them win every last-writer-wins conflict.
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		p.state.LastSync = time.Now()
+		if err := h.clock.Update(msg.Time); err != nil {
+			return err
+		}
+		pe := &store.PatchEnvelope{
+			Collection: msg.Collection,
+			Key:        msg.Key,
+			DType:      msg.DType,
+			Patch:      msg.Patch,
+			Tombstone:  msg.Tombstone,
+			Time:       msg.Time,
+			Deps:       msg.Deps,
+		}
+		for _, bp := range msg.Batch {
+			pe.Batch = append(pe.Batch, &store.PatchEnvelope{
+				Collection: bp.Collection,
+				Key:        bp.Key,
+				DType:      bp.DType,
+				Patch:      bp.Patch,
+				Tombstone:  bp.Tombstone,
+			})
+		}
+		// The peer has applied this patch, along with its dependencies.
+		known := &common.VersionVector{}
+		if msg.Deps != nil {
+			known.Merge(msg.Deps)
+		}
+		known.Put(msg.AgentId, msg.AgentSeq)
+		h.observePeer(p.state.Addr, known)
+		return h.store.ApplyServerPatch(msg.AgentId, msg.AgentSeq, pe)
+	case "CollectionR2I":
+		var msg CollectionR2I
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return err
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		p.state.LastSync = time.Now()
+		ec := p.collection(msg.Collection)
+		ec.Creates, ec.Tombstone = msg.Creates, msg.Tombstone
+		return nil
+	case "ValueR2I":
+		var msg ValueR2I
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return err
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		p.state.LastSync = time.Now()
+		p.collection(msg.Collection).Values[msg.Key] = &store.EncodedValue{
+			DType:     msg.DType,
+			Value:     msg.Value,
+			Tombstone: msg.Tombstone,
+		}
+		return nil
+	case "ValuesDoneR2I":
+		var msg ValuesDoneR2I
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return err
+		}
+		if msg.VersionVector == nil {
+			return errors.New("missing version vector")
+		}
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		p.state.LastSync = time.Now()
+		if err := h.clock.Update(msg.Time); err != nil {
+			p.collections = nil
+			return err
+		}
+		collections := p.collections
+		p.collections = nil
+		h.observePeer(p.state.Addr, msg.VersionVector)
+		log.Printf("peer %s: merging %d collections", p.state.Addr, len(collections))
+		return h.store.MergeValues(collections, msg.VersionVector, msg.Time)
+	case "PeersR2I":
+		var msg PeersR2I
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return err
+		}
+		h.mu.Lock()
+		p.state.LastSync = time.Now()
+		h.mu.Unlock()
+		h.processPeersR2I(p.state.Addr, &msg)
+		return nil
+	case "ErrorR2I":
+		var msg ErrorR2I
+		if err := json.Unmarshal(buf, &msg); err != nil {
+			return err
+		}
+		return fmt.Errorf("peer reported error: %s: %s", msg.Code, msg.Message)
+	default:
+		return fmt.Errorf("unknown message type: %s", mt.Type)
+	}
+}
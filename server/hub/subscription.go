@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"strings"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/store"
+)
+
+// subscription is the set of keys a client is interested in, specified as a
+// collection plus a set of keys and a set of key prefixes within it.
+type subscription struct {
+	collection string
+	keys       map[string]bool
+	prefixes   []string
+}
+
+func newSubscription(collection string, keys, prefixes []string) *subscription {
+	sub := &subscription{collection: collection, keys: map[string]bool{}, prefixes: prefixes}
+	for _, key := range keys {
+		sub.keys[key] = true
+	}
+	return sub
+}
+
+// matches returns true iff the given key, in the subscribed collection, is in
+// the subscription.
+func (sub *subscription) matches(key string) bool {
+	if sub.keys[key] {
+		return true
+	}
+	for _, prefix := range sub.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesPatch returns true iff the given patch affects the subscription.
+// Collection patches affect every subscription to their collection.
+func (sub *subscription) matchesPatch(pe *store.PatchEnvelope) bool {
+	if pe.Collection != sub.collection {
+		return false
+	}
+	return store.IsCollectionPatch(pe.DType) || sub.matches(pe.Key)
+}
+
+// skip suppresses patches that were already reflected in the values sent to a
+// client when it updated its subscription. Such patches may still be in the
+// client's log stream, since the log stream can lag behind the store.
+type skip struct {
+	old, new *subscription
+	vec      *common.VersionVector // log head when the values were sent
+}
+
+// covers returns true iff the given patch was reflected in the values sent for
+// the subscription update.
+func (sk *skip) covers(pe *store.PatchEnvelope, agentId, agentSeq uint32) bool {
+	return sk.new.matchesPatch(pe) && !sk.old.matchesPatch(pe) && agentSeq <= sk.vec.Get(agentId)
+}
@@ -1,6 +1,8 @@
 package hub
 
 import (
+	"time"
+
 	"github.com/asadovsky/cdb/server/common"
 )
 
@@ -13,41 +15,163 @@ type MsgType struct {
 	Type string
 }
 
+// Error codes, used in ErrorS2C and ErrorR2I messages.
+const (
+	ErrCodeBadMessage = "BadMessage" // message is malformed or has unknown type
+	ErrCodeBadState   = "BadState"   // message is not valid in the stream's current state
+	ErrCodeBadPatch   = "BadPatch"   // patch could not be applied
+	ErrCodeInternal   = "Internal"   // server failed to process message
+)
+
 ////////////////////////////////////////////////////////////
 // Client-to-server messages
 
+// Subscribes to the given keys in the given collection, plus all keys in the
+// collection with any of the given prefixes. To subscribe to all keys, specify
+// the empty prefix. The collection need not exist. If VersionVector is set (to a
+// version vector previously received from the server for the same
+// subscription), the server resumes from it if possible, sending only the
+// patches the client is missing.
 type SubscribeC2S struct {
-	Type string
+	Type          string
+	Collection    string
+	Keys          []string
+	Prefixes      []string
+	VersionVector *common.VersionVector
+}
+
+// Replaces the current subscription. The server replies with ValueS2C messages
+// for newly subscribed keys, followed by ValuesDoneS2C.
+type UpdateSubscriptionC2S struct {
+	Type       string
+	Collection string
+	Keys       []string
+	Prefixes   []string
 }
 
 type PatchC2S struct {
-	Type  string
-	Key   string
-	DType string // "delete" means, delete this record
-	Patch string // encoded
+	Type       string
+	Collection string // must exist
+	Key        string
+	DType      string // "delete" means, delete this record
+	Patch      string // encoded
+}
+
+// Atomically applies the given patches, as a single patch: either all patches
+// are applied, or none are. Each key may appear at most once, and collection
+// patches are not allowed.
+type BatchC2S struct {
+	Type    string
+	Patches []BatchPatch
+}
+
+type BatchPatch struct {
+	Collection string // must exist
+	Key        string
+	DType      string // "delete" means, delete this record
+	Patch      string // encoded
+}
+
+// Creates the given collection, if it does not already exist.
+type CreateCollectionC2S struct {
+	Type       string
+	Collection string
+}
+
+// Destroys the given collection, which must exist, deleting all its records.
+// The default collection cannot be destroyed.
+type DestroyCollectionC2S struct {
+	Type       string
+	Collection string
+}
+
+// Requests the values of up to PageSize keys in [Start, Limit) that also have
+// the given prefix, in key order (or reverse key order, if Reverse is set). An
+// empty Limit means no upper bound. The server replies with ScanS2C. Scans are
+// independent of the subscription, and may be sent at any time.
+type ScanC2S struct {
+	Type       string
+	Collection string
+	Start      string
+	Limit      string
+	Prefix     string
+	Reverse    bool
+	PageSize   int // zero means maxScanPageSize
 }
 
 ////////////////////////////////////////////////////////////
 // Server-to-client messages
 
 type ValueS2C struct {
-	Type  string
-	Key   string
-	DType string
-	Value string // encoded
+	Type       string
+	Collection string
+	Key        string
+	DType      string
+	Value      string // encoded
 }
 
+// Marks the end of the values sent in response to SubscribeC2S or
+// UpdateSubscriptionC2S. In response to SubscribeC2S, VersionVector is the
+// position from which patches will follow, and Resumed is true iff the server
+// resumed from the client's version vector, sending no values.
 type ValuesDoneS2C struct {
-	Type string
+	Type          string
+	VersionVector *common.VersionVector
+	Resumed       bool
 }
 
+// Collection patches (createCollection and destroyCollection) are sent to all
+// clients subscribed to the affected collection, and have an empty Key.
 type PatchS2C struct {
+	Type       string
+	AgentId    uint32 // agent that created this patch
+	IsLocal    bool   // true iff patch originated from this client (on this agent)
+	Collection string
+	Key        string
+	DType      string // "delete" means, delete this record
+	Patch      string // encoded
+}
+
+// Sent in place of PatchS2C for batches. Patches holds only the batch's patches
+// to subscribed keys (each possibly preceded by a delete of its key), and may be
+// empty if the batch originated from this client. Clients should apply the
+// patches together.
+type BatchS2C struct {
 	Type    string
-	AgentId uint32 // agent that created this patch
-	IsLocal bool   // true iff patch originated from this client (on this agent)
-	Key     string
-	DType   string // "delete" means, delete this record
-	Patch   string // encoded
+	AgentId uint32 // agent that created this batch
+	IsLocal bool   // true iff batch originated from this client (on this agent)
+	Patches []BatchPatch
+}
+
+// Sent when the server has sent all patches up to the given version vector.
+type ProgressS2C struct {
+	Type          string
+	VersionVector *common.VersionVector
+}
+
+// Reply to ScanC2S. Replies are sent in the order in which scans were received.
+// If More is true, the scan stopped at the page size; to get the next page,
+// repeat the scan with Start set to the last key plus a zero byte (or, for a
+// reverse scan, Limit set to the last key).
+type ScanS2C struct {
+	Type          string
+	Collection    string
+	Values        []ScanValue
+	More          bool
+	VersionVector *common.VersionVector // patches reflected in the values
+}
+
+type ScanValue struct {
+	Key   string
+	DType string
+	Value string // encoded
+}
+
+// Sent before the server closes the stream due to an error.
+type ErrorS2C struct {
+	Type    string
+	Code    string
+	Message string
 }
 
 ////////////////////////////////////////////////////////////
@@ -60,14 +184,90 @@ type SubscribeI2R struct {
 	VersionVector *common.VersionVector
 }
 
+// Sent periodically. Acknowledges all patches the initiator has applied, from
+// any source.
+type AckI2R struct {
+	Type          string
+	VersionVector *common.VersionVector
+}
+
 ////////////////////////////////////////////////////////////
 // Responder-to-initiator messages
 
 type PatchR2I struct {
-	Type     string
-	AgentId  uint32 // agent that created this patch
-	AgentSeq uint32 // creator's sequence number for this patch
-	Key      string
-	DType    string
-	Patch    string // encoded
+	Type       string
+	AgentId    uint32 // agent that created this patch
+	AgentSeq   uint32 // creator's sequence number for this patch
+	Collection string
+	Key        string
+	DType      string                // "delete" means, delete this record
+	Patch      string                // encoded
+	Tombstone  *common.VersionVector // tombstone observed by creator, if any
+	Time       time.Time             // creation time, per creator's hybrid logical clock
+	// Patches the creator had applied when it created this patch, other than its
+	// own, and other than those implied by its previous patch, if any. The
+	// initiator applies this patch only after all of these.
+	Deps *common.VersionVector `json:",omitempty"`
+	// For batches (DType "batch"), the patches in the batch. Collection, Key, and
+	// Patch are then empty.
+	Batch []BatchPatchR2I `json:",omitempty"`
+}
+
+type BatchPatchR2I struct {
+	Collection string
+	Key        string
+	DType      string                // "delete" means, delete this record
+	Patch      string                // encoded
+	Tombstone  *common.VersionVector // tombstone observed by creator, if any
+}
+
+// Sent in place of patches if the responder's log no longer has some of the
+// patches the initiator is missing. The responder sends all collections, each
+// followed by its values (including deleted ones), followed by ValuesDoneR2I,
+// and then streams patches beyond the version vector in ValuesDoneR2I.
+type CollectionR2I struct {
+	Type       string
+	Collection string
+	Creates    []common.Dot          // creations not undone by any destruction
+	Tombstone  *common.VersionVector // merged version vectors of all destructions, if any
+}
+
+type ValueR2I struct {
+	Type       string
+	Collection string
+	Key        string
+	DType      string                // empty if deleted
+	Value      string                // encoded
+	Tombstone  *common.VersionVector // merged version vectors of all deletions, if any
+}
+
+type ValuesDoneR2I struct {
+	Type          string
+	VersionVector *common.VersionVector // patches reflected in the values
+	Time          time.Time             // latest creation time of any such patch
+}
+
+// Member describes a hub in the cluster.
+type Member struct {
+	Addr     string
+	AgentId  uint32    // zero if not yet known
+	LastSeen time.Time // last time the member was known to be reachable
+	// Patches the member is known to have applied. Nil if not yet known.
+	VersionVector *common.VersionVector
+	// Whether the member itself has reported its current identity, as opposed
+	// to us having learned it via gossip. Not sent over the wire.
+	confirmed bool
+}
+
+// Sent periodically. Lists the responder and all other members it knows about.
+type PeersR2I struct {
+	Type    string
+	Members []Member
+}
+
+// Sent before the responder closes the stream due to an error.
+type ErrorR2I struct {
+	Type    string
+	Code    string
+	Message string
 }
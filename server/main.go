@@ -12,12 +12,14 @@ import (
 var (
 	port      = flag.Int("port", 0, "")
 	peerAddrs = flag.String("peer-addrs", "", "comma-separated peer addrs")
+	dataDir   = flag.String("data-dir", "", "data directory; if empty, data is not persisted")
+	maxPeers  = flag.Int("max-peers", 8, "max number of peers; when reached, peers learned via gossip are not added")
 )
 
 func main() {
 	flag.Parse()
 	addr := fmt.Sprintf("localhost:%d", *port)
-	if err := hub.Serve(addr, strings.Split(*peerAddrs, ",")); err != nil {
+	if err := hub.Serve(addr, strings.Split(*peerAddrs, ","), *dataDir, *maxPeers); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/store/engine"
+)
+
+// DTypeBatch is the dtype of batches, i.e. log records holding several patches
+// that are applied atomically. All patches in a batch share the batch's agent
+// sequence number, so each key may appear at most once in a batch (just as a
+// single patch may not allocate several ids with the same sequence number).
+// Batches may not hold collection patches or other batches.
+const DTypeBatch = "batch"
+
+// ClientPatch is a patch in a client batch.
+type ClientPatch struct {
+	Collection string
+	Key        string
+	DType      string // "delete" means, delete this record
+	Patch      string // encoded
+}
+
+type batchKey struct {
+	collection, key string
+}
+
+// checkBatchKeys returns an error if the given patches include several patches
+// for the same key.
+func checkBatchKeys(n int, key func(i int) batchKey) error {
+	seen := make(map[batchKey]bool, n)
+	for i := 0; i < n; i++ {
+		k := key(i)
+		if seen[k] {
+			return fmt.Errorf("multiple patches for key %q in collection %q", k.key, k.collection)
+		}
+		seen[k] = true
+	}
+	return nil
+}
+
+// ApplyClientBatch atomically applies the given patches, created at time t, as
+// a single log record, and returns the local sequence number for the written
+// log record. If any patch cannot be applied, none is. Mutex must be held.
+func (s *Store) ApplyClientBatch(agentId uint32, t time.Time, patches []ClientPatch) (uint32, error) {
+	if len(patches) == 0 {
+		return 0, errors.New("empty batch")
+	}
+	if err := checkBatchKeys(len(patches), func(i int) batchKey {
+		return batchKey{patches[i].Collection, patches[i].Key}
+	}); err != nil {
+		return 0, err
+	}
+	vec := s.Log.Head()
+	vec.Put(agentId, vec.Get(agentId)+1)
+	b := &engine.Batch{}
+	pe := &PatchEnvelope{DType: DTypeBatch, Time: t}
+	for _, p := range patches {
+		bpe, err := s.applyClientPatch(b, agentId, vec, t, p.Collection, p.Key, p.DType, p.Patch)
+		if err != nil {
+			return 0, fmt.Errorf("failed to apply patch for key %q in collection %q: %w", p.Key, p.Collection, err)
+		}
+		bpe.Time = time.Time{}
+		pe.Batch = append(pe.Batch, bpe)
+	}
+	return s.Log.pushNew(b, agentId, pe)
+}
+
+// applyServerBatch applies the given batch, identified by the given dot, adding
+// the resulting writes to the given batch. See applyServerPatch.
+func (s *Store) applyServerBatch(b *engine.Batch, dot common.Dot, pe *PatchEnvelope) error {
+	if len(pe.Batch) == 0 {
+		return errors.New("empty batch")
+	}
+	if err := checkBatchKeys(len(pe.Batch), func(i int) batchKey {
+		return batchKey{pe.Batch[i].Collection, pe.Batch[i].Key}
+	}); err != nil {
+		return err
+	}
+	pe.Dropped = true
+	for _, bpe := range pe.Batch {
+		if IsCollectionPatch(bpe.DType) || bpe.DType == DTypeBatch {
+			return fmt.Errorf("invalid dtype in batch: %s", bpe.DType)
+		}
+		if err := s.applyServerPatch(b, dot, bpe); err != nil {
+			return fmt.Errorf("failed to apply patch for key %q in collection %q: %w", bpe.Key, bpe.Collection, err)
+		}
+		pe.Dropped = pe.Dropped && bpe.Dropped
+	}
+	return nil
+}
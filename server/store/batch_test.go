@@ -0,0 +1,107 @@
+package store
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+)
+
+func counterPatch(key string) ClientPatch {
+	return ClientPatch{Collection: DefaultCollection, Key: key, DType: cvalue.DTypeCCounter, Patch: `{"Add":1}`}
+}
+
+// values returns the stored values, keyed by engine key.
+func values(t *testing.T, s *Store) map[string]string {
+	res := map[string]string{}
+	for k, v := range dump(t, s) {
+		if strings.HasPrefix(k, valuePrefix) {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+func TestClientBatchAppliesNothingOnError(t *testing.T) {
+	s := newStore(t)
+	ts := time.Unix(1, 0)
+	if _, err := s.ApplyClientBatch(1, ts, []ClientPatch{counterPatch("a")}); err != nil {
+		t.Fatal(err)
+	}
+	want := dump(t, s)
+	bad := ClientPatch{Collection: DefaultCollection, Key: "c", DType: cvalue.DTypeCCounter, Patch: "bad"}
+	if _, err := s.ApplyClientBatch(1, ts, []ClientPatch{counterPatch("a"), counterPatch("b"), bad}); err == nil {
+		t.Fatal("expected error")
+	}
+	checkUnchanged(t, s, want)
+	if got := s.Log.head.Get(1); got != 1 {
+		t.Fatalf("got head %d, want 1", got)
+	}
+}
+
+func TestClientBatchRejectsInvalidPatches(t *testing.T) {
+	s := newStore(t)
+	ts := time.Unix(1, 0)
+	want := dump(t, s)
+	for _, patches := range [][]ClientPatch{
+		{},
+		{counterPatch("a"), counterPatch("a")},
+		{counterPatch("a"), {Collection: DefaultCollection, Key: "a", DType: cvalue.DTypeDelete}},
+		{counterPatch("a"), {Collection: "c", DType: DTypeCreateCollection}},
+		{counterPatch("a"), {Collection: DefaultCollection, Key: "b", DType: DTypeBatch}},
+	} {
+		if _, err := s.ApplyClientBatch(1, ts, patches); err == nil {
+			t.Fatalf("%v: expected error", patches)
+		}
+		checkUnchanged(t, s, want)
+	}
+}
+
+func TestServerBatch(t *testing.T) {
+	src := newStore(t)
+	seq, err := src.ApplyClientBatch(1, time.Unix(1, 0), []ClientPatch{counterPatch("a"), counterPatch("b")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pe, err := src.Log.read(1, seq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pe.DType != DTypeBatch || len(pe.Batch) != 2 {
+		t.Fatalf("got %+v, want batch of 2 patches", pe)
+	}
+
+	// Invalid batches are rejected without modifying the store.
+	dst := newStore(t)
+	want := dump(t, dst)
+	for _, batch := range [][]*PatchEnvelope{
+		{},
+		{pe.Batch[0], pe.Batch[0]},
+		{pe.Batch[0], {Collection: "c", DType: DTypeCreateCollection}},
+		{pe.Batch[0], {Collection: DefaultCollection, Key: "b", DType: DTypeBatch}},
+		{pe.Batch[0], {Collection: DefaultCollection, Key: "b", DType: cvalue.DTypeCCounter, Patch: "bad"}},
+	} {
+		bad := *pe
+		bad.Batch = batch
+		if err := dst.ApplyServerPatch(1, seq, &bad); err == nil {
+			t.Fatalf("%v: expected error", batch)
+		}
+		checkUnchanged(t, dst, want)
+		if got := dst.Log.head.Get(1); got != 0 {
+			t.Fatalf("got head %d, want 0", got)
+		}
+	}
+
+	// A valid batch replicates all of its patches.
+	if err := dst.ApplyServerPatch(1, seq, pe); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := values(t, dst), values(t, src); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got := dst.Log.head.Get(1); got != seq {
+		t.Fatalf("got head %d, want %d", got, seq)
+	}
+}
@@ -0,0 +1,228 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/store/engine"
+)
+
+// DefaultCollection is the collection that exists by default and cannot be
+// destroyed.
+const DefaultCollection = ""
+
+// DTypes of collection patches, i.e. patches that create or destroy a
+// collection. Collection patches have an empty key.
+const (
+	DTypeCreateCollection  = "createCollection"
+	DTypeDestroyCollection = "destroyCollection"
+)
+
+// IsCollectionPatch returns true iff patches of the given dtype are collection
+// patches.
+func IsCollectionPatch(dtype string) bool {
+	return dtype == DTypeCreateCollection || dtype == DTypeDestroyCollection
+}
+
+// Collections behave much like keys: destroying a collection deletes every key
+// in it, and trumps any concurrent ops on its keys. Each collection has a
+// tombstone, the merge of the version vectors of all destructions of that
+// collection, and the tombstone observed by a patch creator (see PatchEnvelope)
+// includes the tombstone of the key's collection. Collection existence has
+// observed-remove semantics: a destruction undoes only the creations its creator
+// had observed, so a concurrent creation leaves the collection in existence
+// (but empty).
+
+// CollectionEnvelope represents a collection's metadata.
+type CollectionEnvelope struct {
+	// Creations of this collection not undone by any destruction, identified by
+	// their patches' dots.
+	Creates []common.Dot `json:",omitempty"`
+	// Merged version vectors of all destructions of this collection. Nil if the
+	// collection has never been destroyed.
+	Tombstone *common.VersionVector `json:",omitempty"`
+}
+
+// EncodedCollection is an encoded collection, along with the encoded values of
+// all its keys (including deleted values), keyed by key. Used to replicate
+// collections.
+type EncodedCollection struct {
+	CollectionEnvelope
+	Values map[string]*EncodedValue
+}
+
+// exists returns true iff the named collection, with this envelope, exists.
+func (ce *CollectionEnvelope) exists(name string) bool {
+	return name == DefaultCollection || len(ce.Creates) > 0
+}
+
+// tombstone returns the tombstone, or an empty version vector if the collection
+// has never been destroyed.
+func (ce *CollectionEnvelope) tombstone() *common.VersionVector {
+	if ce.Tombstone == nil {
+		return &common.VersionVector{}
+	}
+	return ce.Tombstone
+}
+
+// destroy undoes the creations in the given version vector, merging it into the
+// tombstone.
+func (ce *CollectionEnvelope) destroy(vec *common.VersionVector) {
+	creates := []common.Dot{}
+	for _, d := range ce.Creates {
+		if !vec.Contains(d) {
+			creates = append(creates, d)
+		}
+	}
+	ce.Creates = creates
+	if ce.Tombstone == nil {
+		ce.Tombstone = &common.VersionVector{}
+	}
+	ce.Tombstone.Merge(vec)
+}
+
+// mergeCollections returns the merge of the given collection envelopes, where
+// vec and otherVec represent the patches seen by the states holding ce and
+// other, respectively.
+func mergeCollections(ce *CollectionEnvelope, vec *common.VersionVector, other *CollectionEnvelope, otherVec *common.VersionVector) *CollectionEnvelope {
+	dots, otherDots := map[common.Dot]bool{}, map[common.Dot]bool{}
+	for _, d := range ce.Creates {
+		dots[d] = true
+	}
+	for _, d := range other.Creates {
+		otherDots[d] = true
+	}
+	res := &CollectionEnvelope{Creates: []common.Dot{}}
+	for d := range common.MergeDots(dots, vec, otherDots, otherVec) {
+		res.Creates = append(res.Creates, d)
+	}
+	if ce.Tombstone != nil || other.Tombstone != nil {
+		res.Tombstone = ce.tombstone().Copy()
+		res.Tombstone.Merge(other.tombstone())
+	}
+	return res
+}
+
+// effectiveTombstone returns the merge of the given value's tombstone and its
+// collection's tombstone, i.e. all deletions the value reflects.
+func effectiveTombstone(ce *CollectionEnvelope, ve *ValueEnvelope) *common.VersionVector {
+	res := ve.tombstone().Copy()
+	res.Merge(ce.tombstone())
+	return res
+}
+
+// checkCollectionName returns an error if the given collection name is invalid.
+func checkCollectionName(name string) error {
+	if strings.Contains(name, "\x00") {
+		return errors.New("collection name must not contain NUL")
+	}
+	return nil
+}
+
+// Engine keys for collections.
+const collectionPrefix = "c/"
+
+func collectionKey(name string) string {
+	return collectionPrefix + name
+}
+
+// loadCollection returns the envelope for the named collection, which may be
+// modified without affecting the store. Returns an empty envelope if the
+// collection has never been created or destroyed.
+func (s *Store) loadCollection(name string) (*CollectionEnvelope, error) {
+	buf, err := s.e.Get(collectionKey(name))
+	if err == engine.ErrNotFound {
+		return &CollectionEnvelope{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var ce CollectionEnvelope
+	if err := json.Unmarshal(buf, &ce); err != nil {
+		return nil, internal(fmt.Errorf("invalid envelope for collection %q: %v", name, err))
+	}
+	return &ce, nil
+}
+
+// putCollection adds a write of the given collection envelope to the given
+// batch.
+func putCollection(b *engine.Batch, name string, ce *CollectionEnvelope) error {
+	buf, err := json.Marshal(ce)
+	if err != nil {
+		return err
+	}
+	b.Put(collectionKey(name), buf)
+	return nil
+}
+
+// destroyCollection destroys the named collection, merging the given version
+// vector into its tombstone and deleting every key in it, and adds the
+// resulting writes to the given batch.
+func (s *Store) destroyCollection(b *engine.Batch, name string, ce *CollectionEnvelope, vec *common.VersionVector) error {
+	ce.destroy(vec)
+	if err := putCollection(b, name, ce); err != nil {
+		return err
+	}
+	it := s.NewIterator(name)
+	for it.Advance() {
+		ve := it.Value()
+		ve.delete(vec)
+		if err := putValueEnvelope(b, name, it.Key(), ve); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// CreateCollection creates the named collection, if it does not already exist,
+// in a patch created at time t. Returns the local sequence number for the
+// written log record, or zero if the collection already exists. Mutex must be
+// held.
+func (s *Store) CreateCollection(agentId uint32, t time.Time, name string) (uint32, error) {
+	if err := checkCollectionName(name); err != nil {
+		return 0, err
+	}
+	ce, err := s.loadCollection(name)
+	if err != nil {
+		return 0, err
+	}
+	if ce.exists(name) {
+		return 0, nil
+	}
+	ce.Creates = append(ce.Creates, common.Dot{AgentId: agentId, AgentSeq: s.Log.head.Get(agentId) + 1})
+	b := &engine.Batch{}
+	if err := putCollection(b, name, ce); err != nil {
+		return 0, err
+	}
+	return s.Log.pushNew(b, agentId, &PatchEnvelope{Collection: name, DType: DTypeCreateCollection, Time: t})
+}
+
+// DestroyCollection destroys the named collection, deleting every key in it, in
+// a patch created at time t. Returns the local sequence number for the written
+// log record. Mutex must be held.
+func (s *Store) DestroyCollection(agentId uint32, t time.Time, name string) (uint32, error) {
+	if name == DefaultCollection {
+		return 0, errors.New("cannot destroy default collection")
+	}
+	ce, err := s.loadCollection(name)
+	if err != nil {
+		return 0, err
+	}
+	if !ce.exists(name) {
+		return 0, fmt.Errorf("collection %q does not exist", name)
+	}
+	vec := s.Log.Head()
+	vec.Put(agentId, vec.Get(agentId)+1)
+	buf, err := vec.MarshalJSON()
+	if err != nil {
+		return 0, err
+	}
+	b := &engine.Batch{}
+	if err := s.destroyCollection(b, name, ce, vec); err != nil {
+		return 0, err
+	}
+	return s.Log.pushNew(b, agentId, &PatchEnvelope{Collection: name, DType: DTypeDestroyCollection, Patch: string(buf), Time: t})
+}
@@ -0,0 +1,337 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/asadovsky/cdb/server/common"
+)
+
+const (
+	dataFile = "data"
+	// Compaction is considered once the data file reaches this size, and happens
+	// once at most half of the file is live.
+	minCompactSize = 4 << 20
+	// Maximum payload size of the records written by compaction.
+	compactRecordSize = 1 << 20
+)
+
+const (
+	opPut    byte = 0
+	opDelete byte = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// diskEngine is a log-structured on-disk engine. The data file is a sequence of
+// records, one per batch, each holding a length, a checksum, and the batch's
+// writes. Values stay on disk; memory holds only the keys, along with the file
+// offset of each key's latest value. Once the file is mostly dead (overwritten
+// or deleted values), it is compacted by rewriting the live values to a new
+// file and renaming it over the old one.
+type diskEngine struct {
+	dir  string
+	f    *os.File
+	size int64 // size of the data file
+	live int64 // bytes in the data file needed to represent live values
+	locs map[string]loc
+	x    index
+}
+
+var _ Engine = (*diskEngine)(nil)
+
+// loc is the location of a value within the data file.
+type loc struct {
+	off int64
+	n   int
+}
+
+// OpenDiskEngine opens the engine in the given directory, creating the directory
+// if needed.
+func OpenDiskEngine(dir string) (Engine, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	// Left over from an interrupted compaction.
+	if err := os.Remove(filepath.Join(dir, dataFile+".tmp")); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, dataFile), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	// Sync the directory so that a newly created data file survives a crash.
+	if err := common.SyncDir(dir); err != nil {
+		f.Close()
+		return nil, err
+	}
+	e := &diskEngine{dir: dir, f: f, locs: map[string]loc{}}
+	if err := e.load(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read %s: %v", filepath.Join(dir, dataFile), err)
+	}
+	return e, nil
+}
+
+// load reads the data file, building the index. A torn final record (e.g. from
+// a crash during Write) is truncated away.
+func (e *diskEngine) load() error {
+	info, err := e.f.Stat()
+	if err != nil {
+		return err
+	}
+	fileSize := info.Size()
+	r := bufio.NewReader(io.NewSectionReader(e.f, 0, fileSize))
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err == io.EOF {
+			break
+		} else if err == io.ErrUnexpectedEOF {
+			return e.f.Truncate(e.size)
+		} else if err != nil {
+			return err
+		}
+		n := int64(binary.LittleEndian.Uint32(header[:4]))
+		if e.size+8+n > fileSize {
+			return e.f.Truncate(e.size)
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+			if e.size+8+n == fileSize {
+				return e.f.Truncate(e.size)
+			}
+			return fmt.Errorf("bad checksum for record at offset %d", e.size)
+		}
+		ops, offs, err := decodePayload(payload)
+		if err != nil {
+			return fmt.Errorf("bad record at offset %d: %v", e.size, err)
+		}
+		for i, op := range ops {
+			e.apply(op, e.size+8+offs[i])
+		}
+		e.size += 8 + n
+	}
+	return nil
+}
+
+// apply updates the index for the given write, whose value (if any) is at the
+// given file offset.
+func (e *diskEngine) apply(op op, off int64) {
+	if old, ok := e.locs[op.key]; ok {
+		e.live -= liveSize(op.key, old.n)
+		if op.delete {
+			delete(e.locs, op.key)
+			e.x.remove(op.key)
+		}
+	} else if !op.delete {
+		e.x.insert(op.key)
+	}
+	if !op.delete {
+		e.locs[op.key] = loc{off: off, n: len(op.value)}
+		e.live += liveSize(op.key, len(op.value))
+	}
+}
+
+// liveSize returns the number of bytes needed to represent the given key-value
+// pair in a compacted data file.
+func liveSize(key string, n int) int64 {
+	return int64(1 + 2*binary.MaxVarintLen32 + len(key) + n)
+}
+
+func (e *diskEngine) Get(key string) ([]byte, error) {
+	l, ok := e.locs[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	buf := make([]byte, l.n)
+	if _, err := e.f.ReadAt(buf, l.off); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (e *diskEngine) Scan(start, limit string) Stream {
+	return newKeyStream(&e.x, start, limit, false, e.Get)
+}
+
+func (e *diskEngine) ReverseScan(start, limit string) Stream {
+	return newKeyStream(&e.x, start, limit, true, e.Get)
+}
+
+func (e *diskEngine) Write(b *Batch) error {
+	if e.f == nil {
+		return errors.New("engine is closed")
+	}
+	if len(b.ops) == 0 {
+		return nil
+	}
+	payload, offs := encodePayload(b.ops)
+	_, err := e.f.WriteAt(encodeRecord(payload), e.size)
+	if err == nil {
+		err = e.f.Sync()
+	}
+	if err != nil {
+		// Drop any partially written record.
+		e.f.Truncate(e.size)
+		return err
+	}
+	for i, op := range b.ops {
+		e.apply(op, e.size+8+offs[i])
+	}
+	e.size += 8 + int64(len(payload))
+	// The batch is durable at this point, so a failed compaction must not fail
+	// the write; the old data file remains valid, and we retry on a later write.
+	if e.size >= minCompactSize && e.size >= 2*e.live {
+		if err := e.compact(); err != nil {
+			log.Printf("failed to compact %s: %v", e.dir, err)
+		}
+	}
+	return nil
+}
+
+// compact rewrites the live values to a new data file and renames it over the
+// current one.
+func (e *diskEngine) compact() error {
+	path := filepath.Join(e.dir, dataFile)
+	f, err := os.OpenFile(path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	locs := make(map[string]loc, len(e.locs))
+	var size int64
+	ops, n := []op{}, 0
+	flush := func() error {
+		payload, offs := encodePayload(ops)
+		if _, err := f.WriteAt(encodeRecord(payload), size); err != nil {
+			return err
+		}
+		for i, op := range ops {
+			locs[op.key] = loc{off: size + 8 + offs[i], n: len(op.value)}
+		}
+		size += 8 + int64(len(payload))
+		ops, n = ops[:0], 0
+		return nil
+	}
+	stream := newKeyStream(&e.x, "", "", false, e.Get)
+	for stream.Advance() {
+		key, value := stream.Key(), stream.Value()
+		ops = append(ops, op{key: key, value: value})
+		if n += len(key) + len(value); n >= compactRecordSize {
+			if err = flush(); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = stream.Err()
+	}
+	if err == nil && len(ops) > 0 {
+		err = flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(path + ".tmp")
+		return err
+	}
+	e.f.Close()
+	e.f, e.size, e.locs = f, size, locs
+	return common.SyncDir(e.dir)
+}
+
+func (e *diskEngine) Close() error {
+	if e.f == nil {
+		return nil
+	}
+	err := e.f.Close()
+	e.f = nil
+	return err
+}
+
+////////////////////////////////////////////////////////////
+// Record encoding
+
+// encodeRecord returns the record for the given payload: its length and
+// checksum, followed by the payload itself.
+func encodeRecord(payload []byte) []byte {
+	buf := make([]byte, 8+len(payload))
+	binary.LittleEndian.PutUint32(buf[:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	copy(buf[8:], payload)
+	return buf
+}
+
+// encodePayload encodes the given writes, returning the payload along with the
+// offset of each write's value within the payload.
+func encodePayload(ops []op) ([]byte, []int64) {
+	buf, offs := []byte{}, make([]int64, len(ops))
+	var tmp [binary.MaxVarintLen64]byte
+	for i, op := range ops {
+		if op.delete {
+			buf = append(buf, opDelete)
+		} else {
+			buf = append(buf, opPut)
+		}
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(op.key)))]...)
+		buf = append(buf, op.key...)
+		if op.delete {
+			continue
+		}
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(op.value)))]...)
+		offs[i] = int64(len(buf))
+		buf = append(buf, op.value...)
+	}
+	return buf, offs
+}
+
+// decodePayload is the inverse of encodePayload.
+func decodePayload(buf []byte) ([]op, []int64, error) {
+	ops, offs := []op{}, []int64{}
+	pos := 0
+	readBytes := func() ([]byte, error) {
+		n, k := binary.Uvarint(buf[pos:])
+		if k <= 0 || uint64(len(buf)-pos-k) < n {
+			return nil, errors.New("truncated write")
+		}
+		pos += k
+		res := buf[pos : pos+int(n)]
+		pos += int(n)
+		return res, nil
+	}
+	for pos < len(buf) {
+		kind := buf[pos]
+		pos++
+		if kind != opPut && kind != opDelete {
+			return nil, nil, fmt.Errorf("unknown write kind: %d", kind)
+		}
+		key, err := readBytes()
+		if err != nil {
+			return nil, nil, err
+		}
+		o := op{key: string(key), delete: kind == opDelete}
+		var off int
+		if !o.delete {
+			if o.value, err = readBytes(); err != nil {
+				return nil, nil, err
+			}
+			off = pos - len(o.value)
+		}
+		ops, offs = append(ops, o), append(offs, int64(off))
+	}
+	return ops, offs, nil
+}
@@ -0,0 +1,164 @@
+package engine
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func open(t *testing.T, dir string) Engine {
+	e, err := OpenDiskEngine(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func put(t *testing.T, e Engine, key, value string) {
+	b := &Batch{}
+	b.Put(key, []byte(value))
+	if err := e.Write(b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkContents checks that e holds exactly the given key-value pairs.
+func checkContents(t *testing.T, e Engine, want map[string]string) {
+	t.Helper()
+	n := 0
+	s := e.Scan("", "")
+	for s.Advance() {
+		if got := string(s.Value()); got != want[s.Key()] {
+			t.Fatalf("%s: got %q, want %q", s.Key(), got, want[s.Key()])
+		}
+		n++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if n != len(want) {
+		t.Fatalf("got %d keys, want %d", n, len(want))
+	}
+}
+
+func fileSize(t *testing.T, dir string) int64 {
+	info, err := os.Stat(filepath.Join(dir, dataFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+// writeRecords writes three single-key batches to a new engine in dir, and
+// returns the size of the data file after each write.
+func writeRecords(t *testing.T, dir string) []int64 {
+	e := open(t, dir)
+	defer e.Close()
+	sizes := []int64{}
+	for _, key := range []string{"a", "b", "c"} {
+		put(t, e, key, strings.Repeat(key, 10))
+		sizes = append(sizes, fileSize(t, dir))
+	}
+	return sizes
+}
+
+func TestTornTail(t *testing.T) {
+	// Cut the last record short, both within its header and within its payload.
+	for _, cut := range []int64{4, 20} {
+		dir := t.TempDir()
+		sizes := writeRecords(t, dir)
+		if err := os.Truncate(filepath.Join(dir, dataFile), sizes[2]-cut); err != nil {
+			t.Fatal(err)
+		}
+		e := open(t, dir)
+		checkContents(t, e, map[string]string{"a": "aaaaaaaaaa", "b": "bbbbbbbbbb"})
+		if got := fileSize(t, dir); got != sizes[1] {
+			t.Fatalf("got size %d, want %d", got, sizes[1])
+		}
+		// The engine remains writable, and new writes survive a reopen.
+		put(t, e, "d", "d")
+		e.Close()
+		e = open(t, dir)
+		checkContents(t, e, map[string]string{"a": "aaaaaaaaaa", "b": "bbbbbbbbbb", "d": "d"})
+		e.Close()
+	}
+}
+
+// corrupt flips a byte at the given offset in the data file in dir.
+func corrupt(t *testing.T, dir string, off int64) {
+	f, err := os.OpenFile(filepath.Join(dir, dataFile), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, off); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBadChecksum(t *testing.T) {
+	// A bad checksum in the final record is treated as a torn write.
+	dir := t.TempDir()
+	sizes := writeRecords(t, dir)
+	corrupt(t, dir, sizes[2]-1)
+	e := open(t, dir)
+	checkContents(t, e, map[string]string{"a": "aaaaaaaaaa", "b": "bbbbbbbbbb"})
+	e.Close()
+	if got := fileSize(t, dir); got != sizes[1] {
+		t.Fatalf("got size %d, want %d", got, sizes[1])
+	}
+
+	// A bad checksum in an earlier record is an error.
+	dir = t.TempDir()
+	sizes = writeRecords(t, dir)
+	corrupt(t, dir, sizes[1]-1)
+	if _, err := OpenDiskEngine(dir); err == nil || !strings.Contains(err.Error(), "bad checksum") {
+		t.Fatalf("got %v, want bad checksum error", err)
+	}
+	if got := fileSize(t, dir); got != sizes[2] {
+		t.Fatalf("got size %d, want %d", got, sizes[2])
+	}
+}
+
+func TestCompaction(t *testing.T) {
+	dir := t.TempDir()
+	e := open(t, dir)
+	want := map[string]string{}
+	value := string(bytes.Repeat([]byte{'x'}, 64<<10))
+	// Overwrite a few keys until the data file is well past the compaction
+	// threshold, and delete one of them.
+	for i := 0; i < 2*minCompactSize/len(value); i++ {
+		key := fmt.Sprintf("k%d", i%4)
+		put(t, e, key, fmt.Sprintf("%d%s", i, value))
+		want[key] = fmt.Sprintf("%d%s", i, value)
+	}
+	b := &Batch{}
+	b.Delete("k0")
+	if err := e.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	delete(want, "k0")
+	if got := fileSize(t, dir); got >= minCompactSize {
+		t.Fatalf("data file not compacted: size %d", got)
+	}
+	checkContents(t, e, want)
+	// Writes after compaction go to the new data file.
+	put(t, e, "k4", "v")
+	want["k4"] = "v"
+	checkContents(t, e, want)
+	e.Close()
+	if _, err := os.Stat(filepath.Join(dir, dataFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+	e = open(t, dir)
+	defer e.Close()
+	checkContents(t, e, want)
+}
@@ -0,0 +1,88 @@
+// Package engine defines Engine, an ordered key-value storage engine, along
+// with in-memory and on-disk implementations. The store keeps its values and
+// log in an engine.
+package engine
+
+import (
+	"errors"
+)
+
+// ErrNotFound is returned by Engine.Get if the key does not exist.
+var ErrNotFound = errors.New("not found")
+
+type Engine interface {
+	// Get returns the value for the given key, or ErrNotFound if the key does
+	// not exist. The returned slice must not be modified.
+	Get(key string) ([]byte, error)
+	// Scan returns a stream of key-value pairs with keys in [start, limit), in
+	// lexicographic key order. An empty limit means no upper bound. The engine
+	// must not be written while the stream is in use.
+	Scan(start, limit string) Stream
+	// ReverseScan is like Scan, but streams key-value pairs in reverse key order.
+	ReverseScan(start, limit string) Stream
+	// Write atomically (and, for persistent engines, durably) applies the given
+	// batch: after a crash, either all of its writes are visible or none are.
+	Write(b *Batch) error
+	// Close closes the engine.
+	Close() error
+}
+
+// Stream is an iterator over key-value pairs.
+type Stream interface {
+	// Advance advances the stream, staging the next key-value pair. Must be
+	// called to stage the first pair.
+	Advance() bool
+	// Key returns the current key.
+	Key() string
+	// Value returns the current value, which must not be modified.
+	Value() []byte
+	// Err returns a non-nil error iff the stream encountered an error.
+	Err() error
+}
+
+// PrefixLimit returns the limit to pass to Scan to scan all keys with the given
+// prefix.
+func PrefixLimit(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+////////////////////////////////////////////////////////////
+// Batch
+
+type op struct {
+	key    string
+	value  []byte // nil for deletions
+	delete bool
+}
+
+// Batch is a list of writes to apply atomically. Later writes to a key take
+// precedence over earlier ones.
+type Batch struct {
+	ops []op
+}
+
+// Put sets the value for the given key. The batch retains value, so the caller
+// must not modify it afterwards.
+func (b *Batch) Put(key string, value []byte) {
+	if value == nil {
+		value = []byte{}
+	}
+	b.ops = append(b.ops, op{key: key, value: value})
+}
+
+// Delete deletes the given key, if it exists.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, op{key: key, delete: true})
+}
+
+// Len returns the number of writes in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
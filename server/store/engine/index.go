@@ -0,0 +1,194 @@
+package engine
+
+import (
+	"sort"
+)
+
+// Maximum number of keys per index chunk.
+const maxChunkSize = 512
+
+// index is an ordered set of keys, used by both engines to serve scans without
+// sorting. Keys are kept in a list of non-empty sorted chunks, which together
+// form one sorted sequence. An insert or remove moves keys within a single
+// chunk (and, if the chunk splits or empties, moves the chunk list), so it stays
+// cheap even when keys are inserted in the middle of a large index, as happens
+// whenever a patch is appended to the log.
+type index struct {
+	chunks [][]string
+}
+
+// pos is a position within an index: key i of chunk c. Positions past the last
+// key are normalized to {len(chunks), 0}.
+type pos struct {
+	c, i int
+}
+
+func (p pos) less(q pos) bool {
+	return p.c < q.c || p.c == q.c && p.i < q.i
+}
+
+// chunk returns the chunk that holds, or would hold, the given key.
+func (x *index) chunk(key string) int {
+	c := sort.Search(len(x.chunks), func(c int) bool { return x.chunks[c][0] > key }) - 1
+	if c < 0 {
+		return 0
+	}
+	return c
+}
+
+// search returns the position of the first key >= the given key.
+func (x *index) search(key string) pos {
+	if len(x.chunks) == 0 {
+		return pos{}
+	}
+	c := x.chunk(key)
+	i := sort.SearchStrings(x.chunks[c], key)
+	if i == len(x.chunks[c]) {
+		return pos{c + 1, 0}
+	}
+	return pos{c, i}
+}
+
+// key returns the key at the given position, which must be valid.
+func (x *index) key(p pos) string {
+	return x.chunks[p.c][p.i]
+}
+
+// next returns the position after the given one.
+func (x *index) next(p pos) pos {
+	if p.i++; p.i == len(x.chunks[p.c]) {
+		return pos{p.c + 1, 0}
+	}
+	return p
+}
+
+// prev returns the position before the given one, which must not be the first.
+func (x *index) prev(p pos) pos {
+	if p.i > 0 {
+		return pos{p.c, p.i - 1}
+	}
+	return pos{p.c - 1, len(x.chunks[p.c-1]) - 1}
+}
+
+// insert adds the given key, if not already present.
+func (x *index) insert(key string) {
+	if len(x.chunks) == 0 {
+		x.chunks = [][]string{{key}}
+		return
+	}
+	c := x.chunk(key)
+	a := x.chunks[c]
+	i := sort.SearchStrings(a, key)
+	if i < len(a) && a[i] == key {
+		return
+	}
+	a = append(a, "")
+	copy(a[i+1:], a[i:])
+	a[i] = key
+	x.chunks[c] = a
+	if len(a) <= maxChunkSize {
+		return
+	}
+	// Split the chunk in two.
+	half := len(a) / 2
+	b := append([]string(nil), a[half:]...)
+	for j := half; j < len(a); j++ {
+		a[j] = ""
+	}
+	x.chunks[c] = a[:half]
+	x.chunks = append(x.chunks, nil)
+	copy(x.chunks[c+2:], x.chunks[c+1:])
+	x.chunks[c+1] = b
+}
+
+// remove removes the given key, if present.
+func (x *index) remove(key string) {
+	p := x.search(key)
+	if p.c == len(x.chunks) || x.key(p) != key {
+		return
+	}
+	a := x.chunks[p.c]
+	copy(a[p.i:], a[p.i+1:])
+	a[len(a)-1] = ""
+	if a = a[:len(a)-1]; len(a) > 0 {
+		x.chunks[p.c] = a
+		return
+	}
+	copy(x.chunks[p.c:], x.chunks[p.c+1:])
+	x.chunks[len(x.chunks)-1] = nil
+	x.chunks = x.chunks[:len(x.chunks)-1]
+}
+
+// bounds returns the positions of the keys in [start, limit), as a half-open
+// interval. An empty limit means no upper bound.
+func (x *index) bounds(start, limit string) (pos, pos) {
+	i, j := x.search(start), pos{len(x.chunks), 0}
+	if limit != "" {
+		j = x.search(limit)
+	}
+	if j.less(i) {
+		j = i
+	}
+	return i, j
+}
+
+// keyStream is a stream over the keys at positions [i, j) of an index, in
+// either direction, reading each value on demand. Since it reads the index
+// directly, the index must not be modified while the stream is in use.
+type keyStream struct {
+	x       *index
+	i, j    pos
+	reverse bool
+	get     func(key string) ([]byte, error)
+	started bool
+	pos     pos
+	val     []byte
+	err     error
+}
+
+func newKeyStream(x *index, start, limit string, reverse bool, get func(key string) ([]byte, error)) *keyStream {
+	s := &keyStream{x: x, reverse: reverse, get: get}
+	s.i, s.j = x.bounds(start, limit)
+	return s
+}
+
+func (s *keyStream) Advance() bool {
+	if s.err != nil {
+		return false
+	}
+	if s.reverse {
+		if !s.started {
+			s.pos = s.j
+		}
+		if !s.i.less(s.pos) {
+			return false
+		}
+		s.pos = s.x.prev(s.pos)
+	} else {
+		if !s.started {
+			s.pos = s.i
+		} else if s.pos.less(s.j) {
+			s.pos = s.x.next(s.pos)
+		}
+		if !s.pos.less(s.j) {
+			return false
+		}
+	}
+	s.started = true
+	if s.val, s.err = s.get(s.x.key(s.pos)); s.err != nil {
+		return false
+	}
+	return true
+}
+
+func (s *keyStream) Key() string {
+	return s.x.key(s.pos)
+}
+
+func (s *keyStream) Value() []byte {
+	return s.val
+}
+
+func (s *keyStream) Err() error {
+	return s.err
+}
@@ -0,0 +1,74 @@
+package engine
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// scan returns the keys in [start, limit) of x, in the given direction.
+func scan(t *testing.T, x *index, start, limit string, reverse bool) []string {
+	res := []string{}
+	s := newKeyStream(x, start, limit, reverse, func(string) ([]byte, error) { return nil, nil })
+	for s.Advance() {
+		res = append(res, s.Key())
+	}
+	if s.Advance() {
+		t.Fatal("stream advanced past its end")
+	}
+	return res
+}
+
+// TestIndex checks the index against a map, with enough keys to split chunks,
+// and with removals that empty them.
+func TestIndex(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	x, m := &index{}, map[string]bool{}
+	randomKey := func() string {
+		return fmt.Sprintf("%04d", rng.Intn(5000))
+	}
+	for i := 0; i < 20000; i++ {
+		key := randomKey()
+		// Skew towards inserts at first, and towards removes later on.
+		if rng.Intn(20000) > i {
+			x.insert(key)
+			m[key] = true
+		} else {
+			x.remove(key)
+			delete(m, key)
+		}
+		if i%1000 != 0 {
+			continue
+		}
+		want := []string{}
+		for key := range m {
+			want = append(want, key)
+		}
+		sort.Strings(want)
+		if got := scan(t, x, "", "", false); !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		for _, c := range x.chunks {
+			if len(c) == 0 || len(c) > maxChunkSize {
+				t.Fatalf("bad chunk size: %d", len(c))
+			}
+		}
+		start, limit := randomKey(), randomKey()
+		i, j := sort.SearchStrings(want, start), sort.SearchStrings(want, limit)
+		if j < i {
+			j = i
+		}
+		wantRange := append([]string{}, want[i:j]...)
+		if got := scan(t, x, start, limit, false); !reflect.DeepEqual(got, wantRange) {
+			t.Fatalf("scan [%s, %s): got %v, want %v", start, limit, got, wantRange)
+		}
+		for a, b := 0, len(wantRange)-1; a < b; a, b = a+1, b-1 {
+			wantRange[a], wantRange[b] = wantRange[b], wantRange[a]
+		}
+		if got := scan(t, x, start, limit, true); !reflect.DeepEqual(got, wantRange) {
+			t.Fatalf("reverse scan [%s, %s): got %v, want %v", start, limit, got, wantRange)
+		}
+	}
+}
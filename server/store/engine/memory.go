@@ -0,0 +1,51 @@
+package engine
+
+// memEngine is an in-memory engine. Nothing survives Close.
+type memEngine struct {
+	m map[string][]byte
+	x index
+}
+
+var _ Engine = (*memEngine)(nil)
+
+// NewMemEngine returns a new, empty in-memory engine.
+func NewMemEngine() Engine {
+	return &memEngine{m: map[string][]byte{}}
+}
+
+func (e *memEngine) Get(key string) ([]byte, error) {
+	value, ok := e.m[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (e *memEngine) Scan(start, limit string) Stream {
+	return newKeyStream(&e.x, start, limit, false, e.Get)
+}
+
+func (e *memEngine) ReverseScan(start, limit string) Stream {
+	return newKeyStream(&e.x, start, limit, true, e.Get)
+}
+
+func (e *memEngine) Write(b *Batch) error {
+	for _, op := range b.ops {
+		if op.delete {
+			if _, ok := e.m[op.key]; ok {
+				delete(e.m, op.key)
+				e.x.remove(op.key)
+			}
+			continue
+		}
+		if _, ok := e.m[op.key]; !ok {
+			e.x.insert(op.key)
+		}
+		e.m[op.key] = op.value
+	}
+	return nil
+}
+
+func (e *memEngine) Close() error {
+	return nil
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"errors"
+
+	"github.com/asadovsky/cdb/server/store/engine"
+)
+
+// internalError is an error caused by the store itself, e.g. an engine failure
+// or corrupt stored data, rather than by the patch or request being processed.
+type internalError struct {
+	err error
+}
+
+func (e *internalError) Error() string {
+	return e.err.Error()
+}
+
+func (e *internalError) Unwrap() error {
+	return e.err
+}
+
+// IsInternal returns true iff the given error, returned by the store, was caused
+// by the store itself rather than by the patch or request being processed.
+func IsInternal(err error) bool {
+	var ie *internalError
+	return errors.As(err, &ie)
+}
+
+// internal marks the given error, if any, as internal.
+func internal(err error) error {
+	if err == nil || err == engine.ErrNotFound || IsInternal(err) {
+		return err
+	}
+	return &internalError{err}
+}
+
+// internalEngine wraps an engine, marking the errors it returns (other than
+// ErrNotFound) as internal.
+type internalEngine struct {
+	e engine.Engine
+}
+
+var _ engine.Engine = (*internalEngine)(nil)
+
+func (e *internalEngine) Get(key string) ([]byte, error) {
+	buf, err := e.e.Get(key)
+	return buf, internal(err)
+}
+
+func (e *internalEngine) Scan(start, limit string) engine.Stream {
+	return &internalStream{e.e.Scan(start, limit)}
+}
+
+func (e *internalEngine) ReverseScan(start, limit string) engine.Stream {
+	return &internalStream{e.e.ReverseScan(start, limit)}
+}
+
+func (e *internalEngine) Write(b *engine.Batch) error {
+	return internal(e.e.Write(b))
+}
+
+func (e *internalEngine) Close() error {
+	return internal(e.e.Close())
+}
+
+type internalStream struct {
+	engine.Stream
+}
+
+func (s *internalStream) Err() error {
+	return internal(s.Stream.Err())
+}
@@ -1,18 +1,77 @@
 package store
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math"
 	"sync"
+	"time"
 
 	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/store/engine"
 )
 
+// ErrTruncated is returned by LogIterator.Err if the log has been truncated
+// beyond the iterator's position.
+var ErrTruncated = errors.New("log truncated")
+
+// Log is the patch log. Patches are kept in the engine, keyed by originating
+// agent id and that agent's sequence number (see logKey); the log position
+// (base, head, and so on) is kept under logMetaKey, and is written in the same
+// batch as every patch.
 type Log struct {
 	cond *sync.Cond
-	// Maps agent id to patches created by that agent.
-	m        map[uint32][]*PatchEnvelope
+	e    engine.Engine
+	// Patches at or below base have been truncated.
+	base     *common.VersionVector
 	head     *common.VersionVector
 	localSeq uint32
+	// Latest creation time of any patch in the log.
+	maxTime time.Time
+	// For each agent that has created patches since the log was opened, the log
+	// head as of its latest patch. Used to compact dependencies; see deps. Not
+	// persisted, so after a restart, each agent's first patch carries the full
+	// log head as its dependencies. That costs some bytes, but is always safe.
+	created map[uint32]*common.VersionVector
+}
+
+// logMeta is the persisted log position.
+type logMeta struct {
+	Base     *common.VersionVector
+	Head     *common.VersionVector
+	LocalSeq uint32
+	MaxTime  time.Time
+}
+
+// Engine keys for the log.
+const logMetaKey = "$log"
+
+func logKey(agentId, agentSeq uint32) string {
+	return fmt.Sprintf("l/%08x/%08x", agentId, agentSeq)
+}
+
+// openLog reads the log position from the given engine.
+func openLog(mu *sync.Mutex, e engine.Engine) (*Log, error) {
+	l := &Log{
+		cond:    sync.NewCond(mu),
+		e:       e,
+		base:    &common.VersionVector{},
+		head:    &common.VersionVector{},
+		created: map[uint32]*common.VersionVector{},
+	}
+	buf, err := e.Get(logMetaKey)
+	if err == engine.ErrNotFound {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var m logMeta
+	if err := json.Unmarshal(buf, &m); err != nil {
+		return nil, fmt.Errorf("invalid log position: %v", err)
+	}
+	l.base, l.head, l.localSeq, l.maxTime = m.Base, m.Head, m.LocalSeq, m.MaxTime
+	return l, nil
 }
 
 // Head returns a new version vector representing current knowledge. cond.L must
@@ -21,30 +80,184 @@ func (l *Log) Head() *common.VersionVector {
 	return l.head.Copy()
 }
 
-// Wait blocks until the log has patches beyond the given version vector. cond.L
-// must not be held.
-func (l *Log) Wait(vec *common.VersionVector) {
+// Base returns a new version vector representing the truncated patches. cond.L
+// must be held.
+func (l *Log) Base() *common.VersionVector {
+	return l.base.Copy()
+}
+
+// Covers returns true iff the log can bring a reader at the given version
+// vector up to date, i.e. the log has every patch beyond that version vector.
+// cond.L must be held.
+func (l *Log) Covers(vec *common.VersionVector) bool {
+	return l.base.Leq(vec) && vec.Leq(l.head)
+}
+
+// MaxTime returns the latest creation time of any patch in the log. cond.L must
+// be held.
+func (l *Log) MaxTime() time.Time {
+	return l.maxTime
+}
+
+// Wait blocks until the log has patches beyond the given version vector, or
+// until done is closed and Interrupt is called. Returns false iff done was
+// closed. cond.L must not be held.
+func (l *Log) Wait(vec *common.VersionVector, done <-chan struct{}) bool {
 	l.cond.L.Lock()
 	defer l.cond.L.Unlock()
 	for l.head.Leq(vec) {
+		select {
+		case <-done:
+			return false
+		default:
+		}
 		l.cond.Wait()
 	}
+	return true
+}
+
+// Interrupt wakes all blocked Wait calls, so that they can check whether their
+// done channels have been closed. cond.L must not be held.
+func (l *Log) Interrupt() {
+	l.cond.L.Lock()
+	defer l.cond.L.Unlock()
+	l.cond.Broadcast()
+}
+
+// read returns the given agent's patch with the given sequence number.
+func (l *Log) read(agentId, agentSeq uint32) (*PatchEnvelope, error) {
+	buf, err := l.e.Get(logKey(agentId, agentSeq))
+	if err != nil {
+		return nil, internal(fmt.Errorf("failed to read patch %d for agent %d: %v", agentSeq, agentId, err))
+	}
+	var pe PatchEnvelope
+	if err := json.Unmarshal(buf, &pe); err != nil {
+		return nil, internal(fmt.Errorf("invalid patch %d for agent %d: %v", agentSeq, agentId, err))
+	}
+	return &pe, nil
 }
 
-// push appends the given patch (from the given agent id) to the log and returns
-// the local sequence number for the written log record. cond.L must be held.
-func (l *Log) push(agentId uint32, key, dtype string, patch string) (uint32, error) {
-	l.localSeq++
-	s := append(l.m[agentId], &PatchEnvelope{
-		LocalSeq: l.localSeq,
-		Key:      key,
-		DType:    dtype,
-		Patch:    patch,
-	})
-	l.m[agentId] = s
-	l.head.Put(agentId, uint32(len(s)))
+// commit adds the given log position to the given batch, writes the batch, and
+// adopts the new position. cond.L must be held.
+func (l *Log) commit(b *engine.Batch, m *logMeta) error {
+	buf, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	b.Put(logMetaKey, buf)
+	if err := l.e.Write(b); err != nil {
+		return err
+	}
+	l.base, l.head, l.localSeq, l.maxTime = m.Base, m.Head, m.LocalSeq, m.MaxTime
 	l.cond.Broadcast()
-	return l.localSeq, nil
+	return nil
+}
+
+// deps returns the dependencies of a new patch by the given agent: the entries
+// of the log head, other than the agent's own, that have advanced since the
+// agent's previous patch (or all of them, if the agent has not created a patch
+// since the log was opened), or nil if there are none. The omitted entries are
+// implied: every replica applies the agent's patches in order, and applies each
+// one only after its own dependencies, so by the time it applies the new patch,
+// it has applied everything the agent had applied when it created the previous
+// one. cond.L must be held.
+func (l *Log) deps(agentId uint32) *common.VersionVector {
+	deps := l.Head()
+	delete(*deps, agentId)
+	if prev, ok := l.created[agentId]; ok {
+		for id, seq := range *deps {
+			if seq <= prev.Get(id) {
+				delete(*deps, id)
+			}
+		}
+	}
+	if len(*deps) == 0 {
+		return nil
+	}
+	return deps
+}
+
+// pushNew is like push, but for a new patch created by the given agent. Sets
+// the patch's dependencies. cond.L must be held.
+func (l *Log) pushNew(b *engine.Batch, agentId uint32, pe *PatchEnvelope) (uint32, error) {
+	pe.Deps = l.deps(agentId)
+	head := l.Head()
+	localSeq, err := l.push(b, agentId, pe)
+	if err != nil {
+		return 0, err
+	}
+	l.created[agentId] = head
+	return localSeq, nil
+}
+
+// push appends the given patch (from the given agent id) to the log, writing it
+// along with the rest of the given batch, and returns the local sequence number
+// for the written log record. cond.L must be held.
+func (l *Log) push(b *engine.Batch, agentId uint32, pe *PatchEnvelope) (uint32, error) {
+	pe.LocalSeq = l.localSeq + 1
+	buf, err := json.Marshal(pe)
+	if err != nil {
+		return 0, err
+	}
+	head := l.Head()
+	head.Put(agentId, head.Get(agentId)+1)
+	b.Put(logKey(agentId, head.Get(agentId)), buf)
+	maxTime := l.maxTime
+	if pe.Time.After(maxTime) {
+		maxTime = pe.Time
+	}
+	if err := l.commit(b, &logMeta{l.base, head, pe.LocalSeq, maxTime}); err != nil {
+		return 0, err
+	}
+	return pe.LocalSeq, nil
+}
+
+// discard adds deletions of the logged patches at or below the given version
+// vector to the given batch, and returns the resulting base.
+func (l *Log) discard(b *engine.Batch, vec *common.VersionVector) *common.VersionVector {
+	base := l.Base()
+	for agentId, head := range *l.head {
+		seq := vec.Get(agentId)
+		if seq > head {
+			seq = head
+		}
+		for i := base.Get(agentId) + 1; i <= seq; i++ {
+			b.Delete(logKey(agentId, i))
+		}
+		if seq > base.Get(agentId) {
+			base.Put(agentId, seq)
+		}
+	}
+	return base
+}
+
+// truncate discards patches at or below the given version vector, which must
+// be causally closed, i.e. must not include any patch without also including
+// the patches it depends on. cond.L must be held.
+func (l *Log) truncate(vec *common.VersionVector) error {
+	b := &engine.Batch{}
+	base := l.discard(b, vec)
+	if b.Len() == 0 {
+		return nil
+	}
+	return l.commit(b, &logMeta{base, l.head, l.localSeq, l.maxTime})
+}
+
+// advance advances the log to include the given version vector, as when the
+// store has merged values reflecting the patches at or below it, writing the
+// new position along with the rest of the given batch. Since the log cannot
+// serve patches it never received, these patches are treated as truncated,
+// along with any logged patches at or below vec. t is the latest creation time
+// of any patch at or below vec. cond.L must be held.
+func (l *Log) advance(b *engine.Batch, vec *common.VersionVector, t time.Time) error {
+	base, head := l.discard(b, vec), l.Head()
+	base.Merge(vec)
+	head.Merge(vec)
+	maxTime := l.maxTime
+	if t.After(maxTime) {
+		maxTime = t
+	}
+	return l.commit(b, &logMeta{base, head, l.localSeq, maxTime})
 }
 
 ////////////////////////////////////////////////////////////
@@ -53,39 +266,63 @@ func (l *Log) push(agentId uint32, key, dtype string, patch string) (uint32, err
 type LogIterator struct {
 	l   *Log
 	vec *common.VersionVector
-	// Agent id and sequence number for staged patch.
+	// Maps agent id to that agent's patch following vec, for agents whose next
+	// patch has been read but not yet staged.
+	next map[uint32]*PatchEnvelope
+	// Agent id, sequence number, and patch for staged patch.
 	agentId  uint32
 	agentSeq uint32
+	pe       *PatchEnvelope
+	err      error
 }
 
 // NewIterator returns an iterator for patches beyond the given version vector.
 // Iteration order matches log order. cond.L must be held during calls to
-// Advance, but need not be held at other times.
+// Advance, but need not be held at other times. If the log is truncated beyond
+// the iterator's position, iteration stops and Err returns ErrTruncated.
 func (l *Log) NewIterator(vec *common.VersionVector) *LogIterator {
-	return &LogIterator{l: l, vec: vec}
+	return &LogIterator{l: l, vec: vec, next: map[uint32]*PatchEnvelope{}}
 }
 
 // Advance advances the iterator, staging the next patch. Must be called to
 // stage the first value. Assumes cond.L is held.
 func (it *LogIterator) Advance() bool {
-	var minLocalSeq, advAgentId, advAgentSeq uint32 = math.MaxUint32, 0, 0
-	for agentId, patches := range it.l.m {
-		agentSeq := it.vec.Get(agentId)
-		if agentSeq < uint32(len(patches)) && patches[agentSeq].LocalSeq < minLocalSeq {
-			minLocalSeq, advAgentId, advAgentSeq = patches[agentSeq].LocalSeq, agentId, agentSeq+1
+	if it.err != nil {
+		return false
+	}
+	if !it.l.base.Leq(it.vec) {
+		it.err = ErrTruncated
+		return false
+	}
+	var minLocalSeq, advAgentId uint32 = math.MaxUint32, 0
+	for agentId, head := range *it.l.head {
+		seq := it.vec.Get(agentId)
+		if seq >= head {
+			continue
+		}
+		pe, ok := it.next[agentId]
+		if !ok {
+			if pe, it.err = it.l.read(agentId, seq+1); it.err != nil {
+				return false
+			}
+			it.next[agentId] = pe
+		}
+		if pe.LocalSeq < minLocalSeq {
+			minLocalSeq, advAgentId = pe.LocalSeq, agentId
 		}
 	}
 	if minLocalSeq == math.MaxUint32 {
 		return false
 	}
-	it.vec.Put(advAgentId, advAgentSeq)
-	it.agentId, it.agentSeq = advAgentId, advAgentSeq
+	it.agentId, it.agentSeq, it.pe = advAgentId, it.vec.Get(advAgentId)+1, it.next[advAgentId]
+	it.vec.Put(it.agentId, it.agentSeq)
+	delete(it.next, advAgentId)
 	return true
 }
 
 // Value returns the current patch.
 func (it *LogIterator) Patch() *PatchEnvelope {
-	return it.l.m[it.agentId][it.agentSeq-1]
+	return it.pe
 }
 
 // AgentId returns the agent id for the current patch.
@@ -106,5 +343,5 @@ func (it *LogIterator) VersionVector() *common.VersionVector {
 
 // Err returns a non-nil error iff the iterator encountered an error.
 func (it *LogIterator) Err() error {
-	return nil
+	return it.err
 }
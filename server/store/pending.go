@@ -0,0 +1,135 @@
+package store
+
+import (
+	"fmt"
+
+	"github.com/asadovsky/cdb/server/common"
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+)
+
+// Maximum number of server patches buffered awaiting their dependencies. Beyond
+// this, ApplyServerPatch fails, so that the peer stream ends, and is restarted
+// from our version vector.
+const maxPendingPatches = 10000
+
+// pendingPatches holds server patches that arrived before their dependencies,
+// keyed by creator agent id and sequence number. Pending patches are not
+// persisted; after a restart, peers send them again.
+type pendingPatches struct {
+	m map[uint32]map[uint32]*PatchEnvelope
+	n int
+}
+
+func (p *pendingPatches) add(agentId, agentSeq uint32, pe *PatchEnvelope) error {
+	patches, ok := p.m[agentId]
+	if !ok {
+		if p.m == nil {
+			p.m = map[uint32]map[uint32]*PatchEnvelope{}
+		}
+		patches = map[uint32]*PatchEnvelope{}
+		p.m[agentId] = patches
+	}
+	if _, ok := patches[agentSeq]; ok {
+		return nil
+	}
+	if p.n >= maxPendingPatches {
+		return fmt.Errorf("too many pending patches; dropping patch %d for agent %d", agentSeq, agentId)
+	}
+	patches[agentSeq] = pe
+	p.n++
+	return nil
+}
+
+func (p *pendingPatches) remove(agentId, agentSeq uint32) {
+	if _, ok := p.m[agentId][agentSeq]; !ok {
+		return
+	}
+	delete(p.m[agentId], agentSeq)
+	if len(p.m[agentId]) == 0 {
+		delete(p.m, agentId)
+	}
+	p.n--
+}
+
+// patchDeps returns the patches the given patch causally depends on, other than
+// earlier patches by its creator: its recorded dependencies, plus the deletions
+// its creator had observed and those it undoes, which are checked as well in
+// case the patch was logged without its dependencies.
+func patchDeps(agentId, agentSeq uint32, pe *PatchEnvelope) (*common.VersionVector, error) {
+	deps := &common.VersionVector{}
+	if pe.Deps != nil {
+		deps.Merge(pe.Deps)
+	}
+	if pe.Tombstone != nil {
+		deps.Merge(pe.Tombstone)
+	}
+	switch pe.DType {
+	case cvalue.DTypeDelete, DTypeDestroyCollection:
+		vec := &common.VersionVector{}
+		if err := vec.UnmarshalJSON([]byte(pe.Patch)); err != nil {
+			return nil, err
+		}
+		deps.Merge(vec)
+	case DTypeBatch:
+		for _, bpe := range pe.Batch {
+			bdeps, err := patchDeps(agentId, agentSeq, bpe)
+			if err != nil {
+				return nil, err
+			}
+			deps.Merge(bdeps)
+		}
+	}
+	// A deletion's version vector includes the deletion itself, and a creator's
+	// own patches are implied by its sequence number.
+	if deps.Get(agentId) >= agentSeq {
+		deps.Put(agentId, agentSeq-1)
+	}
+	return deps, nil
+}
+
+// ready returns true iff all dependencies of the given patch have been applied.
+// Checking that the creator's previous patch has been applied is what makes it
+// safe for the recorded dependencies to omit those of earlier patches.
+func (s *Store) ready(agentId, agentSeq uint32, pe *PatchEnvelope) (bool, error) {
+	if agentSeq != s.Log.head.Get(agentId)+1 {
+		return false, nil
+	}
+	deps, err := patchDeps(agentId, agentSeq, pe)
+	if err != nil {
+		return false, err
+	}
+	return deps.Leq(s.Log.head), nil
+}
+
+// applyPending applies pending patches whose dependencies have been applied,
+// until none remain, and drops pending patches that have already been applied.
+// Mutex must be held.
+func (s *Store) applyPending() error {
+	for progress := true; progress; {
+		progress = false
+		for agentId, patches := range s.pending.m {
+			for agentSeq := range patches {
+				if agentSeq <= s.Log.head.Get(agentId) {
+					s.pending.remove(agentId, agentSeq)
+				}
+			}
+			agentSeq := s.Log.head.Get(agentId) + 1
+			pe, ok := patches[agentSeq]
+			if !ok {
+				continue
+			}
+			ok, err := s.ready(agentId, agentSeq, pe)
+			if err != nil {
+				return err
+			} else if !ok {
+				continue
+			}
+			s.pending.remove(agentId, agentSeq)
+			if err := s.applyServerPatchNow(agentId, agentSeq, pe); err != nil {
+				return err
+			}
+			progress = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package store
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+)
+
+// logged applies a client patch adding one to the counter at the given key, as
+// the given agent, and returns the logged patch.
+func logged(t *testing.T, s *Store, agentId uint32, key string) *PatchEnvelope {
+	if _, err := s.ApplyClientPatch(agentId, time.Unix(1, 0), DefaultCollection, key, cvalue.DTypeCCounter, `{"Add":1}`); err != nil {
+		t.Fatal(err)
+	}
+	pe, err := s.Log.read(agentId, s.Log.head.Get(agentId))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pe
+}
+
+func applyServerPatch(t *testing.T, s *Store, agentId, agentSeq uint32, pe *PatchEnvelope) {
+	x := *pe
+	if err := s.ApplyServerPatch(agentId, agentSeq, &x); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkPending(t *testing.T, s *Store, head map[uint32]uint32, n int) {
+	t.Helper()
+	for agentId, seq := range head {
+		if got := s.Log.head.Get(agentId); got != seq {
+			t.Fatalf("agent %d: got head %d, want %d", agentId, got, seq)
+		}
+	}
+	if s.pending.n != n {
+		t.Fatalf("got %d pending patches, want %d", s.pending.n, n)
+	}
+}
+
+func TestPendingOutOfOrder(t *testing.T) {
+	src := newStore(t)
+	p1, p2 := logged(t, src, 1, "a"), logged(t, src, 1, "b")
+	dst := newStore(t)
+	applyServerPatch(t, dst, 1, 2, p2)
+	checkPending(t, dst, map[uint32]uint32{1: 0}, 1)
+	// Resending a buffered patch does not buffer it twice.
+	applyServerPatch(t, dst, 1, 2, p2)
+	checkPending(t, dst, map[uint32]uint32{1: 0}, 1)
+	// Applying the missing patch drains the buffered one.
+	applyServerPatch(t, dst, 1, 1, p1)
+	checkPending(t, dst, map[uint32]uint32{1: 2}, 0)
+	// Resending an applied patch is a no-op.
+	applyServerPatch(t, dst, 1, 2, p2)
+	checkPending(t, dst, map[uint32]uint32{1: 2}, 0)
+	if got, want := values(t, dst), values(t, src); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestPendingCausalDeps(t *testing.T) {
+	// Agent 2 writes after observing agent 1's patch.
+	a := newStore(t)
+	p1 := logged(t, a, 1, "a")
+	b := newStore(t)
+	applyServerPatch(t, b, 1, 1, p1)
+	p2 := logged(t, b, 2, "a")
+
+	dst := newStore(t)
+	applyServerPatch(t, dst, 2, 1, p2)
+	checkPending(t, dst, map[uint32]uint32{1: 0, 2: 0}, 1)
+	applyServerPatch(t, dst, 1, 1, p1)
+	checkPending(t, dst, map[uint32]uint32{1: 1, 2: 1}, 0)
+	if got, want := values(t, dst), values(t, b); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestTooManyPending(t *testing.T) {
+	src := newStore(t)
+	pe := logged(t, src, 1, "a")
+	dst := newStore(t)
+	for seq := uint32(2); seq < maxPendingPatches+2; seq++ {
+		applyServerPatch(t, dst, 1, seq, pe)
+	}
+	checkPending(t, dst, map[uint32]uint32{1: 0}, maxPendingPatches)
+	if err := dst.ApplyServerPatch(1, maxPendingPatches+2, pe); err == nil {
+		t.Fatal("expected error")
+	}
+	// Patches that are already buffered are still accepted.
+	applyServerPatch(t, dst, 1, 2, pe)
+	checkPending(t, dst, map[uint32]uint32{1: 0}, maxPendingPatches)
+}
+
+func TestCompactDeps(t *testing.T) {
+	a, b := newStore(t), newStore(t)
+	// Agent 1's patches, as observed by agent 2.
+	var p1 []*PatchEnvelope
+	for i := 0; i < 3; i++ {
+		p1 = append(p1, logged(t, a, 1, "a"))
+	}
+	var p2 []*PatchEnvelope
+	for _, c := range []struct {
+		observe int // number of agent 1's patches to apply before the patch
+		want    map[uint32]uint32
+	}{
+		{1, map[uint32]uint32{1: 1}},
+		{1, nil},
+		{3, map[uint32]uint32{1: 3}},
+	} {
+		for seq := b.Log.head.Get(1) + 1; seq <= uint32(c.observe); seq++ {
+			applyServerPatch(t, b, 1, seq, p1[seq-1])
+		}
+		pe := logged(t, b, 2, "b")
+		var got map[uint32]uint32
+		if pe.Deps != nil {
+			got = *pe.Deps
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("patch %d: got deps %v, want %v", len(p2)+1, got, c.want)
+		}
+		p2 = append(p2, pe)
+	}
+
+	// Agent 2's second patch omits its dependency on agent 1's first patch, but
+	// is still applied only after it.
+	dst := newStore(t)
+	applyServerPatch(t, dst, 2, 2, p2[1])
+	applyServerPatch(t, dst, 2, 1, p2[0])
+	checkPending(t, dst, map[uint32]uint32{1: 0, 2: 0}, 2)
+	applyServerPatch(t, dst, 1, 1, p1[0])
+	checkPending(t, dst, map[uint32]uint32{1: 1, 2: 2}, 0)
+}
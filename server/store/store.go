@@ -2,20 +2,16 @@
 package store
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"log"
-	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/asadovsky/cdb/server/common"
 	"github.com/asadovsky/cdb/server/dtypes/cvalue"
-	"github.com/asadovsky/cdb/server/dtypes/util"
-)
-
-var (
-	errNotImplemented = errors.New("not implemented")
+	"github.com/asadovsky/cdb/server/store/engine"
 )
 
 func assert(b bool, v ...interface{}) {
@@ -25,127 +21,495 @@ func assert(b bool, v ...interface{}) {
 }
 
 type Store struct {
-	Log *Log
-	// Maps key to value.
-	m map[string]*ValueEnvelope
+	Log     *Log
+	e       engine.Engine
+	pending pendingPatches
 }
 
-// OpenStore returns a store.
-func OpenStore(mu *sync.Mutex) *Store {
-	// TODO: Persistence.
-	return &Store{
-		Log: &Log{
-			cond: sync.NewCond(mu),
-			m:    map[uint32][]*PatchEnvelope{},
-			head: &common.VersionVector{},
-		},
-		m: map[string]*ValueEnvelope{},
+// OpenStore returns a store. If dir is non-empty, the store is persisted in the
+// given directory using the on-disk engine; otherwise, it is kept in memory.
+func OpenStore(mu *sync.Mutex, dir string) (*Store, error) {
+	if dir == "" {
+		return NewStore(mu, engine.NewMemEngine())
 	}
+	e, err := engine.OpenDiskEngine(dir)
+	if err != nil {
+		return nil, err
+	}
+	s, err := NewStore(mu, e)
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+	return s, nil
 }
 
-func (s *Store) getOrCreateValueEnvelope(key, dtype string) (*ValueEnvelope, error) {
-	valueEnv, ok := s.m[key]
-	if !ok {
-		zeroValue, err := util.NewZeroValue(dtype)
-		if err != nil {
-			return nil, err
-		}
-		valueEnv = &ValueEnvelope{DType: dtype, Value: zeroValue}
-		s.m[key] = valueEnv
+// NewStore returns a store backed by the given engine, which may already hold a
+// store's contents. The store takes ownership of the engine.
+func NewStore(mu *sync.Mutex, e engine.Engine) (*Store, error) {
+	e = &internalEngine{e}
+	l, err := openLog(mu, e)
+	if err != nil {
+		return nil, err
 	}
-	return valueEnv, nil
+	return &Store{Log: l, e: e}, nil
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return s.e.Close()
 }
 
-// TODO: Make it so a deletion trumps any concurrent ops on the deleted object.
-// In other words, the key-value store should behave like a map CRDT. Seems we
-// need a tombstone with an attached version vector.
+// Engine keys for values. A value's key is prefixed by its collection's name,
+// which cannot contain NUL.
+const valuePrefix = "v/"
 
-// ApplyServerPatch applies the given encoded patch, if needed. Mutex must be
-// held.
-func (s *Store) ApplyServerPatch(agentId, agentSeq uint32, key, dtype, patch string) error {
-	if dtype == cvalue.DTypeDelete {
-		return errNotImplemented
+func valueKey(collection, key string) string {
+	return valuePrefix + collection + "\x00" + key
+}
+
+// collectionValuePrefix returns the prefix of the engine keys of the values in
+// the given collection.
+func collectionValuePrefix(collection string) string {
+	return valuePrefix + collection + "\x00"
+}
+
+// loadValueEnvelope returns the value envelope for the given key, which may be
+// modified without affecting the store. Returns an empty (deleted) envelope if
+// the key does not exist. Changes are committed with putValueEnvelope.
+func (s *Store) loadValueEnvelope(collection, key string) (*ValueEnvelope, error) {
+	buf, err := s.e.Get(valueKey(collection, key))
+	if err == engine.ErrNotFound {
+		return &ValueEnvelope{}, nil
+	} else if err != nil {
+		return nil, err
 	}
-	vec := s.Log.Head()
-	wantSeq := vec.Get(agentId) + 1
-	if agentSeq > wantSeq {
-		return fmt.Errorf("unexpected patch for agent %d: got %d, want %d", agentId, agentSeq, wantSeq)
-	} else if agentSeq < wantSeq {
-		log.Printf("already got patch for agent %d: got %d, want %d", agentId, agentSeq, wantSeq)
+	ev, err := unmarshalEncodedValue(buf)
+	if err != nil {
+		return nil, internal(fmt.Errorf("invalid value for key %q: %v", key, err))
+	}
+	return decodeValueEnvelope(ev)
+}
+
+// putValueEnvelope adds a write of the given value envelope to the given batch.
+func putValueEnvelope(b *engine.Batch, collection, key string, ve *ValueEnvelope) error {
+	ev, err := ve.encode()
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	b.Put(valueKey(collection, key), buf)
+	return nil
+}
+
+func unmarshalEncodedValue(buf []byte) (*EncodedValue, error) {
+	var ev EncodedValue
+	if err := json.Unmarshal(buf, &ev); err != nil {
+		return nil, err
+	}
+	return &ev, nil
+}
+
+// The key-value store behaves like a map CRDT: a deletion trumps any concurrent
+// ops on the deleted object. Each deletion carries a version vector, and each
+// key has a tombstone, the merge of the version vectors of all deletions of that
+// key. Each non-deletion patch carries the tombstone observed by its creator.
+// A patch is applied iff its creator had observed every deletion we know of;
+// otherwise, the patch is concurrent with (or precedes) some deletion, and is
+// dropped. If the creator had observed deletions we have not yet seen, we apply
+// those deletions before applying the patch. Destroying a collection deletes
+// its keys; see collection.go.
+//
+// Patch application is transactional: patches are applied to copies of the
+// affected envelopes, and the copies are written in the same engine batch as
+// the log record, once the patch has been applied without error.
+
+// applyServerPatch applies the given patch, identified by the given dot, adding
+// the resulting writes to the given batch. Records the local effect of the
+// patch in pe.
+func (s *Store) applyServerPatch(b *engine.Batch, dot common.Dot, pe *PatchEnvelope) error {
+	if pe.DType == DTypeBatch {
+		return s.applyServerBatch(b, dot, pe)
+	}
+	ce, err := s.loadCollection(pe.Collection)
+	if err != nil {
+		return err
+	}
+	switch pe.DType {
+	case DTypeCreateCollection:
+		if err := checkCollectionName(pe.Collection); err != nil {
+			return err
+		}
+		if ce.tombstone().Contains(dot) {
+			pe.Dropped = true
+			return nil
+		}
+		ce.Creates = append(ce.Creates, dot)
+		return putCollection(b, pe.Collection, ce)
+	case DTypeDestroyCollection:
+		vec := &common.VersionVector{}
+		if err := vec.UnmarshalJSON([]byte(pe.Patch)); err != nil {
+			return err
+		}
+		if vec.Leq(ce.tombstone()) {
+			pe.Dropped = true
+			return nil
+		}
+		return s.destroyCollection(b, pe.Collection, ce, vec)
+	}
+	ve, err := s.loadValueEnvelope(pe.Collection, pe.Key)
+	if err != nil {
+		return err
+	}
+	ts := effectiveTombstone(ce, ve)
+	if pe.DType == cvalue.DTypeDelete {
+		vec := &common.VersionVector{}
+		if err := vec.UnmarshalJSON([]byte(pe.Patch)); err != nil {
+			return err
+		}
+		if vec.Leq(ts) {
+			pe.Dropped = true
+			return nil
+		}
+		ve.delete(vec)
+		return putValueEnvelope(b, pe.Collection, pe.Key, ve)
+	}
+	observed := pe.Tombstone
+	if observed == nil {
+		observed = &common.VersionVector{}
+	}
+	if !ts.Leq(observed) {
+		pe.Dropped = true
 		return nil
 	}
-	ve, err := s.getOrCreateValueEnvelope(key, dtype)
+	if !observed.Leq(ts) {
+		pe.Reset = !ve.Deleted()
+		ve.delete(observed)
+	}
+	if err := ve.create(pe.DType); err != nil {
+		return err
+	}
+	if err := ve.Value.ApplyServerPatch(pe.Patch); err != nil {
+		return err
+	}
+	return putValueEnvelope(b, pe.Collection, pe.Key, ve)
+}
+
+// ApplyServerPatch applies the given patch, if needed. If the patch arrived
+// before its dependencies (earlier patches by its creator, or patches it
+// causally depends on), it is buffered until they have been applied. Applying
+// a patch may apply buffered patches as well. The patch's LocalSeq and local
+// effect fields are populated once it is applied. Mutex must be held.
+func (s *Store) ApplyServerPatch(agentId, agentSeq uint32, pe *PatchEnvelope) error {
+	if have := s.Log.head.Get(agentId); agentSeq <= have {
+		log.Printf("already got patch for agent %d: got %d, have %d", agentId, agentSeq, have)
+		return nil
+	}
+	ok, err := s.ready(agentId, agentSeq, pe)
 	if err != nil {
 		return err
+	} else if !ok {
+		return s.pending.add(agentId, agentSeq, pe)
+	}
+	if err := s.applyServerPatchNow(agentId, agentSeq, pe); err != nil {
+		return err
 	}
-	if err := ve.Value.ApplyServerPatch(patch); err != nil {
+	return s.applyPending()
+}
+
+// applyServerPatchNow applies the given patch, whose dependencies must have been
+// applied.
+func (s *Store) applyServerPatchNow(agentId, agentSeq uint32, pe *PatchEnvelope) error {
+	b := &engine.Batch{}
+	if err := s.applyServerPatch(b, common.Dot{AgentId: agentId, AgentSeq: agentSeq}, pe); err != nil {
 		return err
 	}
-	// TODO: Commit changes iff there were no errors.
-	_, err = s.Log.push(agentId, key, dtype, patch)
+	_, err := s.Log.push(b, agentId, pe)
 	return err
 }
 
-// ApplyClientPatch applies the given encoded patch and returns the local
-// sequence number for the written log record. Mutex must be held.
-func (s *Store) ApplyClientPatch(agentId uint32, key, dtype, patch string) (uint32, error) {
+// applyClientPatch applies the given encoded patch, for the given key in the
+// given collection, created at time t by the given agent, whose knowledge
+// (including the patch) is vec. Adds the resulting writes to the given batch,
+// and returns the patch to log. If dtype is "delete", deletes the value for the
+// given key, ignoring the patch.
+func (s *Store) applyClientPatch(b *engine.Batch, agentId uint32, vec *common.VersionVector, t time.Time, collection, key, dtype, patch string) (*PatchEnvelope, error) {
+	if IsCollectionPatch(dtype) || dtype == DTypeBatch {
+		return nil, fmt.Errorf("invalid dtype: %s", dtype)
+	}
+	ce, err := s.loadCollection(collection)
+	if err != nil {
+		return nil, err
+	}
+	if !ce.exists(collection) {
+		return nil, fmt.Errorf("collection %q does not exist", collection)
+	}
+	ve, err := s.loadValueEnvelope(collection, key)
+	if err != nil {
+		return nil, err
+	}
+	pe := &PatchEnvelope{Collection: collection, Key: key, DType: dtype, Time: t}
 	if dtype == cvalue.DTypeDelete {
-		return 0, errNotImplemented
+		buf, err := vec.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		pe.Patch = string(buf)
+		ve.delete(vec)
+	} else {
+		if ve.Tombstone != nil || ce.Tombstone != nil {
+			pe.Tombstone = effectiveTombstone(ce, ve)
+		}
+		if err := ve.create(dtype); err != nil {
+			return nil, err
+		}
+		if pe.Patch, err = ve.Value.ApplyClientPatch(agentId, vec, t, patch); err != nil {
+			return nil, err
+		}
 	}
+	if err := putValueEnvelope(b, collection, key, ve); err != nil {
+		return nil, err
+	}
+	return pe, nil
+}
+
+// ApplyClientPatch applies the given encoded patch, for the given key in the
+// given collection, created at time t, and returns the local sequence number
+// for the written log record. If dtype is "delete", deletes the value for the
+// given key, ignoring the patch. Mutex must be held.
+func (s *Store) ApplyClientPatch(agentId uint32, t time.Time, collection, key, dtype, patch string) (uint32, error) {
 	// Build incremented version vector to pass to Value.ApplyPatch.
 	vec := s.Log.Head()
 	vec.Put(agentId, vec.Get(agentId)+1)
-	ve, err := s.getOrCreateValueEnvelope(key, dtype)
+	b := &engine.Batch{}
+	pe, err := s.applyClientPatch(b, agentId, vec, t, collection, key, dtype, patch)
 	if err != nil {
 		return 0, err
 	}
-	patch, err = ve.Value.ApplyClientPatch(agentId, vec, time.Now(), patch)
+	return s.Log.pushNew(b, agentId, pe)
+}
+
+// Truncate discards log entries at or below the given version vector, which
+// must be causally stable, i.e. every patch at or below it must have been
+// applied by every replica. Mutex must be held.
+func (s *Store) Truncate(vec *common.VersionVector) error {
+	return s.Log.truncate(vec)
+}
+
+// MergeValues merges the given collections and their values, which reflect the
+// patches at or below vec, into the store, and advances the log to include vec.
+// Values are merged as follows: if one side has observed a deletion (of the key,
+// or of its collection) the other has not, that side's patches were all
+// concurrent with (or preceded) the deletion, so its value is dropped;
+// otherwise, the values are merged by their dtypes. Patches at or below vec
+// cannot be served from the log thereafter, so readers behind vec must fetch
+// values instead. t is the latest creation time of any patch reflected in the
+// given values. Buffered server patches that the merge makes ready are applied
+// as well. Mutex must be held.
+func (s *Store) MergeValues(collections map[string]*EncodedCollection, vec *common.VersionVector, t time.Time) error {
+	head := s.Log.Head()
+	b := &engine.Batch{}
+	for name, ec := range collections {
+		if err := checkCollectionName(name); err != nil {
+			return err
+		}
+		ce, err := s.loadCollection(name)
+		if err != nil {
+			return err
+		}
+		other := &ec.CollectionEnvelope
+		if err := putCollection(b, name, mergeCollections(ce, head, other, vec)); err != nil {
+			return err
+		}
+		values := ec.Values
+		if !other.tombstone().Leq(ce.tombstone()) {
+			// The other side has destroyed the collection in ways we have not seen,
+			// so our keys that it lacks must be merged (with its deleted values) as
+			// well.
+			values = map[string]*EncodedValue{}
+			it := s.NewIterator(name)
+			for it.Advance() {
+				values[it.Key()] = &EncodedValue{}
+			}
+			if err := it.Err(); err != nil {
+				return err
+			}
+			for key, ev := range ec.Values {
+				values[key] = ev
+			}
+		}
+		for key, ev := range values {
+			if err := s.mergeValue(b, name, key, ce, other, ev, head, vec); err != nil {
+				return fmt.Errorf("failed to merge value for key %q in collection %q: %w", key, name, err)
+			}
+		}
+	}
+	if err := s.Log.advance(b, vec, t); err != nil {
+		return err
+	}
+	return s.applyPending()
+}
+
+// mergeValue merges the given value into the store, where ce and other are the
+// envelopes of the key's collection on each side, and adds the resulting writes
+// to the given batch. See MergeValues.
+func (s *Store) mergeValue(b *engine.Batch, collection, key string, ce, otherCe *CollectionEnvelope, ev *EncodedValue, head, vec *common.VersionVector) error {
+	other, err := decodeValueEnvelope(ev)
 	if err != nil {
-		return 0, err
+		return err
+	}
+	ve, err := s.loadValueEnvelope(collection, key)
+	if err != nil {
+		return err
 	}
-	// TODO: Commit changes iff there were no errors.
-	return s.Log.push(agentId, key, dtype, patch)
+	ts, ots := effectiveTombstone(ce, ve), effectiveTombstone(otherCe, other)
+	if !ts.Leq(ots) {
+		// The other value is dropped.
+		if !ots.Leq(ts) {
+			// So is ours.
+			ve.delete(ots)
+		}
+		return putValueEnvelope(b, collection, key, ve)
+	} else if !ots.Leq(ts) {
+		// Our value is dropped. The other value's tombstone, together with the
+		// merged collection tombstone, covers ours.
+		return putValueEnvelope(b, collection, key, other)
+	}
+	if other.Deleted() {
+		return nil
+	}
+	if err := ve.create(other.DType); err != nil {
+		return err
+	}
+	if err := ve.Value.Merge(head, ev.Value, vec); err != nil {
+		return err
+	}
+	return putValueEnvelope(b, collection, key, ve)
+}
+
+// EncodeValues returns all collections, along with all their values (including
+// deleted values), keyed by collection name. Mutex must be held.
+func (s *Store) EncodeValues() (map[string]*EncodedCollection, error) {
+	res := map[string]*EncodedCollection{}
+	get := func(name string) *EncodedCollection {
+		if _, ok := res[name]; !ok {
+			res[name] = &EncodedCollection{Values: map[string]*EncodedValue{}}
+		}
+		return res[name]
+	}
+	stream := s.e.Scan(collectionPrefix, engine.PrefixLimit(collectionPrefix))
+	for stream.Advance() {
+		name := strings.TrimPrefix(stream.Key(), collectionPrefix)
+		if err := json.Unmarshal(stream.Value(), &get(name).CollectionEnvelope); err != nil {
+			return nil, internal(fmt.Errorf("invalid envelope for collection %q: %v", name, err))
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	stream = s.e.Scan(valuePrefix, engine.PrefixLimit(valuePrefix))
+	for stream.Advance() {
+		parts := strings.SplitN(strings.TrimPrefix(stream.Key(), valuePrefix), "\x00", 2)
+		ev, err := unmarshalEncodedValue(stream.Value())
+		if err != nil {
+			return nil, internal(fmt.Errorf("invalid value for key %q: %v", parts[1], err))
+		}
+		get(parts[0]).Values[parts[1]] = ev
+	}
+	if err := stream.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
 ////////////////////////////////////////////////////////////
 // StoreIterator
 
 type StoreIterator struct {
-	s    *Store
-	keys []string
-	pos  int // current position within keys
+	stream engine.Stream
+	prefix string // engine key prefix of the collection's values
+	key    string
+	ve     *ValueEnvelope
+	err    error
+}
+
+// NewIterator returns an iterator for all stored key-value pairs in the given
+// collection, skipping deleted values. Iteration order matches lexicographic
+// key order. The store must not be modified while the iterator is in use.
+func (s *Store) NewIterator(collection string) *StoreIterator {
+	return s.NewRangeIterator(collection, "", "", false)
 }
 
-// NewIterator returns an iterator for stored key-value pairs. Iteration order
-// matches lexicographic key order. The store must not be modified while the
-// iterator is in use.
-func (s *Store) NewIterator() *StoreIterator {
-	keys := make([]string, 0, len(s.m))
-	for k := range s.m {
-		keys = append(keys, k)
+// NewRangeIterator is like NewIterator, but only iterates over keys in
+// [start, limit), in reverse order if reverse is true. An empty limit means no
+// upper bound.
+func (s *Store) NewRangeIterator(collection, start, limit string, reverse bool) *StoreIterator {
+	prefix := collectionValuePrefix(collection)
+	engineLimit := engine.PrefixLimit(prefix)
+	if limit != "" {
+		engineLimit = valueKey(collection, limit)
 	}
-	sort.Strings(keys)
-	return &StoreIterator{s: s, keys: keys, pos: -1}
+	it := &StoreIterator{prefix: prefix}
+	if reverse {
+		it.stream = s.e.ReverseScan(valueKey(collection, start), engineLimit)
+	} else {
+		it.stream = s.e.Scan(valueKey(collection, start), engineLimit)
+	}
+	return it
+}
+
+// NewPrefixIterator is like NewIterator, but only iterates over keys with the
+// given prefix, in reverse order if reverse is true.
+func (s *Store) NewPrefixIterator(collection, prefix string, reverse bool) *StoreIterator {
+	start, limit := PrefixRange(prefix)
+	return s.NewRangeIterator(collection, start, limit, reverse)
+}
+
+// PrefixRange returns the range [start, limit) of keys with the given prefix.
+// An empty limit means no upper bound.
+func PrefixRange(prefix string) (string, string) {
+	return prefix, engine.PrefixLimit(prefix)
 }
 
 // Advance advances the iterator, staging the next value. Must be called to
 // stage the first value.
 func (it *StoreIterator) Advance() bool {
-	it.pos++
-	return it.pos < len(it.keys)
+	if it.err != nil {
+		return false
+	}
+	for it.stream.Advance() {
+		it.key = strings.TrimPrefix(it.stream.Key(), it.prefix)
+		ev, err := unmarshalEncodedValue(it.stream.Value())
+		if err != nil {
+			it.err = internal(fmt.Errorf("invalid value for key %q: %v", it.key, err))
+			return false
+		}
+		if ev.DType == "" {
+			continue
+		}
+		if it.ve, it.err = decodeValueEnvelope(ev); it.err != nil {
+			return false
+		}
+		return true
+	}
+	it.err = it.stream.Err()
+	return false
 }
 
 // Key returns the current key.
 func (it *StoreIterator) Key() string {
-	return it.keys[it.pos]
+	return it.key
 }
 
 // Value returns the current value.
 func (it *StoreIterator) Value() *ValueEnvelope {
-	return it.s.m[it.keys[it.pos]]
+	return it.ve
 }
 
 // Err returns a non-nil error iff the iterator encountered an error.
 func (it *StoreIterator) Err() error {
-	return nil
+	return it.err
 }
@@ -0,0 +1,189 @@
+package store
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+	"github.com/asadovsky/cdb/server/store/engine"
+)
+
+func newStore(t *testing.T) *Store {
+	s, err := NewStore(&sync.Mutex{}, engine.NewMemEngine())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// dump returns the contents of the store's engine.
+func dump(t *testing.T, s *Store) map[string]string {
+	res := map[string]string{}
+	st := s.e.Scan("", "")
+	for st.Advance() {
+		res[st.Key()] = string(st.Value())
+	}
+	if err := st.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// checkUnchanged checks that the store's engine holds the given contents.
+func checkUnchanged(t *testing.T, s *Store, want map[string]string) {
+	t.Helper()
+	if got := dump(t, s); !reflect.DeepEqual(got, want) {
+		t.Fatalf("store modified: got %v, want %v", got, want)
+	}
+}
+
+const (
+	// goodPatch inserts "ab" into an empty string.
+	goodPatch = `["ci,,,ab"]`
+	// badPatch inserts "ab", then fails, since a patch may insert only once.
+	badPatch = `["ci,,,ab","ci,,,c"]`
+)
+
+// serverPatch applies the given client patch to src as agent 2, and returns the
+// logged patch.
+func serverPatch(t *testing.T, src *Store, patch string) *PatchEnvelope {
+	if _, err := src.ApplyClientPatch(2, time.Unix(1, 0), DefaultCollection, "k", cvalue.DTypeCString, patch); err != nil {
+		t.Fatal(err)
+	}
+	pe, err := src.Log.read(2, src.Log.head.Get(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pe
+}
+
+func TestBadClientOpAppliesNothing(t *testing.T) {
+	s := newStore(t)
+	ts := time.Unix(1, 0)
+	if _, err := s.ApplyClientPatch(1, ts, DefaultCollection, "k", cvalue.DTypeCString, goodPatch); err != nil {
+		t.Fatal(err)
+	}
+	want := dump(t, s)
+	if _, err := s.ApplyClientPatch(1, ts, DefaultCollection, "k", cvalue.DTypeCString, badPatch); err == nil {
+		t.Fatal("expected error")
+	}
+	checkUnchanged(t, s, want)
+	if got := s.Log.head.Get(1); got != 1 {
+		t.Fatalf("got head %d, want 1", got)
+	}
+}
+
+func TestBadServerOpAppliesNothing(t *testing.T) {
+	src := newStore(t)
+	p1 := serverPatch(t, src, `["ci,,,a"]`)
+	p2 := serverPatch(t, src, `["ci,,,b"]`)
+	s := newStore(t)
+	if err := s.ApplyServerPatch(2, 1, p1); err != nil {
+		t.Fatal(err)
+	}
+	want := dump(t, s)
+	// p2's insert, followed by a client op, which is not allowed in server
+	// patches.
+	bad := *p2
+	bad.Patch = strings.TrimSuffix(p2.Patch, "]") + `,"ci,,,z"]`
+	if err := s.ApplyServerPatch(2, 2, &bad); err == nil {
+		t.Fatal("expected error")
+	}
+	checkUnchanged(t, s, want)
+	if got := s.Log.head.Get(2); got != 1 {
+		t.Fatalf("got head %d, want 1", got)
+	}
+	if err := s.ApplyServerPatch(2, 2, p2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failingEngine is an engine whose writes fail.
+type failingEngine struct {
+	engine.Engine
+}
+
+func (failingEngine) Write(b *engine.Batch) error {
+	return errors.New("write failed")
+}
+
+func TestInternalErrors(t *testing.T) {
+	s, err := NewStore(&sync.Mutex{}, failingEngine{engine.NewMemEngine()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := time.Unix(1, 0)
+	if _, err := s.ApplyClientPatch(1, ts, DefaultCollection, "k", cvalue.DTypeCString, goodPatch); !IsInternal(err) {
+		t.Fatalf("got %v, want internal error", err)
+	}
+	if _, err := s.ApplyClientPatch(1, ts, DefaultCollection, "k", cvalue.DTypeCString, badPatch); err == nil || IsInternal(err) {
+		t.Fatalf("got %v, want non-internal error", err)
+	}
+}
+
+// iterKeys returns the keys visited by the given iterator.
+func iterKeys(t *testing.T, it *StoreIterator) []string {
+	res := []string{}
+	for it.Advance() {
+		res = append(res, it.Key())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestIterators(t *testing.T) {
+	s := newStore(t)
+	ts := time.Unix(1, 0)
+	put := func(collection, key, dtype string) {
+		if _, err := s.ApplyClientPatch(1, ts, collection, key, dtype, `{"Add":1}`); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, key := range []string{"a", "ab", "abc", "b", "ba", "c", "d"} {
+		put(DefaultCollection, key, cvalue.DTypeCCounter)
+	}
+	put(DefaultCollection, "c", "delete")
+	if _, err := s.CreateCollection(1, ts, "other"); err != nil {
+		t.Fatal(err)
+	}
+	put("other", "b", cvalue.DTypeCCounter)
+
+	for _, c := range []struct {
+		it   *StoreIterator
+		want []string
+	}{
+		// Deleted values and other collections' values are skipped.
+		{s.NewIterator(DefaultCollection), []string{"a", "ab", "abc", "b", "ba", "d"}},
+		{s.NewIterator("other"), []string{"b"}},
+		{s.NewRangeIterator(DefaultCollection, "ab", "ba", false), []string{"ab", "abc", "b"}},
+		{s.NewRangeIterator(DefaultCollection, "ab", "ba", true), []string{"b", "abc", "ab"}},
+		{s.NewRangeIterator(DefaultCollection, "b", "", false), []string{"b", "ba", "d"}},
+		{s.NewRangeIterator(DefaultCollection, "b", "", true), []string{"d", "ba", "b"}},
+		{s.NewRangeIterator(DefaultCollection, "bb", "e", false), []string{"d"}},
+		{s.NewRangeIterator(DefaultCollection, "c", "b", false), []string{}},
+		{s.NewPrefixIterator(DefaultCollection, "ab", false), []string{"ab", "abc"}},
+		{s.NewPrefixIterator(DefaultCollection, "ab", true), []string{"abc", "ab"}},
+		{s.NewPrefixIterator(DefaultCollection, "", false), []string{"a", "ab", "abc", "b", "ba", "d"}},
+		{s.NewPrefixIterator(DefaultCollection, "z", false), []string{}},
+	} {
+		if got := iterKeys(t, c.it); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("got %v, want %v", got, c.want)
+		}
+	}
+}
+
+func TestServerCreateCollectionBadName(t *testing.T) {
+	s := newStore(t)
+	want := dump(t, s)
+	pe := &PatchEnvelope{Collection: "a\x00b", DType: DTypeCreateCollection}
+	if err := s.ApplyServerPatch(2, 1, pe); err == nil {
+		t.Fatal("expected error")
+	}
+	checkUnchanged(t, s, want)
+}
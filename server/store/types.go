@@ -1,22 +1,133 @@
 package store
 
 import (
+	"fmt"
+	"time"
+
+	"github.com/asadovsky/cdb/server/common"
 	"github.com/asadovsky/cdb/server/dtypes/cvalue"
+	"github.com/asadovsky/cdb/server/dtypes/util"
 )
 
 // ValueEnvelope represents a value and its associated metadata.
 // Key is of the form [Key], where Key is the object key.
 type ValueEnvelope struct {
 	DType string
-	Value cvalue.CValue
+	Value cvalue.CValue // nil if deleted
+	// Merged version vectors of all deletions of this key. Nil if the key has
+	// never been deleted.
+	Tombstone *common.VersionVector
+}
+
+// Deleted returns true iff the value is deleted.
+func (ve *ValueEnvelope) Deleted() bool {
+	return ve.Value == nil
+}
+
+// tombstone returns the tombstone, or an empty version vector if the value has
+// never been deleted.
+func (ve *ValueEnvelope) tombstone() *common.VersionVector {
+	if ve.Tombstone == nil {
+		return &common.VersionVector{}
+	}
+	return ve.Tombstone
+}
+
+// create sets the value to a zero value of the given dtype if the value is
+// deleted. Returns an error if the existing value has a different dtype.
+func (ve *ValueEnvelope) create(dtype string) error {
+	if !ve.Deleted() {
+		if ve.DType != dtype {
+			return fmt.Errorf("wrong dtype: got %s, want %s", dtype, ve.DType)
+		}
+		return nil
+	}
+	zeroValue, err := util.NewZeroValue(dtype)
+	if err != nil {
+		return err
+	}
+	ve.DType, ve.Value = dtype, zeroValue
+	return nil
+}
+
+// delete deletes the value, merging the given version vector into the
+// tombstone.
+func (ve *ValueEnvelope) delete(vec *common.VersionVector) {
+	if ve.Tombstone == nil {
+		ve.Tombstone = &common.VersionVector{}
+	}
+	ve.Tombstone.Merge(vec)
+	ve.DType, ve.Value = "", nil
+}
+
+// EncodedValue is an encoded value envelope, used to persist and replicate
+// values.
+type EncodedValue struct {
+	DType     string                `json:",omitempty"` // empty if deleted
+	Value     string                `json:",omitempty"` // encoded
+	Tombstone *common.VersionVector `json:",omitempty"`
+}
+
+// encode returns the encoded form of this value envelope.
+func (ve *ValueEnvelope) encode() (*EncodedValue, error) {
+	res := &EncodedValue{DType: ve.DType}
+	if ve.Tombstone != nil {
+		res.Tombstone = ve.Tombstone.Copy()
+	}
+	if !ve.Deleted() {
+		var err error
+		if res.Value, err = ve.Value.Encode(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// decodeValueEnvelope decodes the given encoded value envelope.
+func decodeValueEnvelope(ev *EncodedValue) (*ValueEnvelope, error) {
+	res := &ValueEnvelope{DType: ev.DType}
+	if ev.Tombstone != nil {
+		res.Tombstone = ev.Tombstone.Copy()
+	}
+	if ev.DType != "" {
+		var err error
+		if res.Value, err = util.DecodeValue(ev.DType, ev.Value); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
 }
 
 // PatchEnvelope represents a patch and its associated metadata.
 // Key is of the form [AgentId]:[AgentSeq], where AgentId is the creator's agent
 // id and [AgentSeq] is the creator's sequence number for this patch.
 type PatchEnvelope struct {
-	LocalSeq uint32 // one-based position in local, cross-agent patch log
-	Key      string
-	DType    string
-	Patch    string // encoded
+	LocalSeq   uint32 // one-based position in local, cross-agent patch log
+	Collection string
+	Key        string // empty for collection patches
+	DType      string
+	// Encoded patch. For deletions (of keys or collections), an encoded version
+	// vector representing the deleting agent's knowledge at the time of deletion.
+	Patch string
+	// Tombstone of the key (merged with the tombstone of its collection), as
+	// observed by the patch creator. Nil if the creator had not observed any
+	// deletions of the key or collection. Not used for deletions.
+	Tombstone *common.VersionVector
+	// Hybrid logical clock time at which the creator created the patch.
+	Time time.Time
+	// Patches the creator had applied when it created the patch, other than its
+	// own (which are implied by the patch's sequence number), less those it had
+	// already applied when it created its previous patch (which are implied by
+	// that patch). Nil if none. The patch is applied only after all of these.
+	Deps *common.VersionVector `json:",omitempty"`
+	// For batches, the patches in the batch, in order. Only the LocalSeq, Time,
+	// and Deps fields are used in the enclosing envelope, and only the
+	// Collection, Key, DType, Patch, and Tombstone fields (and local effect
+	// fields) are used in the patches.
+	Batch []*PatchEnvelope `json:",omitempty"`
+
+	// Local effect of applying this patch. Not replicated, but persisted with the
+	// log record for log readers.
+	Dropped bool `json:",omitempty"` // patch had no effect due to a deletion
+	Reset   bool `json:",omitempty"` // value was reset due to a deletion not yet observed locally
 }